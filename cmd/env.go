@@ -0,0 +1,258 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+cmd/env.go - this is the handler for the env command and its subcommands
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/davesheldon/nap/napcontext"
+	"github.com/davesheldon/nap/napenv"
+	"github.com/davesheldon/nap/napsecret"
+
+	"github.com/spf13/cobra"
+)
+
+// envCmd represents the env command
+var envCmd = &cobra.Command{
+	Use:   "env",
+	Short: "Manage environments",
+	Long:  `The env command groups commands for working with environment files.`,
+}
+
+var envShowCmd = &cobra.Command{
+	Use:   "show <target>",
+	Short: "Show the variables a run would start with",
+	Long: `The show command prints the variables a run of the target would start with, given the same --env,
+--param, --env-from-os and --precedence flags and project config, along with where each value came from.
+Secrets are masked.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		runConfig, err := newRunConfig(cmd, args)
+		if err != nil {
+			return err
+		}
+
+		secrets := napsecret.NewMasker()
+
+		startingVariables, err := loadEnvironment(runConfig, secrets)
+		if err != nil {
+			return err
+		}
+
+		// the project config is applied as it is for a run, and the variables it sets are shown when nothing
+		// else sets them
+		napCtx := napcontext.New(".", runConfig.Environments, startingVariables.Environment, nil, true)
+		napCtx.Variables.SetAll(napcontext.OverrideScope, startingVariables.Overrides)
+
+		if err := applyProjectConfig(napCtx, runConfig.Project); err != nil {
+			return err
+		}
+
+		for k := range projectVariables(runConfig.Project) {
+			_, set := startingVariables.Environment[k]
+			_, overridden := startingVariables.Overrides[k]
+
+			if value, ok := napCtx.Variables.Lookup(k); ok && !set && !overridden {
+				startingVariables.Environment[k] = value
+				startingVariables.Origins[k] = runConfig.Project.Path
+			}
+		}
+
+		if runConfig.Project != nil {
+			fmt.Printf("Config: %s\n\n", runConfig.Project.Path)
+		}
+
+		// show where each environment was found, since it may be in one of several folders
+		if len(runConfig.Environments) > 0 {
+			fmt.Println("Environments:")
+
+			for _, v := range runConfig.Environments {
+				found, _ := napenv.FindEnvironment(runConfig.TargetDir, v, runConfig.EnvironmentPath...)
+				fmt.Printf("  %s: %s\n", v, found)
+			}
+
+			fmt.Println()
+		}
+
+		printStartingVariables(startingVariables, secrets)
+
+		return nil
+	},
+}
+
+// printStartingVariables prints each variable with its value and where the value came from, in a table
+func printStartingVariables(startingVariables *napenv.StartingVariables, secrets *napsecret.Masker) {
+	seen := make(map[string]bool)
+	names := []string{}
+
+	for _, variables := range []map[string]string{startingVariables.Environment, startingVariables.Overrides} {
+		for k := range variables {
+			if !seen[k] {
+				seen[k] = true
+				names = append(names, k)
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		fmt.Println("No variables.")
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tVALUE\tSOURCE")
+
+	for _, k := range names {
+		value, overrides := startingVariables.Overrides[k]
+		if !overrides {
+			value = startingVariables.Environment[k]
+		}
+
+		source := startingVariables.Origins[k]
+		if startingVariables.Secrets[k] {
+			source += " (secret)"
+		}
+
+		if overrides {
+			source += " (overrides routine env)"
+		}
+
+		value = strings.NewReplacer("\n", "\\n", "\t", "\\t").Replace(secrets.Mask(value))
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", k, value, source)
+	}
+
+	writer.Flush()
+}
+
+var envEncryptCmd = &cobra.Command{
+	Use:   "encrypt <file>",
+	Short: "Encrypt an environment file",
+	Long: `The encrypt command encrypts an environment file with AES-256-GCM and writes it next to the original
+with a .enc extension, e.g. staging.yml becomes staging.yml.enc. The key is read from --key-file, or
+from the NAP_ENV_KEY or NAP_ENV_KEY_FILE environment variable.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		output, _ := cmd.Flags().GetString("output")
+		if len(output) == 0 {
+			output = args[0] + napenv.EncryptedExtension
+		}
+
+		return transformEnvironment(cmd, args[0], output, napenv.Encrypt)
+	},
+}
+
+var envDecryptCmd = &cobra.Command{
+	Use:   "decrypt <file>",
+	Short: "Decrypt an encrypted environment file",
+	Long: `The decrypt command decrypts an environment file encrypted with nap env encrypt and writes it without
+its .enc extension, e.g. staging.yml.enc becomes staging.yml. Use --output - to print it instead.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		output, _ := cmd.Flags().GetString("output")
+		if len(output) == 0 {
+			if !strings.HasSuffix(args[0], napenv.EncryptedExtension) {
+				return fmt.Errorf("cannot name the decrypted file: %s doesn't end in %s, use --output", args[0], napenv.EncryptedExtension)
+			}
+
+			output = strings.TrimSuffix(args[0], napenv.EncryptedExtension)
+		}
+
+		return transformEnvironment(cmd, args[0], output, napenv.Decrypt)
+	},
+}
+
+var envKeygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate a key for encrypted environments",
+	Long: `The keygen command prints a new random key for nap env encrypt. Keep it out of the repository, e.g. in
+a CI secret set as NAP_ENV_KEY.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := napenv.NewKey()
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(key)
+		return nil
+	},
+}
+
+// transformEnvironment reads input, encrypts or decrypts it and writes the result to output, or to stdout
+// if output is -
+func transformEnvironment(cmd *cobra.Command, input string, output string, transform func([]byte, []byte) ([]byte, error)) error {
+	keyFile, _ := cmd.Flags().GetString("key-file")
+	force, _ := cmd.Flags().GetBool("force")
+
+	key, err := napenv.LoadKey(keyFile)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return err
+	}
+
+	result, err := transform(data, key)
+	if err != nil {
+		return fmt.Errorf("%s: %w", input, err)
+	}
+
+	if output == "-" {
+		_, err = os.Stdout.Write(result)
+		return err
+	}
+
+	if _, err := os.Stat(output); err == nil && !force {
+		return fmt.Errorf("%s already exists, use --force to overwrite it", output)
+	}
+
+	if err := os.WriteFile(output, result, 0600); err != nil {
+		return err
+	}
+
+	fmt.Printf("wrote %s\n", output)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(envCmd)
+	envCmd.AddCommand(envShowCmd, envEncryptCmd, envDecryptCmd, envKeygenCmd)
+
+	addEnvironmentFlags(envShowCmd)
+
+	for _, v := range []*cobra.Command{envEncryptCmd, envDecryptCmd} {
+		v.Flags().String("key-file", "", "read the key from the file at `path` instead of NAP_ENV_KEY or NAP_ENV_KEY_FILE")
+		v.Flags().StringP("output", "o", "", "write to the file at `path`, or - for stdout")
+		v.Flags().BoolP("force", "f", false, "overwrite the output file if it exists")
+	}
+}
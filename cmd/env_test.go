@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnvShow(t *testing.T) {
+	tests := map[string]struct {
+		files    map[string]string
+		args     []string
+		expected map[string][]string
+	}{
+		"project config": {
+			files: map[string]string{
+				"nap.yml": "baseUrl: https://api.example.com\nparams:\n  team: qa\n",
+			},
+			expected: map[string][]string{
+				"baseUrl": {"https://api.example.com", "nap.yml"},
+				"team":    {"qa", "nap.yml"},
+			},
+		},
+		"environments win over the project config": {
+			files: map[string]string{
+				"nap.yml": "baseUrl: https://api.example.com\nparams:\n  team: qa\n",
+				"dev.yml": "baseUrl: http://localhost:8080\n",
+			},
+			args: []string{"--env", "dev"},
+			expected: map[string][]string{
+				"baseUrl": {"http://localhost:8080", "dev.yml"},
+				"team":    {"qa", "nap.yml"},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			test.files["routine.yml"] = "kind: routine\nsteps: []\n"
+
+			for file, contents := range test.files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			chdir(t, dir)
+
+			output := captureOutput(t, func() {
+				if err := execute(t, append([]string{"env", "show", "routine.yml"}, test.args...)...); err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+			})
+
+			rows := make(map[string][]string)
+			for _, line := range strings.Split(output, "\n") {
+				if fields := strings.Fields(line); len(fields) == 3 {
+					rows[fields[0]] = []string{fields[1], filepath.Base(fields[2])}
+				}
+			}
+
+			for k, expected := range test.expected {
+				if actual := rows[k]; len(actual) != 2 || actual[0] != expected[0] || actual[1] != expected[1] {
+					t.Errorf("Expected %s to be %v, got %v in:\n%s", k, expected, actual, output)
+				}
+			}
+		})
+	}
+}
+
+// captureOutput returns what run prints to stdout
+func captureOutput(t *testing.T, run func()) string {
+	t.Helper()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = writer
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- string(data)
+	}()
+
+	run()
+
+	os.Stdout = stdout
+	writer.Close()
+
+	return <-output
+}
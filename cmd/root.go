@@ -46,7 +46,7 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
-	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.nap.yaml)")
+	rootCmd.PersistentFlags().String("config", "", "project config file `path` (default is the nap.yml found by walking up from the target)")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -19,16 +19,22 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/davesheldon/nap/napconfig"
 	"github.com/davesheldon/nap/napcontext"
 	"github.com/davesheldon/nap/napenv"
+	"github.com/davesheldon/nap/napreport"
 	"github.com/davesheldon/nap/naprunner"
+	"github.com/davesheldon/nap/napsecret"
 
 	"github.com/spf13/cobra"
 )
@@ -42,16 +48,49 @@ var runCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		start := time.Now()
 
-		runConfig := newRunConfig(cmd, args)
+		runConfig, err := newRunConfig(cmd, args)
+		if err != nil {
+			cmd.SilenceUsage = true
+			return err
+		}
+
+		secrets := napsecret.NewMasker()
 
-		environmentVariables, err := loadEnvironment(runConfig)
+		startingVariables, err := loadEnvironment(runConfig, secrets)
 		if err != nil {
 			cmd.SilenceUsage = true
 			return err
 		}
 
 		var wg sync.WaitGroup
-		napCtx := napcontext.New(".", runConfig.Environments, environmentVariables, &wg, runConfig.Quiet)
+		napCtx := napcontext.New(".", runConfig.Environments, startingVariables.Environment, &wg, runConfig.Quiet)
+		napCtx.Variables.SetAll(napcontext.OverrideScope, startingVariables.Overrides)
+		napCtx.Variables.MarkStructured(napcontext.EnvironmentScope, startingVariables.Structured)
+		napCtx.Variables.MarkStructured(napcontext.OverrideScope, startingVariables.Structured)
+		napCtx.Secrets = secrets
+		napCtx.FailFast = runConfig.FailFast
+		napCtx.Strict = runConfig.Strict
+		napCtx.SetConcurrency(runConfig.Concurrency)
+		napCtx.EnvironmentPath = runConfig.EnvironmentPath
+
+		if err := applyProjectConfig(napCtx, runConfig.Project); err != nil {
+			cmd.SilenceUsage = true
+			return err
+		}
+
+		// the first interrupt cancels the run so teardown steps can still clean up, a second one exits immediately
+		interrupts := make(chan os.Signal, 2)
+		signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(interrupts)
+
+		go func() {
+			<-interrupts
+			fmt.Println("\nCancelling run, waiting for running and teardown steps to finish (interrupt again to exit now)...")
+			napCtx.Cancel()
+
+			<-interrupts
+			os.Exit(130)
+		}()
 
 		routineResult := naprunner.RunPath(napCtx, runConfig.Target)
 
@@ -67,7 +106,18 @@ var runCmd = &cobra.Command{
 			}
 		} else {
 			for _, err := range routineResult.Errors {
-				fmt.Printf("[ERROR] %s\n", err.Error())
+				fmt.Printf("[ERROR] %s\n", secrets.Mask(err.Error()))
+			}
+
+			for _, err := range routineResult.TeardownErrors {
+				fmt.Printf("[TEARDOWN ERROR] %s\n", secrets.Mask(err.Error()))
+			}
+		}
+
+		for _, v := range runConfig.Reporters {
+			if err := napreport.Write(v.Type, v.Path, routineResult, napCtx); err != nil {
+				cmd.SilenceUsage = true
+				return err
 			}
 		}
 
@@ -84,12 +134,16 @@ var runCmd = &cobra.Command{
 
 		for _, runType := range runTypes {
 			typeStats := runStats.StatsByType[runType]
-			statsPerTypeOutput += fmt.Sprintf("%s:\t%d/%d\n", runType, typeStats.Passing, typeStats.Total)
+			statsPerTypeOutput += fmt.Sprintf("%s:\t%d/%d%s\n", runType, typeStats.Passing, typeStats.Total, formatUncounted(typeStats.Skipped, 0))
 		}
 
-		statsPerTypeOutput += fmt.Sprintf("Total:\t\t%d/%d", runStats.Totals.Passing, runStats.Totals.Total)
+		statsPerTypeOutput += fmt.Sprintf("Total:\t\t%d/%d%s", runStats.Totals.Passing, runStats.Totals.Total, formatUncounted(runStats.Totals.Skipped, runStats.NotRun))
+
+		// a cancelled run fails even if every step that ran passed, as its error and the steps it never ran
+		// aren't counted in the totals
+		passed := runStats.Totals.Total == runStats.Totals.Passing && len(routineResult.Errors) == 0 && runStats.NotRun == 0
 
-		if runStats.Totals.Total == runStats.Totals.Passing {
+		if passed && routineResult.IsPassing() {
 			fmt.Printf("\n%s\n\nSUCCESS! Run finished in %dms.\n", statsPerTypeOutput, end.Sub(start).Milliseconds())
 			return nil
 		} else {
@@ -101,23 +155,68 @@ var runCmd = &cobra.Command{
 	},
 }
 
-func loadEnvironment(runConfig *RunConfig) (map[string]string, error) {
-	environmentVariables := make(map[string]string)
+// loadEnvironment loads the variables the run starts with from each source, merged in order of precedence.
+// secrets they refer to are added to secrets
+func loadEnvironment(runConfig *RunConfig, secrets *napsecret.Masker) (*napenv.StartingVariables, error) {
+	precedence, err := napenv.ParsePrecedence(runConfig.Precedence)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, environmentFileNameOriginal := range runConfig.Environments {
-		result, err := napenv.AddEnvironmentFromPath(runConfig.TargetDir, environmentFileNameOriginal, environmentVariables)
-		if err != nil {
-			return environmentVariables, err
-		}
+	options := &napenv.LoadOptions{
+		WorkingDirectory: runConfig.TargetDir,
+		Files:            runConfig.Environments,
+		SearchPath:       runConfig.EnvironmentPath,
+		Params:           runConfig.Variables,
+		OSPrefixes:       runConfig.EnvFromOS,
+		Precedence:       precedence,
+	}
+
+	if runConfig.Project != nil {
+		options.ConfigParams = runConfig.Project.Params
+		options.ConfigPath = runConfig.Project.Path
+	}
+
+	return napenv.Load(options, secrets)
+}
+
+// applyProjectConfig sets the request defaults and transport from the project config. the base url is
+// set as the baseUrl variable, so an environment can point the run at a different host
+func applyProjectConfig(napCtx *napcontext.Context, project *napconfig.Config) error {
+	if project == nil {
+		return nil
+	}
+
+	transport, err := project.Transport()
+	if err != nil {
+		return fmt.Errorf("%s: %w", project.Path, err)
+	}
 
-		environmentVariables = result
+	napCtx.Transport = transport
+	napCtx.RequestDefaults = &napcontext.RequestDefaults{
+		Timeout: time.Duration(project.TimeoutSeconds) * time.Second,
+		Headers: project.Headers,
 	}
 
-	for k, v := range runConfig.Variables {
-		environmentVariables[k] = v
+	napCtx.Variables.SetAll(napcontext.GlobalScope, projectVariables(project))
+
+	if len(project.BaseUrl) > 0 {
+		napCtx.RequestDefaults.BaseUrl = "${baseUrl}"
 	}
 
-	return environmentVariables, nil
+	return nil
+}
+
+// projectVariables returns the variables the project config sets for the whole run, below every other
+// variable
+func projectVariables(project *napconfig.Config) map[string]string {
+	variables := make(map[string]string)
+
+	if project != nil && len(project.BaseUrl) > 0 {
+		variables["baseUrl"] = project.BaseUrl
+	}
+
+	return variables
 }
 
 type RunConfig struct {
@@ -126,11 +225,22 @@ type RunConfig struct {
 	TargetName   string
 	Environments []string
 	Variables    map[string]string
+	EnvFromOS    []string
+	Precedence   string
 	Verbose      bool
 	Quiet        bool
+	FailFast     bool
+	Strict       bool
+	Concurrency  int
+
+	// the project config, if there is one, and the folders it adds to the environment search
+	Project         *napconfig.Config
+	EnvironmentPath []string
+
+	Reporters []*napconfig.Reporter
 }
 
-func newRunConfig(cmd *cobra.Command, args []string) *RunConfig {
+func newRunConfig(cmd *cobra.Command, args []string) (*RunConfig, error) {
 	config := new(RunConfig)
 	config.Target = args[0]
 	config.TargetDir = filepath.Dir(config.Target)
@@ -138,7 +248,12 @@ func newRunConfig(cmd *cobra.Command, args []string) *RunConfig {
 	config.Environments, _ = cmd.Flags().GetStringArray("env")
 	config.Verbose, _ = cmd.Flags().GetBool("verbose")
 	config.Variables = make(map[string]string)
+	config.EnvFromOS, _ = cmd.Flags().GetStringArray("env-from-os")
+	config.Precedence, _ = cmd.Flags().GetString("precedence")
 	config.Quiet, _ = cmd.Flags().GetBool("quiet")
+	config.FailFast, _ = cmd.Flags().GetBool("fail-fast")
+	config.Strict, _ = cmd.Flags().GetBool("strict")
+	config.Concurrency, _ = cmd.Flags().GetInt("concurrency")
 
 	params, _ := cmd.Flags().GetStringArray("param")
 
@@ -149,13 +264,100 @@ func newRunConfig(cmd *cobra.Command, args []string) *RunConfig {
 		}
 	}
 
-	return config
+	reporters, _ := cmd.Flags().GetStringArray("reporter")
+
+	for _, r := range reporters {
+		typePath := strings.SplitN(r, "=", 2)
+		if len(typePath) != 2 || len(typePath[0]) == 0 || len(typePath[1]) == 0 {
+			return nil, fmt.Errorf("invalid reporter '%s', expected <type>=<path>", r)
+		}
+
+		config.Reporters = append(config.Reporters, &napconfig.Reporter{Type: typePath[0], Path: typePath[1]})
+	}
+
+	project, err := loadProjectConfig(cmd, config.TargetDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the project config only fills in what the flags leave out
+	if project != nil {
+		config.Project = project
+		config.EnvironmentPath = project.EnvPath
+
+		if !cmd.Flags().Changed("env") {
+			config.Environments = project.Env
+		}
+
+		if !cmd.Flags().Changed("concurrency") && project.Concurrency > 0 {
+			config.Concurrency = project.Concurrency
+		}
+
+		if len(config.Reporters) == 0 {
+			config.Reporters = project.Reporters
+		}
+	}
+
+	for _, v := range config.Reporters {
+		if !napreport.IsSupported(v.Type) {
+			return nil, fmt.Errorf("unknown reporter type '%s'", v.Type)
+		}
+	}
+
+	return config, nil
+}
+
+// loadProjectConfig loads the config file given by --config, or else the nap.yml found by walking up from
+// the target's folder. it returns nil if there isn't one
+func loadProjectConfig(cmd *cobra.Command, targetDir string) (*napconfig.Config, error) {
+	path, _ := cmd.Flags().GetString("config")
+
+	if len(path) == 0 {
+		found, err := napconfig.Find(targetDir)
+		if err != nil || len(found) == 0 {
+			return nil, err
+		}
+
+		path = found
+	}
+
+	return napconfig.LoadFromPath(path)
 }
 
 func init() {
 	rootCmd.AddCommand(runCmd)
 
-	runCmd.Flags().StringArrayP("env", "e", []string{}, "add environment variables from a file `path`")
-	runCmd.Flags().StringArrayP("param", "p", []string{}, "add a single variable to the run as a `<name>=<value>` pair")
+	addEnvironmentFlags(runCmd)
 	runCmd.Flags().BoolP("quiet", "q", false, "suppress output until the end")
+	runCmd.Flags().Int("concurrency", 0, "the most requests to have in flight at once across the whole run (0 for no limit)")
+	runCmd.Flags().Bool("fail-fast", false, "stop the whole run, including running subroutines, at the first failure")
+	runCmd.Flags().Bool("strict", false, "fail a request or routine before it runs if it refers to a variable that isn't set")
+	runCmd.Flags().StringArray("reporter", []string{}, "write the results to a report as a `<type>=<path>` pair, where type is json or junit")
+}
+
+// formatUncounted describes the steps that didn't run and so aren't counted as passing or failing
+func formatUncounted(skipped int, notRun int) string {
+	uncounted := []string{}
+
+	if skipped > 0 {
+		uncounted = append(uncounted, fmt.Sprintf("%d skipped", skipped))
+	}
+
+	if notRun > 0 {
+		uncounted = append(uncounted, fmt.Sprintf("%d not run", notRun))
+	}
+
+	if len(uncounted) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(" (%s)", strings.Join(uncounted, ", "))
+}
+
+// addEnvironmentFlags adds the flags that say which variables a run starts with
+func addEnvironmentFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayP("env", "e", []string{}, "add environment variables from a file `path`")
+	cmd.Flags().StringArrayP("param", "p", []string{}, "add a single variable to the run as a `<name>=<value>` pair")
+	cmd.Flags().StringArray("env-from-os", []string{}, "add the nap process's environment variables starting with `prefix`, with the prefix removed")
+	cmd.Flags().String("precedence", "os,files,params,routine", "the `order` in which variable sources override each other, lowest first")
 }
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func TestRunExitStatus(t *testing.T) {
+	started := make(chan struct{}, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/started" {
+			started <- struct{}{}
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		files      map[string]string
+		interrupt  bool
+		shouldPass bool
+	}{
+		"passing run": {
+			files: map[string]string{
+				"routine.yml": "kind: routine\nsteps:\n  - run: request.yml\n",
+				"request.yml": "kind: request\npath: ${baseUrl}/ok\n",
+			},
+			shouldPass: true,
+		},
+		"exported variable that was never set": {
+			files: map[string]string{
+				"routine.yml": "kind: routine\nsteps:\n  - run: login.yml\n",
+				"login.yml":   "kind: routine\nexports: [token]\nsteps:\n  - run: request.yml\n",
+				"request.yml": "kind: request\npath: ${baseUrl}/ok\n",
+			},
+			shouldPass: false,
+		},
+		"cancelled run": {
+			files: map[string]string{
+				// the script keeps the run busy while it's interrupted, so the last step never runs
+				"routine.yml": "kind: routine\nsteps:\n  - run: started.yml\n  - run: wait.js\n  - run: request.yml\n",
+				"started.yml": "kind: request\npath: ${baseUrl}/started\n",
+				"wait.js":     "var end = Date.now() + 500; while (Date.now() < end) {}",
+				"request.yml": "kind: request\npath: ${baseUrl}/ok\n",
+			},
+			interrupt:  true,
+			shouldPass: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			for file, contents := range test.files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// targets are given relative to the current directory, as they would be from a shell
+			chdir(t, dir)
+
+			if test.interrupt {
+				go func() {
+					<-started
+					syscall.Kill(os.Getpid(), syscall.SIGINT)
+				}()
+			}
+
+			err := execute(t, "run", "routine.yml", "-q", "-p", "baseUrl="+server.URL)
+
+			if (err == nil) != test.shouldPass {
+				t.Errorf("Expected passing=%t, got %v", test.shouldPass, err)
+			}
+		})
+	}
+}
+
+func TestRunProgress(t *testing.T) {
+	tests := map[string]string{
+		"repeat":           "kind: routine\nsteps:\n  - run: step.js\n    repeat: 2\n",
+		"forEach":          "kind: routine\nsteps:\n  - run: step.js\n    forEach: [a, b, c]\n  - run: step.js\n",
+		"parallel forEach": "kind: routine\nsteps:\n  - run: step.js\n    forEach: [a, b, c]\n    parallel: true\n",
+		"subroutine loop":  "kind: routine\nsteps:\n  - run: inner.yml\n    repeat: 3\n",
+	}
+
+	for name, routine := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := map[string]string{
+				"routine.yml": routine,
+				"inner.yml":   "kind: routine\nsteps:\n  - run: step.js\n    repeat: 2\n",
+				"step.js":     "console.log('ran')",
+			}
+
+			for file, contents := range files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			chdir(t, dir)
+
+			// without -q, each routine shows a progress bar that counts its steps
+			if err := execute(t, "run", "routine.yml"); err != nil {
+				t.Errorf("Expected passing, got %v", err)
+			}
+		})
+	}
+}
+
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+// execute runs nap with args, as if from the command line. a non-nil error means nap exits with status 1.
+// flags are reset first, since cobra keeps their values between runs
+func execute(t *testing.T, args ...string) error {
+	t.Helper()
+
+	for _, command := range []*cobra.Command{rootCmd, runCmd, envCmd, envShowCmd} {
+		for _, flags := range []*pflag.FlagSet{command.Flags(), command.PersistentFlags()} {
+			flags.VisitAll(func(flag *pflag.Flag) {
+				if value, ok := flag.Value.(pflag.SliceValue); ok {
+					value.Replace([]string{})
+				} else if err := flag.Value.Set(flag.DefValue); err != nil {
+					panic(fmt.Sprintf("cannot reset --%s: %v", flag.Name, err))
+				}
+
+				flag.Changed = false
+			})
+		}
+	}
+
+	rootCmd.SetArgs(args)
+
+	return rootCmd.Execute()
+}
@@ -18,6 +18,7 @@ capture.go - this file contains logic for evaluating captures
 package napcap
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/davesheldon/nap/napcontext"
@@ -36,11 +37,28 @@ func CaptureQuery(variable string, query string, ctx *napcontext.Context, vmData
 		return err
 	}
 
-	if len(actual) > 0 {
-		ctx.EnvironmentVariables[variable] = fmt.Sprint(actual[0])
+	if len(actual) == 0 {
+		return nil
 	}
 
-	// todo: deal with multiple return values
+	// multiple values (e.g. from a wildcard jsonpath) are captured as a json array, as are
+	// objects and arrays, so they can be looped over or parsed in a script later
+	var value interface{} = actual
+	if len(actual) == 1 {
+		value = actual[0]
+	}
+
+	switch value.(type) {
+	case []interface{}, map[string]interface{}:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		ctx.Variables.SetStructured(variable, string(data))
+	default:
+		ctx.Variables.Set(variable, fmt.Sprint(value))
+	}
 
 	return nil
 }
@@ -14,6 +14,7 @@ func TestCaptures(t *testing.T) {
 		variable  string
 		ctx       *napcontext.Context
 		queryFunc func(query string, vmData *napscript.VmHttpData) ([]any, error)
+		expected  string
 	}{
 		"set new variable": {
 			variable:  "test1",
@@ -25,6 +26,18 @@ func TestCaptures(t *testing.T) {
 			ctx:       napcontext.New("", nil, map[string]string{"test1": "value1"}, nil, true),
 			queryFunc: mockQuery([]any{"value2"}, nil),
 		},
+		"multiple values": {
+			variable:  "test1",
+			ctx:       napcontext.New("", nil, make(map[string]string), nil, true),
+			queryFunc: mockQuery([]any{"a", float64(2)}, nil),
+			expected:  `["a",2]`,
+		},
+		"object value": {
+			variable:  "test1",
+			ctx:       napcontext.New("", nil, make(map[string]string), nil, true),
+			queryFunc: mockQuery([]any{map[string]interface{}{"id": "a"}}, nil),
+			expected:  `{"id":"a"}`,
+		},
 		"error": {
 			variable:  "test1",
 			ctx:       napcontext.New("", nil, make(map[string]string), nil, true),
@@ -38,8 +51,13 @@ func TestCaptures(t *testing.T) {
 			queryResult, queryError := test.queryFunc("", nil)
 			err := napcap.CaptureQuery(test.variable, "", test.ctx, nil)
 
-			if err == nil && queryError == nil && test.ctx.EnvironmentVariables[test.variable] != queryResult[0] {
-				t.Errorf("Expected %s=%s, got %s", test.variable, queryResult, test.ctx.EnvironmentVariables[test.variable])
+			expected := test.expected
+			if len(expected) == 0 && len(queryResult) > 0 {
+				expected = fmt.Sprint(queryResult[0])
+			}
+
+			if err == nil && queryError == nil && test.ctx.Variables.Get(test.variable) != expected {
+				t.Errorf("Expected %s=%s, got %s", test.variable, expected, test.ctx.Variables.Get(test.variable))
 			} else if queryError != nil && err == nil {
 				t.Errorf("Expected error, got nil")
 			} else if queryError == nil && err != nil {
@@ -0,0 +1,211 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+config.go - this file contains logic for finding and loading a project's nap.yml
+*/
+package napconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/davesheldon/nap/naputil"
+	"gopkg.in/yaml.v2"
+)
+
+// FileNames are the names a project config file may have, in the order they're looked for
+var FileNames = []string{"nap.yml", "nap.yaml"}
+
+// Config holds a project's defaults. command line flags take precedence over them
+type Config struct {
+	// environments to load when no --env flags are given
+	Env []string
+
+	// variables to start with. --param values override them
+	Params map[string]string
+
+	// more folders to look for environments in, after the usual places
+	EnvPath []string `yaml:"envPath"`
+
+	// defaults for every request
+	BaseUrl        string `yaml:"baseUrl"`
+	TimeoutSeconds int    `yaml:"timeoutSeconds"`
+	Headers        map[string]string
+	TLS            *TLSOptions `yaml:"tls"`
+	Proxy          string
+
+	// the default for --concurrency
+	Concurrency int
+
+	// reports to write when no --reporter flags are given
+	Reporters []*Reporter
+
+	// the path the config was loaded from
+	Path string `yaml:"-"`
+}
+
+type TLSOptions struct {
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+	CAFile             string `yaml:"caFile"`
+	CertFile           string `yaml:"certFile"`
+	KeyFile            string `yaml:"keyFile"`
+}
+
+type Reporter struct {
+	Type string
+	Path string
+}
+
+// Find looks for a project config file in a folder and then in each folder above it. it returns an empty
+// path if there isn't one
+func Find(directory string) (string, error) {
+	directory, err := filepath.Abs(directory)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		for _, v := range FileNames {
+			candidate := filepath.Join(directory, v)
+			if exists, _ := naputil.FileExists(candidate); exists {
+				return candidate, nil
+			}
+		}
+
+		parent := filepath.Dir(directory)
+		if parent == directory {
+			return "", nil
+		}
+
+		directory = parent
+	}
+}
+
+// LoadFromPath reads a project config file. paths in it are relative to the file's folder, and are made
+// relative to the current directory
+func LoadFromPath(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(Config)
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("cannot parse '%s'. %w", path, err)
+	}
+
+	config.Path = path
+	directory := filepath.Dir(path)
+
+	// environments are looked for next to the config too, so env: [staging] finds env/staging.yml
+	envPath := []string{}
+	for _, v := range config.EnvPath {
+		envPath = append(envPath, relativeTo(directory, v))
+	}
+
+	config.EnvPath = append(envPath, filepath.Join(directory, "env"), directory)
+
+	if config.TLS != nil {
+		config.TLS.CAFile = relativeTo(directory, config.TLS.CAFile)
+		config.TLS.CertFile = relativeTo(directory, config.TLS.CertFile)
+		config.TLS.KeyFile = relativeTo(directory, config.TLS.KeyFile)
+	}
+
+	for _, v := range config.Reporters {
+		if v == nil {
+			return nil, fmt.Errorf("cannot parse '%s'. reporters may not be empty", path)
+		}
+
+		v.Path = relativeTo(directory, v.Path)
+	}
+
+	return config, nil
+}
+
+func relativeTo(directory string, path string) string {
+	if len(path) == 0 || filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(directory, path)
+}
+
+// Transport returns the http transport for the config's tls and proxy settings, or nil if it doesn't
+// have any
+func (config *Config) Transport() (*http.Transport, error) {
+	if config.TLS == nil && len(config.Proxy) == 0 {
+		return nil, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if len(config.Proxy) > 0 {
+		proxy, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if config.TLS != nil {
+		tlsConfig, err := config.TLS.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return transport, nil
+}
+
+func (options *TLSOptions) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: options.InsecureSkipVerify}
+
+	if len(options.CAFile) > 0 {
+		data, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read tls.caFile: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("cannot read tls.caFile: no certificates found in %s", options.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(options.CertFile) > 0 || len(options.KeyFile) > 0 {
+		certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read tls.certFile and tls.keyFile: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,158 @@
+package napconfig_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/davesheldon/nap/napconfig"
+)
+
+func TestFind(t *testing.T) {
+	root := t.TempDir()
+	nested := filepath.Join(root, "routines", "smoke")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := napconfig.Find(nested)
+	if err != nil || len(found) > 0 {
+		t.Fatalf("Expected no config, got %s (%v)", found, err)
+	}
+
+	path := filepath.Join(root, "nap.yml")
+	if err := os.WriteFile(path, []byte("env: [dev]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err = napconfig.Find(nested)
+	if err != nil || found != path {
+		t.Errorf("Expected %s, got %s (%v)", path, found, err)
+	}
+}
+
+func TestLoadFromPath(t *testing.T) {
+	tests := map[string]struct {
+		contents string
+		check    func(t *testing.T, dir string, config *napconfig.Config)
+		err      string
+	}{
+		"paths are relative to the config": {
+			contents: `env: [staging]
+envPath: [environments]
+baseUrl: https://example.com
+timeoutSeconds: 10
+headers:
+  X-Client: nap
+tls:
+  caFile: certs/ca.pem
+reporters:
+  - type: junit
+    path: out/junit.xml
+`,
+			check: func(t *testing.T, dir string, config *napconfig.Config) {
+				expected := []string{filepath.Join(dir, "environments"), filepath.Join(dir, "env"), dir}
+				if strings.Join(config.EnvPath, ",") != strings.Join(expected, ",") {
+					t.Errorf("Expected envPath %v, got %v", expected, config.EnvPath)
+				}
+
+				if config.TLS.CAFile != filepath.Join(dir, "certs", "ca.pem") {
+					t.Errorf("Expected a relative caFile, got %s", config.TLS.CAFile)
+				}
+
+				if config.Reporters[0].Path != filepath.Join(dir, "out", "junit.xml") {
+					t.Errorf("Expected a relative reporter path, got %s", config.Reporters[0].Path)
+				}
+
+				if config.BaseUrl != "https://example.com" || config.TimeoutSeconds != 10 || config.Headers["X-Client"] != "nap" {
+					t.Errorf("Expected request defaults, got %+v", config)
+				}
+			},
+		},
+		"unknown settings are an error": {
+			contents: "timeout: 10\n",
+			err:      "field timeout not found",
+		},
+		"empty reporters are an error": {
+			contents: "reporters:\n  -\n",
+			err:      "reporters may not be empty",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "nap.yml")
+			if err := os.WriteFile(path, []byte(test.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := napconfig.LoadFromPath(path)
+
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected an error containing %q, got %v", test.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test.check(t, dir, config)
+		})
+	}
+}
+
+func TestTransport(t *testing.T) {
+	tests := map[string]struct {
+		config   *napconfig.Config
+		expected bool
+		err      string
+	}{
+		"no tls or proxy settings": {
+			config: &napconfig.Config{},
+		},
+		"proxy": {
+			config:   &napconfig.Config{Proxy: "http://proxy.local:3128"},
+			expected: true,
+		},
+		"insecure tls": {
+			config:   &napconfig.Config{TLS: &napconfig.TLSOptions{InsecureSkipVerify: true}},
+			expected: true,
+		},
+		"missing ca file": {
+			config: &napconfig.Config{TLS: &napconfig.TLSOptions{CAFile: "missing.pem"}},
+			err:    "cannot read tls.caFile",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			transport, err := test.config.Transport()
+
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected an error containing %q, got %v", test.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (transport != nil) != test.expected {
+				t.Errorf("Expected a transport: %t, got %v", test.expected, transport)
+			}
+
+			if test.config.TLS != nil && !transport.TLSClientConfig.InsecureSkipVerify {
+				t.Errorf("Expected InsecureSkipVerify to be set")
+			}
+		})
+	}
+}
@@ -18,25 +18,56 @@ context.go - this data represents a runnable context with its own set of environ
 package napcontext
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
-	"github.com/davesheldon/nap/naputil"
+	"github.com/davesheldon/nap/napsecret"
 	"github.com/vbauerster/mpb/v8"
 	"github.com/vbauerster/mpb/v8/decor"
 )
 
 type Context struct {
-	Environments         []string
-	EnvironmentVariables map[string]string
-	WorkingDirectory     string
-	ScriptContext        *ScriptContext
-	Cookies              []*http.Cookie
+	Environments     []string
+	Variables        *VariableStore
+	WorkingDirectory string
+	ScriptContext    *ScriptContext
+	Cookies          []*http.Cookie
+	FailFast         bool
+	Strict           bool
+
+	// Secrets hides the values of secrets in output
+	Secrets *napsecret.Masker
+
+	// RequestDefaults apply to every request that doesn't set its own values
+	RequestDefaults *RequestDefaults
+
+	// Transport sends http requests, or nil for the default transport
+	Transport *http.Transport
+
+	// EnvironmentPath lists more folders to look for environment files in
+	EnvironmentPath []string
 
 	progress  *mpb.Progress
 	waitGroup *sync.WaitGroup
 	quiet     bool
+
+	done   context.Context
+	cancel context.CancelFunc
+
+	requestSlots chan struct{}
+}
+
+// RequestDefaults are the values a request gets for the settings it leaves out
+type RequestDefaults struct {
+	// prepended to request paths that aren't full urls
+	BaseUrl string
+	Timeout time.Duration
+
+	// added to requests that don't set the same header. values may refer to variables
+	Headers map[string]string
 }
 
 func New(workingDirectory string, environments []string, environmentVariables map[string]string, wg *sync.WaitGroup, quiet bool) *Context {
@@ -44,12 +75,10 @@ func New(workingDirectory string, environments []string, environmentVariables ma
 
 	ctx.WorkingDirectory = workingDirectory
 	ctx.Environments = environments
-	ctx.EnvironmentVariables = map[string]string{}
+	ctx.Variables = NewVariableStore()
+	ctx.Variables.SetAll(EnvironmentScope, environmentVariables)
 	ctx.Cookies = []*http.Cookie{}
-
-	for k, v := range environmentVariables {
-		ctx.EnvironmentVariables[k] = v
-	}
+	ctx.Secrets = napsecret.NewMasker()
 
 	ctx.waitGroup = wg
 	ctx.quiet = quiet
@@ -59,6 +88,8 @@ func New(workingDirectory string, environments []string, environmentVariables ma
 
 	ctx.ScriptContext = newScriptContext()
 
+	ctx.done, ctx.cancel = context.WithCancel(context.Background())
+
 	return ctx
 }
 
@@ -66,17 +97,84 @@ func (old *Context) Clone(workingDirectory string) *Context {
 	ctx := new(Context)
 
 	ctx.Environments = old.Environments
-	ctx.EnvironmentVariables = naputil.CloneMap(old.EnvironmentVariables)
+	ctx.Variables = old.Variables.Clone()
 	ctx.ScriptContext = newScriptContext()
 	ctx.WorkingDirectory = workingDirectory
 	ctx.progress = old.progress
 	ctx.waitGroup = old.waitGroup
 	ctx.quiet = old.quiet
 	ctx.Cookies = append([]*http.Cookie{}, old.Cookies...)
+	ctx.FailFast = old.FailFast
+	ctx.Strict = old.Strict
+	ctx.Secrets = old.Secrets
+	ctx.RequestDefaults = old.RequestDefaults
+	ctx.Transport = old.Transport
+	ctx.EnvironmentPath = old.EnvironmentPath
+	ctx.done = old.done
+	ctx.cancel = old.cancel
+	ctx.requestSlots = old.requestSlots
 
 	return ctx
 }
 
+// Mask hides the values of secrets in text before it's shown
+func (ctx *Context) Mask(text string) string {
+	if ctx == nil {
+		return text
+	}
+
+	return ctx.Secrets.Mask(text)
+}
+
+// Cancel stops the run, along with every context cloned from the same run. steps that are
+// already running finish, but no more are started apart from teardown steps
+func (ctx *Context) Cancel() {
+	ctx.cancel()
+}
+
+func (ctx *Context) IsCancelled() bool {
+	return ctx.done.Err() != nil
+}
+
+// SetConcurrency limits how many requests may be in flight at once across the whole run, including
+// every context cloned from this one afterwards. a limit of 0 or less means no limit
+func (ctx *Context) SetConcurrency(limit int) {
+	if limit <= 0 {
+		ctx.requestSlots = nil
+		return
+	}
+
+	ctx.requestSlots = make(chan struct{}, limit)
+}
+
+// AcquireRequestSlot waits until a request is allowed to start under the run's concurrency limit
+func (ctx *Context) AcquireRequestSlot() {
+	if ctx.requestSlots != nil {
+		ctx.requestSlots <- struct{}{}
+	}
+}
+
+func (ctx *Context) ReleaseRequestSlot() {
+	if ctx.requestSlots != nil {
+		<-ctx.requestSlots
+	}
+}
+
+// RunContext returns a context that's done once the run is cancelled, for cancelling requests in flight
+func (ctx *Context) RunContext() context.Context {
+	return ctx.done
+}
+
+// Detach returns a copy of the context that shares its variables but can't be cancelled by the run.
+// it's used for teardown steps, which have to run even after the run is cancelled
+func (ctx *Context) Detach() *Context {
+	detached := *ctx
+	detached.FailFast = false
+	detached.done, detached.cancel = context.WithCancel(context.Background())
+
+	return &detached
+}
+
 type Progress struct {
 	name  string
 	steps int64
@@ -0,0 +1,261 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+variables.go - this file contains the variable store shared by everything that runs under a context
+*/
+package napcontext
+
+import (
+	"sync"
+)
+
+// Scope is a layer of variables. when a variable is set in more than one scope, the value in the later
+// scope wins
+type Scope int
+
+const (
+	// GlobalScope holds defaults that apply to the whole run
+	GlobalScope Scope = iota
+
+	// EnvironmentScope holds the variables a run starts with, from environment files, parameters and the
+	// os environment
+	EnvironmentScope
+
+	// RoutineScope holds a routine's env, along with the variables it inherited from its caller
+	RoutineScope
+
+	// OverrideScope holds starting variables that take precedence over routine env
+	OverrideScope
+
+	// CapturedScope holds variables set while running, by captures, scripts and exports
+	CapturedScope
+
+	// StepScope holds a step's env, iteration and loop variables while the step runs
+	StepScope
+
+	scopeCount
+)
+
+// VariableStore holds a context's variables in layered scopes. it's safe to use from several goroutines
+// at once
+type VariableStore struct {
+	mu     sync.RWMutex
+	scopes [scopeCount]map[string]string
+
+	// the variables in each scope that were set as structured values, such as objects and lists, which are
+	// stored as json
+	structured [scopeCount]map[string]bool
+}
+
+func NewVariableStore() *VariableStore {
+	store := new(VariableStore)
+
+	for i := range store.scopes {
+		store.scopes[i] = make(map[string]string)
+		store.structured[i] = make(map[string]bool)
+	}
+
+	return store
+}
+
+// Get returns a variable's value, or an empty string if it isn't set
+func (store *VariableStore) Get(name string) string {
+	value, _ := store.Lookup(name)
+	return value
+}
+
+// Lookup returns a variable's value from the highest scope it's set in, and whether it was set at all
+func (store *VariableStore) Lookup(name string) (string, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for i := len(store.scopes) - 1; i >= 0; i-- {
+		if value, ok := store.scopes[i][name]; ok {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+// Set stores a variable set while running, such as a capture
+func (store *VariableStore) Set(name string, value string) {
+	store.SetIn(CapturedScope, name, value)
+}
+
+func (store *VariableStore) SetIn(scope Scope, name string, value string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.scopes[scope][name] = value
+	delete(store.structured[scope], name)
+}
+
+// SetStructured stores a structured value set while running, such as a captured object, as json
+func (store *VariableStore) SetStructured(name string, value string) {
+	store.SetStructuredIn(CapturedScope, name, value)
+}
+
+func (store *VariableStore) SetStructuredIn(scope Scope, name string, value string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.scopes[scope][name] = value
+	store.structured[scope][name] = true
+}
+
+// SetAll stores several variables in one scope at once
+func (store *VariableStore) SetAll(scope Scope, variables map[string]string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for k, v := range variables {
+		store.scopes[scope][k] = v
+		delete(store.structured[scope], k)
+	}
+}
+
+// MarkStructured records that variables already set in a scope hold structured values stored as json
+func (store *VariableStore) MarkStructured(scope Scope, names map[string]bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for k, structured := range names {
+		if _, ok := store.scopes[scope][k]; ok && structured {
+			store.structured[scope][k] = true
+		}
+	}
+}
+
+// IsStructured reports whether a variable's value, from the highest scope it's set in, was set as a
+// structured value rather than as text
+func (store *VariableStore) IsStructured(name string) bool {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for i := len(store.scopes) - 1; i >= 0; i-- {
+		if _, ok := store.scopes[i][name]; ok {
+			return store.structured[i][name]
+		}
+	}
+
+	return false
+}
+
+// ClearScope removes every variable in a scope
+func (store *VariableStore) ClearScope(scope Scope) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.scopes[scope] = make(map[string]string)
+	store.structured[scope] = make(map[string]bool)
+}
+
+// All returns a copy of every variable with the value from its highest scope
+func (store *VariableStore) All() map[string]string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	all := make(map[string]string)
+
+	for _, scope := range store.scopes {
+		for k, v := range scope {
+			all[k] = v
+		}
+	}
+
+	return all
+}
+
+// AllStructured returns the names of the variables whose values, from their highest scope, are structured
+func (store *VariableStore) AllStructured() map[string]bool {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	structured := make(map[string]bool)
+
+	for i, scope := range store.scopes {
+		for k := range scope {
+			if store.structured[i][k] {
+				structured[k] = true
+			} else {
+				delete(structured, k)
+			}
+		}
+	}
+
+	return structured
+}
+
+// Clone returns a copy of the store that can be changed without affecting this one
+func (store *VariableStore) Clone() *VariableStore {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	clone := new(VariableStore)
+
+	for i, scope := range store.scopes {
+		clone.scopes[i] = make(map[string]string, len(scope))
+		for k, v := range scope {
+			clone.scopes[i][k] = v
+		}
+
+		clone.structured[i] = make(map[string]bool, len(store.structured[i]))
+		for k := range store.structured[i] {
+			clone.structured[i][k] = true
+		}
+	}
+
+	return clone
+}
+
+// EnterRoutine starts a routine's scope. the caller's captured and step variables become part of what the
+// routine inherits, and the routine's env is applied over them. inherited variables that an override would
+// hide are kept as captures, so they still win over the override as they did in the caller
+func (store *VariableStore) EnterRoutine(env map[string]string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	routine := store.scopes[RoutineScope]
+	routineStructured := store.structured[RoutineScope]
+	captured := make(map[string]string)
+	capturedStructured := make(map[string]bool)
+
+	for _, scope := range []Scope{CapturedScope, StepScope} {
+		for k, v := range store.scopes[scope] {
+			values, structured := routine, routineStructured
+			if _, ok := store.scopes[OverrideScope][k]; ok {
+				values, structured = captured, capturedStructured
+			}
+
+			values[k] = v
+			if store.structured[scope][k] {
+				structured[k] = true
+			} else {
+				delete(structured, k)
+			}
+		}
+	}
+
+	store.scopes[CapturedScope] = captured
+	store.structured[CapturedScope] = capturedStructured
+	store.scopes[StepScope] = make(map[string]string)
+	store.structured[StepScope] = make(map[string]bool)
+
+	for k, v := range env {
+		routine[k] = v
+		delete(routineStructured, k)
+	}
+}
@@ -0,0 +1,239 @@
+package napcontext_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/davesheldon/nap/napcontext"
+)
+
+func TestVariableStoreScopes(t *testing.T) {
+	type set struct {
+		scope napcontext.Scope
+		name  string
+		value string
+	}
+
+	tests := map[string]struct {
+		sets     []set
+		clear    []napcontext.Scope
+		enter    map[string]string
+		expected map[string]string
+	}{
+		"later scopes win": {
+			sets: []set{
+				{napcontext.StepScope, "a", "step"},
+				{napcontext.GlobalScope, "a", "global"},
+				{napcontext.CapturedScope, "a", "captured"},
+				{napcontext.EnvironmentScope, "b", "environment"},
+				{napcontext.GlobalScope, "b", "global"},
+				{napcontext.RoutineScope, "c", "routine"},
+				{napcontext.EnvironmentScope, "c", "environment"},
+			},
+			expected: map[string]string{"a": "step", "b": "environment", "c": "routine"},
+		},
+		"clearing a scope uncovers the one below": {
+			sets: []set{
+				{napcontext.CapturedScope, "a", "captured"},
+				{napcontext.StepScope, "a", "step"},
+				{napcontext.StepScope, "b", "step"},
+			},
+			clear:    []napcontext.Scope{napcontext.StepScope},
+			expected: map[string]string{"a": "captured"},
+		},
+		"entering a routine keeps the caller's captures and step variables": {
+			sets: []set{
+				{napcontext.EnvironmentScope, "a", "environment"},
+				{napcontext.CapturedScope, "b", "captured"},
+				{napcontext.StepScope, "c", "step"},
+			},
+			enter:    map[string]string{},
+			expected: map[string]string{"a": "environment", "b": "captured", "c": "step"},
+		},
+		"routine env wins over the caller's captures": {
+			sets: []set{
+				{napcontext.CapturedScope, "a", "captured"},
+				{napcontext.StepScope, "b", "step"},
+			},
+			enter:    map[string]string{"a": "routine", "b": "routine"},
+			expected: map[string]string{"a": "routine", "b": "routine"},
+		},
+		"overrides win over routine env": {
+			sets: []set{
+				{napcontext.OverrideScope, "a", "override"},
+				{napcontext.EnvironmentScope, "b", "environment"},
+			},
+			enter:    map[string]string{"a": "routine", "b": "routine"},
+			expected: map[string]string{"a": "override", "b": "routine"},
+		},
+		"the caller's captures still win over overrides": {
+			sets: []set{
+				{napcontext.OverrideScope, "a", "override"},
+				{napcontext.CapturedScope, "a", "captured"},
+			},
+			enter:    map[string]string{"a": "routine"},
+			expected: map[string]string{"a": "captured"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := napcontext.NewVariableStore()
+
+			for _, v := range test.sets {
+				store.SetIn(v.scope, v.name, v.value)
+			}
+
+			for _, scope := range test.clear {
+				store.ClearScope(scope)
+			}
+
+			if test.enter != nil {
+				store.EnterRoutine(test.enter)
+			}
+
+			all := store.All()
+			if len(all) != len(test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, all)
+			}
+
+			for k, expected := range test.expected {
+				if actual, ok := store.Lookup(k); !ok || actual != expected {
+					t.Errorf("Expected %s=%s, got %s", k, expected, actual)
+				}
+
+				if all[k] != expected {
+					t.Errorf("Expected All()[%s]=%s, got %s", k, expected, all[k])
+				}
+			}
+		})
+	}
+}
+
+func TestVariableStoreClone(t *testing.T) {
+	store := napcontext.NewVariableStore()
+	store.Set("a", "original")
+
+	clone := store.Clone()
+	clone.Set("a", "changed")
+	clone.Set("b", "new")
+
+	if actual := store.Get("a"); actual != "original" {
+		t.Errorf("Expected a=original, got %s", actual)
+	}
+
+	if _, ok := store.Lookup("b"); ok {
+		t.Errorf("Expected b to be unset in the original store")
+	}
+}
+
+func TestVariableStoreStructured(t *testing.T) {
+	tests := map[string]struct {
+		setup    func(store *napcontext.VariableStore)
+		expected bool
+	}{
+		"text": {
+			setup:    func(store *napcontext.VariableStore) { store.Set("a", "[1]") },
+			expected: false,
+		},
+		"structured": {
+			setup:    func(store *napcontext.VariableStore) { store.SetStructured("a", "[1]") },
+			expected: true,
+		},
+		"text set over a structured value": {
+			setup: func(store *napcontext.VariableStore) {
+				store.SetStructured("a", "[1]")
+				store.Set("a", "[2]")
+			},
+			expected: false,
+		},
+		"the highest scope decides": {
+			setup: func(store *napcontext.VariableStore) {
+				store.SetStructuredIn(napcontext.EnvironmentScope, "a", "[1]")
+				store.SetIn(napcontext.StepScope, "a", "[2]")
+			},
+			expected: false,
+		},
+		"marked after being set": {
+			setup: func(store *napcontext.VariableStore) {
+				store.SetAll(napcontext.EnvironmentScope, map[string]string{"a": "[1]"})
+				store.MarkStructured(napcontext.EnvironmentScope, map[string]bool{"a": true, "b": true})
+			},
+			expected: true,
+		},
+		"kept when entering a routine": {
+			setup: func(store *napcontext.VariableStore) {
+				store.SetStructuredIn(napcontext.StepScope, "a", "[1]")
+				store.EnterRoutine(map[string]string{})
+			},
+			expected: true,
+		},
+		"routine env is text": {
+			setup: func(store *napcontext.VariableStore) {
+				store.SetStructuredIn(napcontext.StepScope, "a", "[1]")
+				store.EnterRoutine(map[string]string{"a": "[2]"})
+			},
+			expected: false,
+		},
+		"cleared with its scope": {
+			setup: func(store *napcontext.VariableStore) {
+				store.SetIn(napcontext.EnvironmentScope, "a", "[1]")
+				store.SetStructuredIn(napcontext.StepScope, "a", "[2]")
+				store.ClearScope(napcontext.StepScope)
+			},
+			expected: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := napcontext.NewVariableStore()
+			test.setup(store)
+
+			if actual := store.IsStructured("a"); actual != test.expected {
+				t.Errorf("Expected IsStructured to be %v, got %v", test.expected, actual)
+			}
+
+			if actual := store.Clone().IsStructured("a"); actual != test.expected {
+				t.Errorf("Expected the clone's IsStructured to be %v, got %v", test.expected, actual)
+			}
+
+			if actual := store.AllStructured()["a"]; actual != test.expected {
+				t.Errorf("Expected AllStructured()[a] to be %v, got %v", test.expected, actual)
+			}
+
+			if store.IsStructured("b") {
+				t.Errorf("Expected b, which isn't set, not to be structured")
+			}
+		})
+	}
+}
+
+func TestVariableStoreConcurrency(t *testing.T) {
+	store := napcontext.NewVariableStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				name := fmt.Sprintf("var%d", j%10)
+				store.Set(name, fmt.Sprint(i))
+				store.SetIn(napcontext.StepScope, name, fmt.Sprint(i))
+				store.Get(name)
+				store.All()
+				store.Clone().Set(name, "clone")
+				store.ClearScope(napcontext.StepScope)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if len(store.All()) != 10 {
+		t.Errorf("Expected 10 variables, got %v", store.All())
+	}
+}
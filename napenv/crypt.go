@@ -0,0 +1,161 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+crypt.go - this file contains logic for encrypting and decrypting environment files
+*/
+package napenv
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// EncryptedExtension is added to the name of an encrypted environment file, e.g. staging.yml.enc
+	EncryptedExtension = ".enc"
+
+	// KeyVariable is the os environment variable that holds the key for encrypted environments
+	KeyVariable = "NAP_ENV_KEY"
+
+	// KeyFileVariable is the os environment variable that holds the path to a file with the key in it
+	KeyFileVariable = "NAP_ENV_KEY_FILE"
+
+	// KeySize is the size of a key in bytes, for AES-256
+	KeySize = 32
+
+	encryptedHeader = "nap-encrypted-environment:v1:aes-256-gcm"
+	lineLength      = 76
+)
+
+// LoadKey reads the key for encrypted environments. it comes from keyFile if one is given, otherwise from
+// the NAP_ENV_KEY or NAP_ENV_KEY_FILE os environment variable. a key is 32 random bytes, base64 encoded
+func LoadKey(keyFile string) ([]byte, error) {
+	var text string
+
+	switch {
+	case len(keyFile) > 0:
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key file: %w", err)
+		}
+
+		text = string(data)
+	case len(os.Getenv(KeyVariable)) > 0:
+		text = os.Getenv(KeyVariable)
+	case len(os.Getenv(KeyFileVariable)) > 0:
+		data, err := os.ReadFile(os.Getenv(KeyFileVariable))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key file: %w", err)
+		}
+
+		text = string(data)
+	default:
+		return nil, fmt.Errorf("no key for encrypted environments: set %s or %s", KeyVariable, KeyFileVariable)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil || len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key: expected %d bytes, base64 encoded", KeySize)
+	}
+
+	return key, nil
+}
+
+// NewKey returns a new random key, base64 encoded
+func NewKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Encrypt encrypts an environment file's contents with AES-GCM. the result is text, so it can be committed
+// and diffed like any other file
+func Encrypt(plaintext []byte, key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, []byte(encryptedHeader)))
+
+	var buffer bytes.Buffer
+	buffer.WriteString(encryptedHeader + "\n")
+
+	for len(encoded) > 0 {
+		n := lineLength
+		if len(encoded) < n {
+			n = len(encoded)
+		}
+
+		buffer.WriteString(encoded[:n] + "\n")
+		encoded = encoded[n:]
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// Decrypt decrypts an environment file encrypted with Encrypt
+func Decrypt(data []byte, key []byte) ([]byte, error) {
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	if strings.TrimSpace(lines[0]) != encryptedHeader {
+		return nil, errors.New("not an encrypted environment")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(strings.Join(lines[1:], "")), ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted environment: %w", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("invalid encrypted environment: too short")
+	}
+
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(encryptedHeader))
+	if err != nil {
+		return nil, errors.New("cannot decrypt: wrong key or the file has been changed")
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,187 @@
+package napenv_test
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/davesheldon/nap/napenv"
+)
+
+func newTestKey(t *testing.T) []byte {
+	encoded, err := napenv.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestEncryption(t *testing.T) {
+	key := newTestKey(t)
+	plaintext := []byte("host: example.com\ntoken: " + strings.Repeat("x", 200) + "\n")
+
+	encrypted, err := napenv.Encrypt(plaintext, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(encrypted), "example.com") {
+		t.Fatalf("Expected the contents to be encrypted, got %s", encrypted)
+	}
+
+	changed := append([]byte{}, encrypted...)
+	if changed[50] == 'A' {
+		changed[50] = 'B'
+	} else {
+		changed[50] = 'A'
+	}
+
+	tests := map[string]struct {
+		data []byte
+		key  []byte
+		err  string
+	}{
+		"round trip":  {data: encrypted, key: key},
+		"wrong key":   {data: encrypted, key: newTestKey(t), err: "wrong key or the file has been changed"},
+		"changed":     {data: changed, key: key, err: "cannot decrypt"},
+		"not a match": {data: plaintext, key: key, err: "not an encrypted environment"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, err := napenv.Decrypt(test.data, test.key)
+
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if string(actual) != string(plaintext) {
+				t.Errorf("Expected %s, got %s", plaintext, actual)
+			}
+		})
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	key, err := napenv.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "nap.key")
+	if err := os.WriteFile(keyFile, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		keyFile string
+		env     map[string]string
+		err     string
+	}{
+		"key file":          {keyFile: keyFile},
+		"variable":          {env: map[string]string{napenv.KeyVariable: key}},
+		"key file variable": {env: map[string]string{napenv.KeyFileVariable: keyFile}},
+		"no key":            {err: "no key for encrypted environments"},
+		"invalid key":       {env: map[string]string{napenv.KeyVariable: "c2hvcnQ="}, err: "invalid key"},
+		"missing key file":  {keyFile: filepath.Join(dir, "nope"), err: "cannot read key file"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(napenv.KeyVariable, "")
+			t.Setenv(napenv.KeyFileVariable, "")
+
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+
+			actual, err := napenv.LoadKey(test.keyFile)
+
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if base64.StdEncoding.EncodeToString(actual) != key {
+				t.Errorf("Expected the key to be loaded")
+			}
+		})
+	}
+}
+
+func TestEncryptedEnvironments(t *testing.T) {
+	key, err := napenv.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(napenv.KeyVariable, key)
+	t.Setenv(napenv.KeyFileVariable, "")
+
+	decoded, _ := base64.StdEncoding.DecodeString(key)
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"secrets.yml":  "token: abc\n",
+		"staging.yml":  "extends: secrets\nhost: staging.example.com\n",
+		"secrets.json": `{ "token": "from-json" }`,
+	}
+
+	for name, contents := range files {
+		encrypted, err := napenv.Encrypt([]byte(contents), decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, name+napenv.EncryptedExtension), encrypted, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]struct {
+		file     string
+		expected map[string]string
+	}{
+		"by name":         {file: "secrets", expected: map[string]string{"token": "abc"}},
+		"by full name":    {file: "secrets.yml.enc", expected: map[string]string{"token": "abc"}},
+		"json":            {file: "secrets.json.enc", expected: map[string]string{"token": "from-json"}},
+		"extends":         {file: "staging", expected: map[string]string{"token": "abc", "host": "staging.example.com"}},
+		"plain extension": {file: "staging.yml", expected: map[string]string{"token": "abc", "host": "staging.example.com"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, err := napenv.AddEnvironmentFromPath(dir, test.file, map[string]string{})
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
@@ -22,56 +22,221 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/davesheldon/nap/naputil"
-	"gopkg.in/yaml.v2"
 )
 
-func AddEnvironmentFromPath(workingDirectory string, environmentFileName string, existing map[string]string) (map[string]string, error) {
-	if path.Ext(environmentFileName) != ".yml" && path.Ext(environmentFileName) != ".yaml" {
+// AddEnvironmentFromPath loads an environment file's variables into existing. yaml, json and dotenv files
+// are supported, and a name without one of their extensions is taken to be a yaml file. the variables of
+// any environments the file extends are loaded first, so the file's own values win. searchPath lists more
+// folders to look for the file in
+func AddEnvironmentFromPath(workingDirectory string, environmentFileName string, existing map[string]string, searchPath ...string) (map[string]string, error) {
+	loaded, err := LoadEnvironmentFromPath(workingDirectory, environmentFileName, searchPath...)
+	if err != nil {
+		return existing, err
+	}
+
+	for k, v := range loaded.Variables {
+		existing[k] = v
+	}
+
+	return existing, nil
+}
+
+// LoadedEnvironment is the variables loaded from an environment file and the environments it extends
+type LoadedEnvironment struct {
+	Variables map[string]string
+
+	// the path of the file each variable came from, which differs from the file's own path for variables
+	// from environments it extends
+	Origins map[string]string
+
+	// the variables that hold lists or maps, which are stored as json
+	Structured map[string]bool
+}
+
+func newLoadedEnvironment() *LoadedEnvironment {
+	return &LoadedEnvironment{
+		Variables:  make(map[string]string),
+		Origins:    make(map[string]string),
+		Structured: make(map[string]bool),
+	}
+}
+
+// LoadEnvironmentFromPath loads an environment file's variables, along with where each one came from and
+// which of them hold structured values
+func LoadEnvironmentFromPath(workingDirectory string, environmentFileName string, searchPath ...string) (*LoadedEnvironment, error) {
+	if len(environmentFileName) == 0 {
+		return newLoadedEnvironment(), nil
+	}
+
+	environmentFileName, err := FindEnvironment(workingDirectory, environmentFileName, searchPath...)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadEnvironment(workingDirectory, environmentFileName, []string{}, searchPath)
+}
+
+// FindEnvironment returns the path to an environment file, looking relative to the current directory and
+// then near the target and then in each folder in searchPath. if there's no such file, an encrypted one
+// with the same name is used instead
+func FindEnvironment(workingDirectory string, environmentFileName string, searchPath ...string) (string, error) {
+	if _, ok := parserFor(environmentFileName); !ok {
 		environmentFileName = environmentFileName + ".yml"
 	}
 
-	originalFileName := environmentFileName
+	found, candidates, err := searchEnvironment(workingDirectory, environmentFileName, searchPath)
+	if err != nil || len(found) > 0 {
+		return found, err
+	}
 
-	if len(originalFileName) > 0 {
-		if exists, _ := naputil.FileExists(environmentFileName); !exists {
-			// try and find it relative to the target path
-			environmentFileName = filepath.Join(workingDirectory, "..", "env", originalFileName)
+	if !isEncrypted(environmentFileName) {
+		found, _, err = searchEnvironment(workingDirectory, environmentFileName+EncryptedExtension, searchPath)
+		if err != nil || len(found) > 0 {
+			return found, err
 		}
 
-		if exists, _ := naputil.FileExists(environmentFileName); !exists {
-			// try and find it relative to the target path
-			environmentFileName = filepath.Join(workingDirectory, "env", originalFileName)
+		return "", fmt.Errorf("environment '%s' not found. looked for it and %s in: %s", environmentFileName, environmentFileName+EncryptedExtension, strings.Join(candidates, ", "))
+	}
+
+	return "", fmt.Errorf("environment '%s' not found. looked in: %s", environmentFileName, strings.Join(candidates, ", "))
+}
+
+// searchEnvironment looks for an environment file relative to the current directory, then in an env
+// folder next to the target's folder, in an env folder in the target's folder and finally in the target's
+// folder, then in each folder in searchPath. it returns an empty path if the file isn't in any of them,
+// along with the paths it tried
+func searchEnvironment(workingDirectory string, environmentFileName string, searchPath []string) (string, []string, error) {
+	candidates := []string{
+		environmentFileName,
+		filepath.Join(workingDirectory, "..", "env", environmentFileName),
+		filepath.Join(workingDirectory, "env", environmentFileName),
+		filepath.Join(workingDirectory, environmentFileName),
+	}
+
+	if !filepath.IsAbs(environmentFileName) {
+		for _, v := range searchPath {
+			candidates = append(candidates, filepath.Join(v, environmentFileName))
 		}
+	}
+
+	for _, v := range candidates {
+		if exists, err := naputil.FileExists(v); exists && err != nil {
+			return "", candidates, fmt.Errorf("cannot read '%s'. %w", v, err)
+		} else if exists {
+			return v, candidates, nil
+		}
+	}
 
-		if exists, _ := naputil.FileExists(environmentFileName); !exists {
-			// try and find it relative to the target path
-			environmentFileName = filepath.Join(workingDirectory, originalFileName)
+	return "", candidates, nil
+}
+
+// loadEnvironment reads an environment file and the environments it extends, in order, along with the file
+// each variable came from. chain holds the files that extend this one, to catch an environment that ends
+// up extending itself
+func loadEnvironment(workingDirectory string, environmentFileName string, chain []string, searchPath []string) (*LoadedEnvironment, error) {
+	absolutePath, err := filepath.Abs(environmentFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, v := range chain {
+		if v == absolutePath {
+			cycle := []string{}
+			for _, v := range append(chain[i:], absolutePath) {
+				cycle = append(cycle, filepath.Base(v))
+			}
+
+			return nil, fmt.Errorf("environment cycle: %s", strings.Join(cycle, " -> "))
 		}
+	}
+
+	configData, err := os.ReadFile(environmentFileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open '%s'. %e", environmentFileName, err)
+	}
 
-		if exists, err := naputil.FileExists(environmentFileName); !exists {
-			return existing, fmt.Errorf("environment '%s' not found.", originalFileName)
-		} else if err != nil {
-			return existing, fmt.Errorf("cannot read '%s'. %e", originalFileName, err)
+	if isEncrypted(environmentFileName) {
+		key, err := LoadKey("")
+		if err != nil {
+			return nil, fmt.Errorf("cannot open '%s'. %w", environmentFileName, err)
 		}
 
-		configData, err := os.ReadFile(environmentFileName)
+		configData, err = Decrypt(configData, key)
 		if err != nil {
-			return existing, fmt.Errorf("cannot open '%s'. %e", originalFileName, err)
+			return nil, fmt.Errorf("cannot open '%s'. %w", environmentFileName, err)
 		}
+	}
+
+	parse, _ := parserFor(environmentFileName)
+	env, err := parse(configData)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse '%s'. %w", environmentFileName, err)
+	}
 
-		subMap := make(map[string]string)
+	loaded := newLoadedEnvironment()
+	chain = append(chain[:len(chain):len(chain)], absolutePath)
 
-		err = yaml.Unmarshal(configData, &subMap)
+	for _, v := range env.extends {
+		baseFileName, err := findBaseEnvironment(workingDirectory, filepath.Dir(environmentFileName), v, searchPath)
 		if err != nil {
-			return existing, fmt.Errorf("cannot parse '%s'. %e", originalFileName, err)
+			return nil, fmt.Errorf("'%s' extends %w", filepath.Base(environmentFileName), err)
 		}
 
-		for k, v := range subMap {
-			existing[k] = v
+		base, err := loadEnvironment(workingDirectory, baseFileName, chain, searchPath)
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range base.Variables {
+			loaded.Variables[k] = v
+			loaded.Origins[k] = base.Origins[k]
+			loaded.Structured[k] = base.Structured[k]
 		}
 	}
 
-	return existing, nil
+	for k, v := range env.variables {
+		loaded.Variables[k] = v
+		loaded.Origins[k] = environmentFileName
+		loaded.Structured[k] = env.structured[k]
+	}
+
+	return loaded, nil
+}
+
+// findBaseEnvironment returns the path to an environment that another one extends. it's looked for next to
+// the environment that extends it first
+func findBaseEnvironment(workingDirectory string, directory string, environmentFileName string, searchPath []string) (string, error) {
+	name := environmentFileName
+	if _, ok := parserFor(name); !ok {
+		name = name + ".yml"
+	}
+
+	candidates := []string{name}
+	if !isEncrypted(name) {
+		candidates = append(candidates, name+EncryptedExtension)
+	}
+
+	if !filepath.IsAbs(name) {
+		for _, v := range candidates {
+			if exists, _ := naputil.FileExists(filepath.Join(directory, v)); exists {
+				return filepath.Join(directory, v), nil
+			}
+		}
+	}
+
+	return FindEnvironment(workingDirectory, environmentFileName, searchPath...)
+}
+
+// parserFor returns the parser for an environment file by its extension. an encrypted file is parsed by the
+// extension it had before it was encrypted
+func parserFor(environmentFileName string) (func([]byte) (*environment, error), bool) {
+	parse, ok := parsers[strings.ToLower(path.Ext(strings.TrimSuffix(environmentFileName, EncryptedExtension)))]
+	return parse, ok
+}
+
+func isEncrypted(environmentFileName string) bool {
+	return strings.HasSuffix(environmentFileName, EncryptedExtension)
 }
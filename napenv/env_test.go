@@ -0,0 +1,493 @@
+package napenv_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/davesheldon/nap/napenv"
+	"github.com/davesheldon/nap/napsecret"
+)
+
+func TestEnvironmentFormats(t *testing.T) {
+	tests := map[string]struct {
+		file     string
+		contents string
+		expected map[string]string
+		err      string
+	}{
+		"yaml": {
+			file:     "env.yml",
+			contents: "host: example.com\nport: 8080\n",
+			expected: map[string]string{"host": "example.com", "port": "8080"},
+		},
+		"structured yaml": {
+			file:     "env.yml",
+			contents: "db:\n  host: localhost\n  port: 5432\n  replicas: [ a, b ]\nids: [ 1, 2, 3 ]\nflags:\n  - name: beta\n    enabled: true\nversion: 1.10\n",
+			expected: map[string]string{
+				"db":      `{"host":"localhost","port":5432,"replicas":["a","b"]}`,
+				"ids":     `[1,2,3]`,
+				"flags":   `[{"enabled":true,"name":"beta"}]`,
+				"version": "1.10",
+			},
+		},
+		"json": {
+			file:     "env.json",
+			contents: `{ "host": "example.com", "port": 8080, "tags": [ "a" ], "none": null }`,
+			expected: map[string]string{"host": "example.com", "port": "8080", "tags": `["a"]`, "none": ""},
+		},
+		"json that isn't an object": {
+			file:     "env.json",
+			contents: `[ 1, 2 ]`,
+			err:      "expected an object",
+		},
+		"dotenv": {
+			file: ".env",
+			contents: `# comment
+HOST=example.com
+export TOKEN = abc123
+EMPTY=
+QUOTED="a \"b\"\nc # not a comment"
+SINGLE='raw \n # value'
+INLINE=value # comment
+URL=https://example.com/?a=b#frag
+`,
+			expected: map[string]string{
+				"HOST":   "example.com",
+				"TOKEN":  "abc123",
+				"EMPTY":  "",
+				"QUOTED": "a \"b\"\nc # not a comment",
+				"SINGLE": `raw \n # value`,
+				"INLINE": "value",
+				"URL":    "https://example.com/?a=b#frag",
+			},
+		},
+		"named dotenv": {
+			file:     "staging.env",
+			contents: "HOST=staging.example.com\n",
+			expected: map[string]string{"HOST": "staging.example.com"},
+		},
+		"dotenv without a value": {
+			file:     ".env",
+			contents: "HOST=example.com\nBROKEN\n",
+			err:      "line 2: expected KEY=value",
+		},
+		"dotenv with an unterminated value": {
+			file:     ".env",
+			contents: "HOST=\"example.com\n",
+			err:      "line 1: unterminated value",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, test.file), []byte(test.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			actual, err := napenv.AddEnvironmentFromPath(dir, filepath.Join(dir, test.file), map[string]string{})
+
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	t.Setenv("NAP_TEST_HOST", "os.example.com")
+	t.Setenv("NAP_TEST_TOKEN", "from-os")
+
+	sources := map[napenv.Source]map[string]string{
+		napenv.SourceOS:     napenv.FromOS([]string{"NAP_TEST_"}),
+		napenv.SourceFiles:  {"HOST": "files.example.com", "PORT": "80"},
+		napenv.SourceParams: {"PORT": "8080"},
+	}
+
+	tests := map[string]struct {
+		precedence  string
+		environment map[string]string
+		overrides   map[string]string
+		err         string
+	}{
+		"default": {
+			precedence:  "os,files,params,routine",
+			environment: map[string]string{"HOST": "files.example.com", "TOKEN": "from-os", "PORT": "8080"},
+			overrides:   map[string]string{},
+		},
+		"os wins": {
+			precedence:  "files, params, os, routine",
+			environment: map[string]string{"HOST": "os.example.com", "TOKEN": "from-os", "PORT": "8080"},
+			overrides:   map[string]string{},
+		},
+		"params override routine env": {
+			precedence:  "os,files,routine,params",
+			environment: map[string]string{"HOST": "files.example.com", "TOKEN": "from-os", "PORT": "80"},
+			overrides:   map[string]string{"PORT": "8080"},
+		},
+		"unknown source": {
+			precedence: "os,files,params,routine,cli",
+			err:        `unknown source "cli"`,
+		},
+		"missing source": {
+			precedence: "os,files,params",
+			err:        "must list all of os, files, params, routine",
+		},
+		"repeated source": {
+			precedence: "os,files,params,os",
+			err:        "os is listed more than once",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			precedence, err := napenv.ParsePrecedence(test.precedence)
+
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			environment, overrides := napenv.Layer(precedence, sources)
+
+			if !reflect.DeepEqual(environment, test.environment) {
+				t.Errorf("Expected environment %v, got %v", test.environment, environment)
+			}
+
+			if !reflect.DeepEqual(overrides, test.overrides) {
+				t.Errorf("Expected overrides %v, got %v", test.overrides, overrides)
+			}
+		})
+	}
+}
+
+func TestEnvironmentExtends(t *testing.T) {
+	files := map[string]string{
+		"base.yml":         "host: example.com\nport: 80\nregion: us\n",
+		"shared.json":      `{ "token": "shared", "port": 443 }`,
+		"staging.yml":      "extends: [ base, shared.json ]\nhost: staging.example.com\n",
+		"single.yml":       "extends: base\nregion: eu\n",
+		"nested.yml":       "extends: [ staging ]\nregion: ap\n",
+		"child.json":       `{ "extends": "base", "port": 8080 }`,
+		"cycle-a.yml":      "extends: [ cycle-b ]\n",
+		"cycle-b.yml":      "extends: [ cycle-a ]\n",
+		"self.yml":         "extends: self\n",
+		"missing.yml":      "extends: [ nope ]\n",
+		"bad-extends.yml":  "extends: { a: b }\n",
+		"bad-extends.json": `{ "extends": 1 }`,
+	}
+
+	tests := map[string]struct {
+		file     string
+		expected map[string]string
+		err      string
+	}{
+		"list of bases, later wins and own values win": {
+			file:     "staging.yml",
+			expected: map[string]string{"host": "staging.example.com", "port": "443", "region": "us", "token": "shared"},
+		},
+		"single base": {
+			file:     "single.yml",
+			expected: map[string]string{"host": "example.com", "port": "80", "region": "eu"},
+		},
+		"bases of bases": {
+			file:     "nested.yml",
+			expected: map[string]string{"host": "staging.example.com", "port": "443", "region": "ap", "token": "shared"},
+		},
+		"json": {
+			file:     "child.json",
+			expected: map[string]string{"host": "example.com", "port": "8080", "region": "us"},
+		},
+		"cycle": {
+			file: "cycle-a.yml",
+			err:  "environment cycle: cycle-a.yml -> cycle-b.yml -> cycle-a.yml",
+		},
+		"extends itself": {
+			file: "self.yml",
+			err:  "environment cycle: self.yml -> self.yml",
+		},
+		"missing base": {
+			file: "missing.yml",
+			err:  "'missing.yml' extends environment 'nope.yml' not found.",
+		},
+		"invalid yaml extends": {
+			file: "bad-extends.yml",
+			err:  "extends: expected a list of names",
+		},
+		"invalid extends": {
+			file: "bad-extends.json",
+			err:  "extends: expected a list of names",
+		},
+	}
+
+	dir := t.TempDir()
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			// bases are found next to the environment that extends them, wherever nap runs from
+			actual, err := napenv.AddEnvironmentFromPath(t.TempDir(), filepath.Join(dir, test.file), map[string]string{})
+
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	fallback := func(name string) (string, bool) {
+		if name == "outer" {
+			return "from outside", true
+		}
+
+		return "", false
+	}
+
+	tests := map[string]struct {
+		variables map[string]string
+		expected  map[string]string
+		err       string
+	}{
+		"references": {
+			variables: map[string]string{"host": "example.com", "apiUrl": "https://${host}/api/v2", "usersUrl": "${apiUrl}/users"},
+			expected:  map[string]string{"host": "example.com", "apiUrl": "https://example.com/api/v2", "usersUrl": "https://example.com/api/v2/users"},
+		},
+		"defaults": {
+			variables: map[string]string{"port": "${nope:-80}", "url": "example.com:${port}"},
+			expected:  map[string]string{"port": "80", "url": "example.com:80"},
+		},
+		"fallback": {
+			variables: map[string]string{"a": "${outer}"},
+			expected:  map[string]string{"a": "from outside"},
+		},
+		"unresolved is left": {
+			variables: map[string]string{"auth": "Bearer ${token}"},
+			expected:  map[string]string{"auth": "Bearer ${token}"},
+		},
+		"cycle": {
+			variables: map[string]string{"a": "${b}", "b": "x${c}", "c": "${a}"},
+			err:       "variable cycle:",
+		},
+		"refers to itself": {
+			variables: map[string]string{"a": "${a}"},
+			err:       "variable cycle: a -> a",
+		},
+		"errors": {
+			variables: map[string]string{"a": "${nope:?must be set}"},
+			err:       "cannot resolve a: nope: must be set",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, err := napenv.Resolve(test.variables, fallback)
+
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	for _, v := range []string{"env", "shared"} {
+		if err := os.MkdirAll(filepath.Join(dir, v), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := map[string]string{
+		"env/base.yml":       "host: example.com\nport: 80\n",
+		"shared/staging.yml": "extends: base\napiUrl: https://${host}:${port}/api\ntoken: ${secret:env:NAP_LOAD_TEST_SECRET}\n",
+	}
+
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv("NAP_LOAD_TEST_SECRET", "s3cret")
+	t.Setenv("NAP_LOAD_TEST_REGION", "eu")
+
+	precedence, err := napenv.ParsePrecedence("os,files,routine,params")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	masker := napsecret.NewMasker()
+
+	start, err := napenv.Load(&napenv.LoadOptions{
+		WorkingDirectory: dir,
+		Files:            []string{"staging"},
+		SearchPath:       []string{filepath.Join(dir, "shared")},
+		Params:           map[string]string{"port": "8080"},
+		ConfigParams:     map[string]string{"port": "9090", "team": "qa"},
+		ConfigPath:       "nap.yml",
+		OSPrefixes:       []string{"NAP_LOAD_TEST_"},
+		Precedence:       precedence,
+	}, masker)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := map[string]string{
+		"host":   "example.com",
+		"port":   "80",
+		"apiUrl": "https://example.com:8080/api",
+		"token":  "s3cret",
+		"team":   "qa",
+		"REGION": "eu",
+		"SECRET": "s3cret",
+	}
+
+	if !reflect.DeepEqual(start.Environment, expected) {
+		t.Errorf("Expected environment %v, got %v", expected, start.Environment)
+	}
+
+	if !reflect.DeepEqual(start.Overrides, map[string]string{"port": "8080"}) {
+		t.Errorf("Expected the params to override routine env, got %v", start.Overrides)
+	}
+
+	origins := map[string]string{
+		"host":   filepath.Join(dir, "env", "base.yml"),
+		"port":   "--param",
+		"apiUrl": filepath.Join(dir, "shared", "staging.yml"),
+		"token":  filepath.Join(dir, "shared", "staging.yml"),
+		"team":   "nap.yml",
+		"REGION": "os NAP_LOAD_TEST_REGION",
+		"SECRET": "os NAP_LOAD_TEST_SECRET",
+	}
+
+	if !reflect.DeepEqual(start.Origins, origins) {
+		t.Errorf("Expected origins %v, got %v", origins, start.Origins)
+	}
+
+	if !reflect.DeepEqual(start.Secrets, map[string]bool{"token": true}) {
+		t.Errorf("Expected token to be a secret, got %v", start.Secrets)
+	}
+
+	if masked := masker.Mask("Bearer s3cret"); masked != "Bearer "+napsecret.Redacted {
+		t.Errorf("Expected the secret to be masked, got %s", masked)
+	}
+}
+
+func TestLoadConfigParams(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "dev.yml"), []byte("host: file.example.com\nregion: file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("NAP_CONFIG_TEST_region", "os")
+	t.Setenv("NAP_CONFIG_TEST_team", "os")
+
+	tests := map[string]struct {
+		precedence  string
+		environment map[string]string
+		overrides   map[string]string
+		origins     map[string]string
+	}{
+		"every source overrides config params": {
+			precedence:  "os,files,params,routine",
+			environment: map[string]string{"host": "file.example.com", "region": "file", "team": "os", "user": "param", "timeout": "30"},
+			overrides:   map[string]string{},
+			origins:     map[string]string{"host": filepath.Join(dir, "dev.yml"), "region": filepath.Join(dir, "dev.yml"), "team": "os NAP_CONFIG_TEST_team", "user": "--param", "timeout": "nap.yml"},
+		},
+		"config params stay below os when it's the highest source": {
+			precedence:  "files,params,os,routine",
+			environment: map[string]string{"host": "file.example.com", "region": "os", "team": "os", "user": "param", "timeout": "30"},
+			overrides:   map[string]string{},
+			origins:     map[string]string{"host": filepath.Join(dir, "dev.yml"), "region": "os NAP_CONFIG_TEST_region", "team": "os NAP_CONFIG_TEST_team", "user": "--param", "timeout": "nap.yml"},
+		},
+		"config params stay below routine env when the other sources override it": {
+			precedence:  "routine,os,files,params",
+			environment: map[string]string{"host": "config.example.com", "region": "config", "team": "config", "user": "config", "timeout": "30"},
+			overrides:   map[string]string{"host": "file.example.com", "region": "file", "team": "os", "user": "param"},
+			origins:     map[string]string{"host": filepath.Join(dir, "dev.yml"), "region": filepath.Join(dir, "dev.yml"), "team": "os NAP_CONFIG_TEST_team", "user": "--param", "timeout": "nap.yml"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			precedence, err := napenv.ParsePrecedence(test.precedence)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start, err := napenv.Load(&napenv.LoadOptions{
+				WorkingDirectory: dir,
+				Files:            []string{filepath.Join(dir, "dev.yml")},
+				Params:           map[string]string{"user": "param"},
+				ConfigParams:     map[string]string{"host": "config.example.com", "region": "config", "team": "config", "user": "config", "timeout": "30"},
+				ConfigPath:       "nap.yml",
+				OSPrefixes:       []string{"NAP_CONFIG_TEST_"},
+				Precedence:       precedence,
+			}, napsecret.NewMasker())
+
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if !reflect.DeepEqual(start.Environment, test.environment) {
+				t.Errorf("Expected environment %v, got %v", test.environment, start.Environment)
+			}
+
+			if !reflect.DeepEqual(start.Overrides, test.overrides) {
+				t.Errorf("Expected overrides %v, got %v", test.overrides, start.Overrides)
+			}
+
+			if !reflect.DeepEqual(start.Origins, test.origins) {
+				t.Errorf("Expected origins %v, got %v", test.origins, start.Origins)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+formats.go - this file contains parsers for the environment file formats
+*/
+package napenv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// environment is what an environment file contains: its own variables, which of them hold lists or maps
+// stored as json, and the names of the environments it extends
+type environment struct {
+	variables  map[string]string
+	structured map[string]bool
+	extends    []string
+}
+
+// extendsKey is the key an environment uses to list the environments it extends
+const extendsKey = "extends"
+
+// parsers reads an environment file, by file extension
+var parsers = map[string]func([]byte) (*environment, error){
+	".yml":  parseYaml,
+	".yaml": parseYaml,
+	".json": parseJson,
+	".env":  parseDotenv,
+}
+
+var dotenvKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.\-]*$`)
+
+// yamlValue is a value in a yaml environment. scalars are kept as they're written, and lists and maps
+// are kept as structured values
+type yamlValue struct {
+	text       string
+	structured interface{}
+}
+
+func (value *yamlValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&value.text); err == nil {
+		return nil
+	}
+
+	return unmarshal(&value.structured)
+}
+
+func parseYaml(data []byte) (*environment, error) {
+	values := make(map[string]yamlValue)
+
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+
+	env := &environment{variables: make(map[string]string), structured: make(map[string]bool)}
+
+	for k, v := range values {
+		if k == extendsKey {
+			extends, err := parseExtends(v.text, v.structured)
+			if err != nil {
+				return nil, err
+			}
+
+			env.extends = extends
+			continue
+		}
+
+		if v.structured == nil {
+			env.variables[k] = v.text
+			continue
+		}
+
+		data, err := json.Marshal(normalizeYaml(v.structured))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+
+		env.variables[k] = string(data)
+		env.structured[k] = true
+	}
+
+	return env, nil
+}
+
+// parseExtends reads the names of the environments an environment extends, given as one name or a list
+func parseExtends(text string, structured interface{}) ([]string, error) {
+	switch value := structured.(type) {
+	case nil:
+		return []string{text}, nil
+	case []interface{}:
+		extends := make([]string, 0, len(value))
+		for _, v := range value {
+			name, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: expected a list of names", extendsKey)
+			}
+
+			extends = append(extends, name)
+		}
+
+		return extends, nil
+	default:
+		return nil, fmt.Errorf("%s: expected a list of names", extendsKey)
+	}
+}
+
+// normalizeYaml converts the maps in a yaml value to ones with string keys, so it can be stored as json
+func normalizeYaml(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized[fmt.Sprint(key)] = normalizeYaml(item)
+		}
+
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, item := range v {
+			normalized[i] = normalizeYaml(item)
+		}
+
+		return normalized
+	default:
+		return v
+	}
+}
+
+// parseJson reads a json object. strings are used as they are, null becomes an empty string and anything
+// else is stored as json
+func parseJson(data []byte) (*environment, error) {
+	var object map[string]interface{}
+
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, fmt.Errorf("expected an object: %w", err)
+	}
+
+	env := &environment{variables: make(map[string]string), structured: make(map[string]bool)}
+
+	if extends, ok := object[extendsKey]; ok {
+		delete(object, extendsKey)
+
+		text, isText := extends.(string)
+		if isText {
+			extends = nil
+		} else if extends == nil {
+			return nil, fmt.Errorf("%s: expected a list of names", extendsKey)
+		}
+
+		names, err := parseExtends(text, extends)
+		if err != nil {
+			return nil, err
+		}
+
+		env.extends = names
+	}
+
+	variables := env.variables
+
+	for k, v := range object {
+		switch value := v.(type) {
+		case nil:
+			variables[k] = ""
+		case string:
+			variables[k] = value
+		default:
+			data, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+
+			variables[k] = string(data)
+
+			switch value.(type) {
+			case map[string]interface{}, []interface{}:
+				env.structured[k] = true
+			}
+		}
+	}
+
+	return env, nil
+}
+
+// parseDotenv reads KEY=value lines. lines may start with export, blank lines and lines starting with #
+// are ignored, and values may be double quoted (with escapes such as \n), single quoted (taken as they
+// are) or unquoted, in which case a # after whitespace starts a comment
+func parseDotenv(data []byte) (*environment, error) {
+	variables := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		text = strings.TrimSpace(strings.TrimPrefix(text, "export "))
+
+		separator := strings.Index(text, "=")
+		if separator < 0 {
+			return nil, fmt.Errorf("line %d: expected KEY=value", line)
+		}
+
+		key := strings.TrimSpace(text[:separator])
+		if !dotenvKeyRegex.MatchString(key) {
+			return nil, fmt.Errorf("line %d: invalid name: %s", line, key)
+		}
+
+		value, err := parseDotenvValue(strings.TrimSpace(text[separator+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		variables[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &environment{variables: variables, structured: make(map[string]bool)}, nil
+}
+
+func parseDotenvValue(text string) (string, error) {
+	if len(text) == 0 {
+		return "", nil
+	}
+
+	switch text[0] {
+	case '"':
+		end := closingQuote(text)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated value: %s", text)
+		}
+
+		return strconv.Unquote(text[:end+1])
+	case '\'':
+		end := strings.IndexByte(text[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated value: %s", text)
+		}
+
+		return text[1 : end+1], nil
+	}
+
+	if comment := strings.Index(text, " #"); comment >= 0 {
+		text = text[:comment]
+	}
+
+	return strings.TrimSpace(text), nil
+}
+
+// closingQuote returns the index of the " that ends a double quoted value, or -1 if there isn't one
+func closingQuote(text string) int {
+	for i := 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+
+	return -1
+}
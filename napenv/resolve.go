@@ -0,0 +1,131 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+resolve.go - this file contains logic for resolving environment values that refer to other variables
+*/
+package napenv
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/davesheldon/nap/napsecret"
+	"github.com/davesheldon/nap/naptemplate"
+)
+
+// Resolve substitutes references to other variables into each value, e.g. apiUrl: ${host}/api/v2. it's
+// meant to run once every environment has been merged, so a value can refer to a variable from any of
+// them. a reference to a variable that isn't in variables is looked up with fallback, if there is one, and
+// left as it is if it can't be found. a variable that refers back to itself is an error
+func Resolve(variables map[string]string, fallback naptemplate.Lookup) (map[string]string, error) {
+	resolver := &resolver{
+		variables: variables,
+		fallback:  fallback,
+		resolved:  make(map[string]string, len(variables)),
+	}
+
+	for k := range variables {
+		if _, err := resolver.resolve(k); err != nil {
+			return nil, err
+		}
+	}
+
+	return resolver.resolved, nil
+}
+
+// ResolveSecrets replaces each secret reference in the values, e.g. ${secret:file:/run/secrets/token}, with
+// the secret it points to. the secrets are added to masker so they're hidden in output
+func ResolveSecrets(variables map[string]string, masker *napsecret.Masker) (map[string]string, error) {
+	resolved := make(map[string]string, len(variables))
+
+	for k, v := range variables {
+		if !napsecret.Contains(v) {
+			resolved[k] = v
+			continue
+		}
+
+		value, secrets, err := napsecret.Substitute(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+
+		masker.Add(secrets...)
+		resolved[k] = value
+	}
+
+	return resolved, nil
+}
+
+type resolver struct {
+	variables map[string]string
+	fallback  naptemplate.Lookup
+	resolved  map[string]string
+
+	// the variables being resolved, in the order they refer to each other
+	chain []string
+	err   error
+}
+
+func (resolver *resolver) resolve(name string) (string, error) {
+	if value, ok := resolver.resolved[name]; ok {
+		return value, nil
+	}
+
+	for i, v := range resolver.chain {
+		if v == name {
+			return "", fmt.Errorf("variable cycle: %s -> %s", strings.Join(resolver.chain[i:], " -> "), name)
+		}
+	}
+
+	resolver.chain = append(resolver.chain, name)
+	defer func() { resolver.chain = resolver.chain[:len(resolver.chain)-1] }()
+
+	value, err := naptemplate.Render(resolver.variables[name], resolver.lookup)
+	if resolver.err != nil {
+		return "", resolver.err
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve %s: %w", name, err)
+	}
+
+	resolver.resolved[name] = value
+
+	return value, nil
+}
+
+// lookup resolves a variable that another one refers to. template lookups can't fail, so an error is kept
+// until the value that referred to it is finished
+func (resolver *resolver) lookup(name string) (string, bool) {
+	if resolver.err != nil {
+		return "", false
+	}
+
+	if _, ok := resolver.variables[name]; ok {
+		value, err := resolver.resolve(name)
+		if err != nil {
+			resolver.err = err
+			return "", false
+		}
+
+		return value, true
+	}
+
+	if resolver.fallback != nil {
+		return resolver.fallback(name)
+	}
+
+	return "", false
+}
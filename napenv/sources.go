@@ -0,0 +1,281 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+sources.go - this file contains logic for combining the sources of a run's starting variables
+*/
+package napenv
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/davesheldon/nap/napsecret"
+)
+
+// Source is somewhere the variables a run starts with come from
+type Source string
+
+const (
+	// SourceOS is the nap process's environment, imported with --env-from-os
+	SourceOS Source = "os"
+
+	// SourceFiles is the environment files given with --env
+	SourceFiles Source = "files"
+
+	// SourceParams is the variables given with --param
+	SourceParams Source = "params"
+
+	// SourceRoutine is the env of each routine, applied when the routine starts
+	SourceRoutine Source = "routine"
+)
+
+// DefaultPrecedence lists the sources from lowest to highest precedence
+var DefaultPrecedence = []Source{SourceOS, SourceFiles, SourceParams, SourceRoutine}
+
+// ParsePrecedence reads a comma separated list of sources, from lowest to highest precedence. each source
+// must be listed exactly once
+func ParsePrecedence(text string) ([]Source, error) {
+	precedence := []Source{}
+	seen := make(map[Source]bool)
+
+	for _, v := range strings.Split(text, ",") {
+		source := Source(strings.TrimSpace(v))
+
+		if !isSource(source) {
+			return nil, fmt.Errorf("invalid precedence: unknown source %q (must be one of %s)", source, joinSources(DefaultPrecedence))
+		}
+
+		if seen[source] {
+			return nil, fmt.Errorf("invalid precedence: %s is listed more than once", source)
+		}
+
+		seen[source] = true
+		precedence = append(precedence, source)
+	}
+
+	if len(precedence) != len(DefaultPrecedence) {
+		return nil, fmt.Errorf("invalid precedence: %s must list all of %s", text, joinSources(DefaultPrecedence))
+	}
+
+	return precedence, nil
+}
+
+func isSource(source Source) bool {
+	for _, v := range DefaultPrecedence {
+		if v == source {
+			return true
+		}
+	}
+
+	return false
+}
+
+func joinSources(sources []Source) string {
+	names := make([]string, 0, len(sources))
+	for _, v := range sources {
+		names = append(names, string(v))
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// FromOS returns the nap process's environment variables whose names start with one of the prefixes, with
+// the prefix removed. an empty prefix imports every variable as it is
+func FromOS(prefixes []string) map[string]string {
+	variables, _ := fromOS(prefixes)
+	return variables
+}
+
+// fromOS returns the same variables as FromOS, along with the name each one has in the os environment
+func fromOS(prefixes []string) (map[string]string, map[string]string) {
+	variables := make(map[string]string)
+	names := make(map[string]string)
+
+	for _, prefix := range prefixes {
+		for _, v := range os.Environ() {
+			separator := strings.Index(v, "=")
+			if separator <= 0 {
+				continue
+			}
+
+			name, value := v[:separator], v[separator+1:]
+
+			if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+				variables[name[len(prefix):]] = value
+				names[name[len(prefix):]] = name
+			}
+		}
+	}
+
+	return variables, names
+}
+
+// Layer merges the variables from each source in order of precedence. the variables from sources below
+// routine env are returned as environment, and the ones from sources above it as overrides, which are
+// applied over every routine's env
+func Layer(precedence []Source, variables map[Source]map[string]string) (map[string]string, map[string]string) {
+	environment := make(map[string]string)
+	overrides := make(map[string]string)
+
+	target := environment
+	for _, source := range precedence {
+		if source == SourceRoutine {
+			target = overrides
+			continue
+		}
+
+		for k, v := range variables[source] {
+			target[k] = v
+		}
+	}
+
+	return environment, overrides
+}
+
+// LoadOptions says where the variables a run starts with come from
+type LoadOptions struct {
+	// the directory of the target, near which environment files are looked for
+	WorkingDirectory string
+
+	// environment files, from --env
+	Files []string
+
+	// more folders to look for environment files in
+	SearchPath []string
+
+	// variables from --param
+	Params map[string]string
+
+	// variables from the project config, and the config's path. they're defaults, below every other source
+	ConfigParams map[string]string
+	ConfigPath   string
+
+	// prefixes of os environment variables to import, from --env-from-os
+	OSPrefixes []string
+
+	// the order in which the sources override each other, lowest first
+	Precedence []Source
+}
+
+// StartingVariables are the variables a run starts with
+type StartingVariables struct {
+	// the variables below routine env, and the ones that override it
+	Environment map[string]string
+	Overrides   map[string]string
+
+	// where each variable's value came from: the path of an environment file, --param or the name of an os
+	// environment variable
+	Origins map[string]string
+
+	// the variables whose values hold secrets
+	Secrets map[string]bool
+
+	// the variables whose values hold lists or maps from an environment file, which are stored as json
+	Structured map[string]bool
+}
+
+// Load reads the variables a run starts with from each source and merges them in order of precedence.
+// references between them are resolved once they're merged, and then secrets are looked up and added to
+// masker
+func Load(options *LoadOptions, masker *napsecret.Masker) (*StartingVariables, error) {
+	files := make(map[string]string)
+	fileOrigins := make(map[string]string)
+	fileStructured := make(map[string]bool)
+
+	for _, v := range options.Files {
+		loaded, err := LoadEnvironmentFromPath(options.WorkingDirectory, v, options.SearchPath...)
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range loaded.Variables {
+			files[k] = v
+			fileOrigins[k] = loaded.Origins[k]
+			fileStructured[k] = loaded.Structured[k]
+		}
+	}
+
+	osVariables, osNames := fromOS(options.OSPrefixes)
+
+	sources := map[Source]map[string]string{
+		SourceOS:     osVariables,
+		SourceFiles:  files,
+		SourceParams: options.Params,
+	}
+
+	start := &StartingVariables{Origins: make(map[string]string), Secrets: make(map[string]bool), Structured: make(map[string]bool)}
+	start.Environment, start.Overrides = Layer(options.Precedence, sources)
+
+	// the project config's params are the lowest of all, so any other source can override them
+	for k, v := range options.ConfigParams {
+		if _, ok := start.Environment[k]; !ok {
+			start.Environment[k] = v
+			start.Origins[k] = options.ConfigPath
+		}
+	}
+
+	for _, source := range options.Precedence {
+		for k := range sources[source] {
+			start.Structured[k] = source == SourceFiles && fileStructured[k]
+
+			switch source {
+			case SourceOS:
+				start.Origins[k] = "os " + osNames[k]
+			case SourceFiles:
+				start.Origins[k] = fileOrigins[k]
+			case SourceParams:
+				start.Origins[k] = "--param"
+			}
+		}
+	}
+
+	// values can refer to variables from any source, so they're resolved once everything is merged
+	merged := make(map[string]string, len(start.Environment)+len(start.Overrides))
+	for _, variables := range []map[string]string{start.Environment, start.Overrides} {
+		for k, v := range variables {
+			merged[k] = v
+		}
+	}
+
+	resolved, err := Resolve(merged, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range resolved {
+		if napsecret.Contains(v) {
+			start.Secrets[k] = true
+		}
+	}
+
+	resolved, err = ResolveSecrets(resolved, masker)
+	if err != nil {
+		return nil, err
+	}
+
+	for k := range start.Environment {
+		// an overridden value is hidden by the override, so it's left as it is
+		if _, ok := start.Overrides[k]; !ok {
+			start.Environment[k] = resolved[k]
+		}
+	}
+
+	for k := range start.Overrides {
+		start.Overrides[k] = resolved[k]
+	}
+
+	return start, nil
+}
@@ -18,7 +18,10 @@ query.go - this file contains logic for evaluating queries
 package napquery
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -29,6 +32,9 @@ import (
 
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
+var eventQueryRegex = regexp.MustCompile(`^event\[(\d+)\] (id|event|type|data)(?: jsonpath (.+))?$`)
+var messageQueryRegex = regexp.MustCompile(`^message\[(\d+)\] (type|data)(?: jsonpath (.+))?$`)
+
 func evalJsonPath(expression string, data interface{}) ([]interface{}, error) {
 	var config = jsonpath.Config{}
 	config.SetAggregateFunction(`length`, func(params []interface{}) (interface{}, error) {
@@ -79,6 +85,46 @@ func Eval(query string, vmData *napscript.VmHttpData) ([]any, error) {
 		return value, nil
 	}
 
+	trailer, isTrailer := strings.CutPrefix(query, "trailer ")
+	if isTrailer {
+		if vmData.Response.Trailers == nil {
+			return nil, nil
+		}
+
+		return vmData.Response.Trailers[trailer], nil
+	}
+
+	if query == "graphql errors" || query == "graphql errors count" {
+		errors, err := evalJsonPath("$.errors[*].message", vmData.Response.JsonBody)
+		if err != nil {
+			errors = []any{}
+		}
+
+		if query == "graphql errors count" {
+			return []any{strconv.Itoa(len(errors))}, nil
+		}
+
+		return errors, nil
+	}
+
+	graphqlData, isGraphqlData := strings.CutPrefix(query, "graphql data")
+	if isGraphqlData {
+		path := strings.TrimPrefix(strings.TrimSpace(graphqlData), "$")
+		if len(path) > 0 && !strings.HasPrefix(path, ".") && !strings.HasPrefix(path, "[") {
+			path = "." + path
+		}
+
+		return evalJsonPath("$.data"+path, vmData.Response.JsonBody)
+	}
+
+	if query == "grpc status" {
+		return []any{vmData.Response.GrpcStatus}, nil
+	}
+
+	if query == "grpc message" {
+		return []any{vmData.Response.GrpcMessage}, nil
+	}
+
 	cookie, isCookie := strings.CutPrefix(query, "cookie ")
 	if isCookie {
 		if strings.Contains(cookie, "[") {
@@ -119,6 +165,63 @@ func Eval(query string, vmData *napscript.VmHttpData) ([]any, error) {
 		}
 	}
 
+	if query == "events count" {
+		return []any{strconv.Itoa(len(vmData.Response.Events))}, nil
+	}
+
+	if matches := eventQueryRegex.FindStringSubmatch(query); matches != nil {
+		index, err := strconv.Atoi(matches[1])
+		if err != nil {
+			return nil, err
+		}
+
+		if index >= len(vmData.Response.Events) {
+			return []any{}, nil
+		}
+
+		event := vmData.Response.Events[index]
+
+		switch matches[2] {
+		case "id":
+			return []any{event.Id}, nil
+		case "event", "type":
+			return []any{event.Event}, nil
+		}
+
+		if len(matches[3]) > 0 {
+			return evalJsonPath(matches[3], event.JsonData)
+		}
+
+		return []any{event.Data}, nil
+	}
+
+	if query == "messages count" {
+		return []any{strconv.Itoa(len(vmData.Response.Messages))}, nil
+	}
+
+	if matches := messageQueryRegex.FindStringSubmatch(query); matches != nil {
+		index, err := strconv.Atoi(matches[1])
+		if err != nil {
+			return nil, err
+		}
+
+		if index >= len(vmData.Response.Messages) {
+			return []any{}, nil
+		}
+
+		message := vmData.Response.Messages[index]
+
+		if matches[2] == "type" {
+			return []any{message.Type}, nil
+		}
+
+		if len(matches[3]) > 0 {
+			return evalJsonPath(matches[3], message.JsonData)
+		}
+
+		return []any{message.Data}, nil
+	}
+
 	if query == "status" {
 		return []any{strconv.Itoa(vmData.Response.StatusCode)}, nil
 	}
@@ -131,5 +234,33 @@ func Eval(query string, vmData *napscript.VmHttpData) ([]any, error) {
 		return []any{vmData.Response.Body}, nil
 	}
 
+	if query == "bytes" || query == "bytes hex" {
+		return []any{hex.EncodeToString([]byte(vmData.Response.Body))}, nil
+	}
+
+	if query == "bytes base64" {
+		return []any{base64.StdEncoding.EncodeToString([]byte(vmData.Response.Body))}, nil
+	}
+
+	if query == "sha256" {
+		return []any{vmData.Response.Sha256}, nil
+	}
+
+	if query == "md5" {
+		return []any{vmData.Response.Md5}, nil
+	}
+
+	if query == "size" {
+		return []any{strconv.FormatInt(vmData.Response.Size, 10)}, nil
+	}
+
+	if query == "jsonvalid" {
+		return []any{strconv.FormatBool(vmData.Response.JsonValid)}, nil
+	}
+
+	if query == "jsonerror" {
+		return []any{vmData.Response.JsonError}, nil
+	}
+
 	return nil, fmt.Errorf("Query \"%s\" not recognized.", query)
 }
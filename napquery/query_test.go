@@ -1,6 +1,9 @@
 package napquery_test
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
 	"testing"
 
 	"github.com/davesheldon/nap/napquery"
@@ -13,10 +16,13 @@ var json = jsoniter.ConfigCompatibleWithStandardLibrary
 func TestQueries(t *testing.T) {
 
 	data := mockVmHttpData()
+	binaryData := mockBinaryVmHttpData()
+	graphqlData := mockGraphqlVmHttpData()
 
 	tests := map[string]struct {
 		query       string
 		expectation []interface{}
+		data        *napscript.VmHttpData
 	}{
 		"body - default": {
 			query:       "body",
@@ -34,11 +40,112 @@ func TestQueries(t *testing.T) {
 			query:       "jsonpath $.results[?(@.name == \"nothing\")].length()",
 			expectation: []any{},
 		},
+		"events - count": {
+			query:       "events count",
+			expectation: []any{"2"},
+		},
+		"event - data": {
+			query:       "event[0] data",
+			expectation: []any{"hello"},
+		},
+		"event - type": {
+			query:       "event[1] event",
+			expectation: []any{"update"},
+		},
+		"event - id": {
+			query:       "event[1] id",
+			expectation: []any{"2"},
+		},
+		"event - data jsonpath": {
+			query:       "event[1] data jsonpath $.id",
+			expectation: []any{float64(42)},
+		},
+		"event - out of range": {
+			query:       "event[5] data",
+			expectation: []any{},
+		},
+		"graphql errors": {
+			query:       "graphql errors",
+			expectation: []any{"Cannot query field \"nope\""},
+			data:        graphqlData,
+		},
+		"graphql errors - count": {
+			query:       "graphql errors count",
+			expectation: []any{"1"},
+			data:        graphqlData,
+		},
+		"graphql errors - none": {
+			query:       "graphql errors",
+			expectation: []any{},
+		},
+		"graphql errors - count, none": {
+			query:       "graphql errors count",
+			expectation: []any{"0"},
+		},
+		"graphql data - path": {
+			query:       "graphql data company.ceo",
+			expectation: []any{"Elon Musk"},
+			data:        graphqlData,
+		},
+		"graphql data - jsonpath": {
+			query:       "graphql data $.company.ceo",
+			expectation: []any{"Elon Musk"},
+			data:        graphqlData,
+		},
+		"bytes - default": {
+			query:       "bytes",
+			expectation: []any{"00ff6e6170"},
+			data:        binaryData,
+		},
+		"bytes - hex": {
+			query:       "bytes hex",
+			expectation: []any{"00ff6e6170"},
+			data:        binaryData,
+		},
+		"bytes - base64": {
+			query:       "bytes base64",
+			expectation: []any{"AP9uYXA="},
+			data:        binaryData,
+		},
+		"sha256": {
+			query:       "sha256",
+			expectation: []any{"7da62e32f0d451c6d42c2c0b7e6b62a768142ec63a1b547bc66145b136bc3292"},
+			data:        binaryData,
+		},
+		"md5": {
+			query:       "md5",
+			expectation: []any{"a3863ed26ec4ba1c758d55932d4d48e4"},
+			data:        binaryData,
+		},
+		"size": {
+			query:       "size",
+			expectation: []any{"5"},
+			data:        binaryData,
+		},
+		"jsonvalid - valid": {
+			query:       "jsonvalid",
+			expectation: []any{"true"},
+		},
+		"jsonvalid - malformed": {
+			query:       "jsonvalid",
+			expectation: []any{"false"},
+			data:        binaryData,
+		},
+		"jsonerror - malformed": {
+			query:       "jsonerror",
+			expectation: []any{binaryData.Response.JsonError},
+			data:        binaryData,
+		},
 	}
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			actual, err := napquery.Eval(test.query, data)
+			testData := test.data
+			if testData == nil {
+				testData = data
+			}
+
+			actual, err := napquery.Eval(test.query, testData)
 			if err != nil {
 				t.Errorf("%T: %e", err, err)
 			} else if len(actual) == len(test.expectation) && len(test.expectation) == 0 {
@@ -88,5 +195,32 @@ func mockVmHttpData() *napscript.VmHttpData {
 		}
 	] }`
 	json.Unmarshal([]byte(data.Response.Body), &data.Response.JsonBody)
+	data.Response.JsonValid = true
+	data.Response.Events = []*napscript.VmSseEvent{
+		{Id: "1", Event: "message", Data: "hello"},
+		{Id: "2", Event: "update", Data: `{ "id": 42 }`, JsonData: map[string]any{"id": float64(42)}},
+	}
+	return data
+}
+
+func mockBinaryVmHttpData() *napscript.VmHttpData {
+	data := new(napscript.VmHttpData)
+	data.Response = new(napscript.VmHttpResponse)
+	data.Response.Headers = make(map[string][]any)
+	data.Response.Headers["Content-Type"] = []any{"application/json"}
+	data.Response.Body = "\x00\xffnap"
+	data.Response.Size = 5
+	data.Response.Sha256 = fmt.Sprintf("%x", sha256.Sum256([]byte(data.Response.Body)))
+	data.Response.Md5 = fmt.Sprintf("%x", md5.Sum([]byte(data.Response.Body)))
+	data.Response.JsonError = json.Unmarshal([]byte(data.Response.Body), &data.Response.JsonBody).Error()
+	return data
+}
+
+func mockGraphqlVmHttpData() *napscript.VmHttpData {
+	data := new(napscript.VmHttpData)
+	data.Response = new(napscript.VmHttpResponse)
+	data.Response.Body = `{ "data": { "company": { "ceo": "Elon Musk" } }, "errors": [ { "message": "Cannot query field \"nope\"" } ] }`
+	json.Unmarshal([]byte(data.Response.Body), &data.Response.JsonBody)
+	data.Response.JsonValid = true
 	return data
 }
@@ -0,0 +1,120 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+json.go - this file contains logic for writing run results as json
+*/
+package napreport
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/davesheldon/nap/napcontext"
+	"github.com/davesheldon/nap/naproutine"
+)
+
+type jsonRoutine struct {
+	Name           string      `json:"name"`
+	Passing        bool        `json:"passing"`
+	StartTime      time.Time   `json:"startTime"`
+	EndTime        time.Time   `json:"endTime"`
+	ElapsedMs      int64       `json:"elapsedMs"`
+	Errors         []string    `json:"errors,omitempty"`
+	TeardownErrors []string    `json:"teardownErrors,omitempty"`
+	Setup          []*jsonStep `json:"setup,omitempty"`
+	Steps          []*jsonStep `json:"steps"`
+	Teardown       []*jsonStep `json:"teardown,omitempty"`
+}
+
+type jsonStep struct {
+	Name         string       `json:"name"`
+	Type         string       `json:"type,omitempty"`
+	Passing      bool         `json:"passing"`
+	Skipped      bool         `json:"skipped,omitempty"`
+	SkipReason   string       `json:"skipReason,omitempty"`
+	NotRun       bool         `json:"notRun,omitempty"`
+	NotRunReason string       `json:"notRunReason,omitempty"`
+	Status       string       `json:"status,omitempty"`
+	Attempts     int          `json:"attempts,omitempty"`
+	ElapsedMs    int64        `json:"elapsedMs"`
+	Output       []string     `json:"output,omitempty"`
+	Errors       []string     `json:"errors,omitempty"`
+	Routine      *jsonRoutine `json:"routine,omitempty"`
+}
+
+func marshalJson(result *naproutine.RoutineResult, ctx *napcontext.Context) ([]byte, error) {
+	data, err := json.MarshalIndent(newJsonRoutine(result, ctx), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, '\n'), nil
+}
+
+func newJsonRoutine(result *naproutine.RoutineResult, ctx *napcontext.Context) *jsonRoutine {
+	return &jsonRoutine{
+		Name:           routineName(result),
+		Passing:        result.IsPassing(),
+		StartTime:      result.StartTime,
+		EndTime:        result.EndTime,
+		ElapsedMs:      result.GetElapsedMs(),
+		Errors:         maskErrors(result.Errors, ctx),
+		TeardownErrors: maskErrors(result.TeardownErrors, ctx),
+		Setup:          newJsonSteps(result.SetupResults, ctx),
+		Steps:          newJsonSteps(result.StepResults, ctx),
+		Teardown:       newJsonSteps(result.TeardownResults, ctx),
+	}
+}
+
+func newJsonSteps(stepResults []*naproutine.RoutineStepResult, ctx *napcontext.Context) []*jsonStep {
+	steps := make([]*jsonStep, 0, len(stepResults))
+
+	for _, v := range stepResults {
+		if v == nil {
+			continue
+		}
+
+		step := &jsonStep{
+			Name:         ctx.Mask(v.GetName()),
+			Type:         v.StepType,
+			Passing:      v.IsPassing(),
+			Skipped:      v.Skipped,
+			SkipReason:   ctx.Mask(v.SkipReason),
+			NotRun:       v.NotRun,
+			NotRunReason: ctx.Mask(v.NotRunReason),
+			ElapsedMs:    v.EndTime.Sub(v.StartTime).Milliseconds(),
+			Errors:       maskErrors(stepErrors(v), ctx),
+		}
+
+		if v.RequestResult != nil {
+			step.Status = v.RequestResult.GetStatus()
+			step.Attempts = v.RequestResult.Attempts
+		}
+
+		if v.ScriptResult != nil {
+			for _, output := range v.ScriptResult.ScriptOutput {
+				step.Output = append(step.Output, ctx.Mask(output))
+			}
+		}
+
+		if v.SubroutineResult != nil {
+			step.Routine = newJsonRoutine(v.SubroutineResult, ctx)
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps
+}
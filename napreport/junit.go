@@ -0,0 +1,166 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+junit.go - this file contains logic for writing run results as junit xml
+*/
+package napreport
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"github.com/davesheldon/nap/napcontext"
+	"github.com/davesheldon/nap/naproutine"
+)
+
+type junitSuites struct {
+	XMLName  xml.Name      `xml:"testsuites"`
+	Name     string        `xml:"name,attr"`
+	Tests    int           `xml:"tests,attr"`
+	Failures int           `xml:"failures,attr"`
+	Skipped  int           `xml:"skipped,attr"`
+	Time     string        `xml:"time,attr"`
+	Suites   []*junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string       `xml:"name,attr"`
+	Tests     int          `xml:"tests,attr"`
+	Failures  int          `xml:"failures,attr"`
+	Skipped   int          `xml:"skipped,attr"`
+	Time      string       `xml:"time,attr"`
+	Timestamp string       `xml:"timestamp,attr,omitempty"`
+	Cases     []*junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string          `xml:"name,attr"`
+	ClassName string          `xml:"classname,attr"`
+	Time      string          `xml:"time,attr"`
+	Failure   *junitFailure   `xml:"failure,omitempty"`
+	Skipped   *junitSkipped   `xml:"skipped,omitempty"`
+	SystemOut *junitSystemOut `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr,omitempty"`
+}
+
+type junitSystemOut struct {
+	Text string `xml:",chardata"`
+}
+
+// marshalJUnit writes a routine as a test suite, with a test case for each request and script step. each
+// subroutine gets a suite of its own, named after the routines that led to it
+func marshalJUnit(result *naproutine.RoutineResult, ctx *napcontext.Context) ([]byte, error) {
+	suites := &junitSuites{Name: routineName(result), Time: seconds(result.GetElapsedMs())}
+	addJUnitSuite(suites, routineName(result), result, ctx)
+
+	for _, v := range suites.Suites {
+		suites.Tests += v.Tests
+		suites.Failures += v.Failures
+		suites.Skipped += v.Skipped
+	}
+
+	data, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+func addJUnitSuite(suites *junitSuites, name string, result *naproutine.RoutineResult, ctx *napcontext.Context) {
+	suite := &junitSuite{Name: ctx.Mask(name), Time: seconds(result.GetElapsedMs())}
+	if !result.StartTime.IsZero() {
+		suite.Timestamp = result.StartTime.Format("2006-01-02T15:04:05")
+	}
+
+	suites.Suites = append(suites.Suites, suite)
+
+	// a routine's errors include its failed steps' errors, so they're only reported on their own when no
+	// step failed, e.g. when the routine couldn't be loaded
+	for i, errors := range [][]error{result.Errors, result.TeardownErrors} {
+		if len(errors) == 0 || !naproutine.IsPassing(result.AllStepResults()) {
+			continue
+		}
+
+		caseName := "routine"
+		if i == 1 {
+			caseName = "teardown"
+		}
+
+		suite.add(&junitCase{Name: caseName, ClassName: suite.Name, Time: seconds(0), Failure: newJUnitFailure(errors, ctx)})
+	}
+
+	for _, v := range result.AllStepResults() {
+		if v == nil {
+			continue
+		}
+
+		if v.SubroutineResult != nil {
+			addJUnitSuite(suites, name+" > "+routineName(v.SubroutineResult), v.SubroutineResult, ctx)
+			continue
+		}
+
+		testCase := &junitCase{
+			Name:      ctx.Mask(v.GetName()),
+			ClassName: suite.Name,
+			Time:      seconds(v.EndTime.Sub(v.StartTime).Milliseconds()),
+		}
+
+		if v.Skipped {
+			testCase.Skipped = &junitSkipped{Message: ctx.Mask(v.SkipReason)}
+		} else if v.NotRun {
+			testCase.Skipped = &junitSkipped{Message: ctx.Mask(v.NotRunReason)}
+		} else if errors := stepErrors(v); len(errors) > 0 {
+			testCase.Failure = newJUnitFailure(errors, ctx)
+		}
+
+		if v.ScriptResult != nil && len(v.ScriptResult.ScriptOutput) > 0 {
+			testCase.SystemOut = &junitSystemOut{Text: ctx.Mask(strings.Join(v.ScriptResult.ScriptOutput, "\n"))}
+		}
+
+		suite.add(testCase)
+	}
+}
+
+func (suite *junitSuite) add(testCase *junitCase) {
+	suite.Cases = append(suite.Cases, testCase)
+	suite.Tests++
+
+	if testCase.Failure != nil {
+		suite.Failures++
+	}
+
+	if testCase.Skipped != nil {
+		suite.Skipped++
+	}
+}
+
+func newJUnitFailure(errors []error, ctx *napcontext.Context) *junitFailure {
+	messages := maskErrors(errors, ctx)
+	return &junitFailure{Message: messages[0], Text: strings.Join(messages, "\n")}
+}
+
+func seconds(ms int64) string {
+	return fmt.Sprintf("%.3f", float64(ms)/1000)
+}
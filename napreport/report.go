@@ -0,0 +1,109 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+report.go - this file contains logic for writing run results to report files
+*/
+package napreport
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/davesheldon/nap/napcontext"
+	"github.com/davesheldon/nap/naproutine"
+)
+
+const (
+	TypeJson  = "json"
+	TypeJUnit = "junit"
+)
+
+var writers = map[string]func(result *naproutine.RoutineResult, ctx *napcontext.Context) ([]byte, error){
+	TypeJson:  marshalJson,
+	TypeJUnit: marshalJUnit,
+}
+
+// IsSupported reports whether there's a writer for a report type
+func IsSupported(reportType string) bool {
+	_, ok := writers[reportType]
+	return ok
+}
+
+// Write writes a run's result to path as a report of the given type. secrets are masked and the report's
+// folder is created if it doesn't exist
+func Write(reportType string, path string, result *naproutine.RoutineResult, ctx *napcontext.Context) error {
+	marshal, ok := writers[reportType]
+	if !ok {
+		return fmt.Errorf("unknown reporter type '%s'", reportType)
+	}
+
+	data, err := marshal(unwrap(result), ctx)
+	if err != nil {
+		return fmt.Errorf("cannot write %s report: %w", reportType, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("cannot write %s report: %w", reportType, err)
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("cannot write %s report: %w", reportType, err)
+	}
+
+	return nil
+}
+
+// unwrap returns the routine that was run. running a single routine wraps it in a system-generated one
+// with one step
+func unwrap(result *naproutine.RoutineResult) *naproutine.RoutineResult {
+	if len(result.StepResults) == 1 && result.StepResults[0].SubroutineResult != nil {
+		return result.StepResults[0].SubroutineResult
+	}
+
+	return result
+}
+
+// stepErrors returns every error a step failed with
+func stepErrors(stepResult *naproutine.RoutineStepResult) []error {
+	errors := append([]error{}, stepResult.Errors...)
+
+	if stepResult.RequestResult != nil && stepResult.RequestResult.Error != nil {
+		errors = append(errors, stepResult.RequestResult.Error)
+	}
+
+	if stepResult.ScriptResult != nil && stepResult.ScriptResult.Error != nil {
+		errors = append(errors, stepResult.ScriptResult.Error)
+	}
+
+	return errors
+}
+
+func routineName(result *naproutine.RoutineResult) string {
+	if result.Routine != nil && len(result.Routine.Name) > 0 {
+		return result.Routine.Name
+	}
+
+	return "nap"
+}
+
+func maskErrors(errors []error, ctx *napcontext.Context) []string {
+	masked := make([]string, 0, len(errors))
+	for _, v := range errors {
+		masked = append(masked, ctx.Mask(v.Error()))
+	}
+
+	return masked
+}
@@ -0,0 +1,141 @@
+package napreport_test
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davesheldon/nap/napcontext"
+	"github.com/davesheldon/nap/napreport"
+	"github.com/davesheldon/nap/naproutine"
+	"github.com/davesheldon/nap/napsecret"
+)
+
+func TestWrite(t *testing.T) {
+	start := time.Now()
+
+	inner := &naproutine.RoutineResult{
+		Routine:   &naproutine.Routine{Name: "Login"},
+		StartTime: start,
+		EndTime:   start.Add(20 * time.Millisecond),
+		StepResults: []*naproutine.RoutineStepResult{
+			{Step: &naproutine.RoutineStep{Run: "token.js"}, StepType: "script", ScriptResult: &naproutine.ScriptResult{ScriptOutput: []string{"token is s3cret"}}},
+			{Step: &naproutine.RoutineStep{Run: "check.js"}, StepType: "script", ScriptResult: &naproutine.ScriptResult{Error: errors.New("expected s3cret to be empty")}},
+			{Step: &naproutine.RoutineStep{Run: "cleanup.js"}, StepType: "script", Skipped: true, SkipReason: "if was false"},
+		},
+	}
+
+	outer := &naproutine.RoutineResult{
+		Routine:   &naproutine.Routine{Name: "Smoke"},
+		StartTime: start,
+		EndTime:   start.Add(30 * time.Millisecond),
+		StepResults: []*naproutine.RoutineStepResult{
+			{Step: &naproutine.RoutineStep{Run: "login.yml"}, StepType: "routine", SubroutineResult: inner},
+			{Step: &naproutine.RoutineStep{Run: "ping.js"}, StepType: "script", ScriptResult: &naproutine.ScriptResult{}},
+		},
+	}
+
+	// running a routine wraps it in a system-generated one
+	result := &naproutine.RoutineResult{
+		StepResults: []*naproutine.RoutineStepResult{
+			{Step: &naproutine.RoutineStep{Run: "smoke.yml"}, StepType: "routine", SubroutineResult: outer},
+		},
+	}
+
+	ctx := napcontext.New("", nil, nil, nil, true)
+	ctx.Secrets = napsecret.NewMasker()
+	ctx.Secrets.Add("s3cret")
+
+	dir := t.TempDir()
+
+	t.Run("json", func(t *testing.T) {
+		path := filepath.Join(dir, "reports", "result.json")
+		data := write(t, napreport.TypeJson, path, result, ctx)
+
+		report := struct {
+			Name    string
+			Passing bool
+			Steps   []struct {
+				Name    string
+				Routine *struct {
+					Steps []struct {
+						Name    string
+						Skipped bool
+						Errors  []string
+					}
+				}
+			}
+		}{}
+
+		if err := json.Unmarshal(data, &report); err != nil {
+			t.Fatal(err)
+		}
+
+		if report.Name != "Smoke" || report.Passing || len(report.Steps) != 2 {
+			t.Fatalf("Expected the failing Smoke routine with 2 steps, got %s", data)
+		}
+
+		steps := report.Steps[0].Routine.Steps
+		if len(steps) != 3 || !steps[2].Skipped || len(steps[1].Errors) != 1 {
+			t.Errorf("Expected the subroutine's steps, got %s", data)
+		}
+	})
+
+	t.Run("junit", func(t *testing.T) {
+		path := filepath.Join(dir, "junit.xml")
+		data := write(t, napreport.TypeJUnit, path, result, ctx)
+
+		report := struct {
+			Tests    int `xml:"tests,attr"`
+			Failures int `xml:"failures,attr"`
+			Skipped  int `xml:"skipped,attr"`
+			Suites   []struct {
+				Name  string `xml:"name,attr"`
+				Tests int    `xml:"tests,attr"`
+			} `xml:"testsuite"`
+		}{}
+
+		if err := xml.Unmarshal(data, &report); err != nil {
+			t.Fatal(err)
+		}
+
+		if report.Tests != 4 || report.Failures != 1 || report.Skipped != 1 {
+			t.Errorf("Expected 4 tests, 1 failure and 1 skipped, got %s", data)
+		}
+
+		if len(report.Suites) != 2 || report.Suites[0].Name != "Smoke" || report.Suites[1].Name != "Smoke > Login" {
+			t.Errorf("Expected a suite for each routine, got %s", data)
+		}
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		err := napreport.Write("html", filepath.Join(dir, "report.html"), result, ctx)
+		if err == nil || !strings.Contains(err.Error(), "unknown reporter type") {
+			t.Errorf("Expected an unknown reporter error, got %v", err)
+		}
+	})
+}
+
+func write(t *testing.T, reportType string, path string, result *naproutine.RoutineResult, ctx *napcontext.Context) []byte {
+	t.Helper()
+
+	if err := napreport.Write(reportType, path, result, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(data), "s3cret") {
+		t.Errorf("Expected secrets to be masked, got %s", data)
+	}
+
+	return data
+}
@@ -22,13 +22,16 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/davesheldon/nap/napassert"
 	"github.com/davesheldon/nap/napcontext"
+	"github.com/davesheldon/nap/naptemplate"
 	"gopkg.in/yaml.v2"
 )
 
 type Request struct {
+	Kind                  string
 	Name                  string
 	Path                  string
 	Verb                  string
@@ -37,6 +40,8 @@ type Request struct {
 	Cookies               map[string]string
 	Body                  interface{}
 	GraphQL               *GraphQLOptions `yaml:"graphql"`
+	SSE                   *SSEOptions     `yaml:"sse"`
+	Retry                 *RetryOptions   `yaml:"retry"`
 	PreRequestScript      string          `yaml:"preRequestScript"`
 	PostRequestScript     string          `yaml:"postRequestScript"`
 	PreRequestScriptFile  string          `yaml:"preRequestScriptFile"`
@@ -44,15 +49,73 @@ type Request struct {
 	Captures              map[string]string
 	Asserts               []string
 	Verbose               bool
+	Strict                bool
+	MaxBodyBytes          int64  `yaml:"maxBodyBytes"`
+	SaveBodyTo            string `yaml:"saveBodyTo"`
+
+	// websocket options
+	Subprotocols []string
+	Messages     []*WebSocketMessage
+
+	// grpc options
+	Target      string
+	Service     string
+	Message     interface{}
+	Metadata    map[string]string
+	ProtoFiles  []string `yaml:"protoFiles"`
+	ImportPaths []string `yaml:"importPaths"`
+	Plaintext   bool
 
 	// aliases
 	Url    string
 	Method string
+
+	// the project's timeout, for a request that doesn't set timeoutSeconds
+	defaultTimeout time.Duration
+
+	// the file the request was loaded from, and whether undefined variables are an error
+	path   string
+	strict bool
 }
 
 type GraphQLOptions struct {
-	Query     string      `json:"query"`
-	Variables interface{} `json:"variables"`
+	Query          string      `json:"query"`
+	Variables      interface{} `json:"variables"`
+	OperationName  string      `json:"operationName,omitempty" yaml:"operationName"`
+	PersistedQuery bool        `json:"-" yaml:"persistedQuery"`
+	Method         string      `json:"-"`
+}
+
+type SSEOptions struct {
+	Count          int    `yaml:"count"`
+	TimeoutSeconds int    `yaml:"timeoutSeconds"`
+	UntilEvent     string `yaml:"untilEvent"`
+	UntilData      string `yaml:"untilData"`
+}
+
+type RetryOptions struct {
+	Count          *int // retries after the first attempt; 3 when absent, and 0 turns retries off
+	Delay          string
+	MaxDelay       string `yaml:"maxDelay"`
+	Backoff        string
+	Multiplier     float64
+	Jitter         float64
+	OnStatus       []int `yaml:"onStatus"`
+	OnNetworkError bool  `yaml:"onNetworkError"`
+	Until          []string
+}
+
+type WebSocketMessage struct {
+	Text   string
+	Json   interface{}
+	Binary string
+	Expect *WebSocketExpect
+}
+
+type WebSocketExpect struct {
+	Count          int
+	Match          string
+	TimeoutSeconds int `yaml:"timeoutSeconds"`
 }
 
 func parse(data []byte) (*Request, error) {
@@ -73,38 +136,166 @@ func LoadFromPath(path string, ctx *napcontext.Context) (*Request, error) {
 		return nil, err
 	}
 
-	dataAsString := string(data)
-
-	for k, v := range ctx.EnvironmentVariables {
-		variable := fmt.Sprintf("${%s}", k)
-		dataAsString = strings.ReplaceAll(dataAsString, variable, v)
+	data, unresolved, err := naptemplate.RenderYaml(data, ctx.Variables.Lookup)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
 	}
-	data = []byte(dataAsString)
+
 	request, err := parse(data)
 
+	if request != nil && (ctx.Strict || request.Strict) {
+		if err := naptemplate.Undefined(path, strictReferences(unresolved)); err != nil {
+			return nil, err
+		}
+	}
+
+	if request != nil {
+		request.path = path
+		request.strict = ctx.Strict || request.Strict
+	}
+
 	// check aliases
 	if request != nil && len(request.Path) == 0 && len(request.Url) > 0 {
 		request.Path = request.Url
 	}
 
-	if request != nil && len(request.Verb) == 0 && len(request.Method) > 0 {
+	// a grpc request's method is the rpc to call, not an http verb
+	if request != nil && request.Kind != "grpc" && len(request.Verb) == 0 && len(request.Method) > 0 {
 		request.Verb = request.Method
 	}
 
+	if request != nil && err == nil {
+		if err := request.applyDefaults(ctx.RequestDefaults, ctx.Variables.Lookup); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
 	return request, err
 }
 
+// Timeout returns how long the request may take: its own timeoutSeconds, or else the project's default.
+// zero means there's no limit
+func (request *Request) Timeout() time.Duration {
+	if request.TimeoutSeconds > 0 {
+		return time.Duration(request.TimeoutSeconds) * time.Second
+	}
+
+	return request.defaultTimeout
+}
+
+// applyDefaults fills in the settings the request leaves out from the project's defaults. grpc requests
+// only take the timeout, as they have a target and metadata instead of a path and headers
+func (request *Request) applyDefaults(defaults *napcontext.RequestDefaults, lookup naptemplate.Lookup) error {
+	if defaults == nil {
+		return nil
+	}
+
+	request.defaultTimeout = defaults.Timeout
+
+	if request.Kind == "grpc" {
+		return nil
+	}
+
+	if len(defaults.BaseUrl) > 0 && len(request.Path) > 0 && !strings.Contains(request.Path, "://") {
+		baseUrl, err := naptemplate.Render(defaults.BaseUrl, lookup)
+		if err != nil {
+			return fmt.Errorf("baseUrl: %w", err)
+		}
+
+		// a websocket connects to the same host over the matching websocket scheme
+		if request.Kind == "websocket" && strings.HasPrefix(baseUrl, "http") {
+			baseUrl = "ws" + strings.TrimPrefix(baseUrl, "http")
+		}
+
+		request.Path = strings.TrimSuffix(baseUrl, "/") + "/" + strings.TrimPrefix(request.Path, "/")
+	}
+
+	if len(defaults.Headers) > 0 && request.Headers == nil {
+		request.Headers = make(map[string]string)
+	}
+
+	for k, v := range defaults.Headers {
+		if hasHeader(request.Headers, k) {
+			continue
+		}
+
+		value, err := naptemplate.Render(v, lookup)
+		if err != nil {
+			return fmt.Errorf("headers.%s: %w", k, err)
+		}
+
+		request.Headers[k] = value
+	}
+
+	return nil
+}
+
+// hasHeader reports whether a header is set, ignoring case as http does
+func hasHeader(headers map[string]string, name string) bool {
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// strictReferences leaves out references in scripts, which are javascript rather than variable references,
+// and in asserts, which can use the request's own captures and are checked when they're run
+func strictReferences(references []*naptemplate.Reference) []*naptemplate.Reference {
+	result := make([]*naptemplate.Reference, 0, len(references))
+
+	for _, v := range references {
+		if v.Field == "preRequestScript" || v.Field == "postRequestScript" {
+			continue
+		}
+
+		if strings.HasPrefix(v.Field, "asserts[") || strings.HasPrefix(v.Field, "retry.until[") {
+			continue
+		}
+
+		result = append(result, v)
+	}
+
+	return result
+}
+
 var expr = fmt.Sprintf("^(.+) (%s) \"?(.+)\"?$", strings.Join(napassert.GetPredicates(), "|"))
 var re = regexp.MustCompile(expr)
 
 func (request *Request) GetAsserts(ctx *napcontext.Context) ([]*napassert.Assert, error) {
+	return request.parseAsserts(request.Asserts, "asserts", ctx)
+}
+
+func (request *Request) GetRetryUntilAsserts(ctx *napcontext.Context) ([]*napassert.Assert, error) {
+	if request.Retry == nil {
+		return []*napassert.Assert{}, nil
+	}
+
+	return request.parseAsserts(request.Retry.Until, "retry.until", ctx)
+}
+
+// parseAsserts renders and parses asserts once the response is in, so they can use the request's captures.
+// in strict mode, a variable that still isn't set is an error
+func (request *Request) parseAsserts(assertStrings []string, field string, ctx *napcontext.Context) ([]*napassert.Assert, error) {
 	var asserts []*napassert.Assert = make([]*napassert.Assert, 0)
-	for _, v := range request.Asserts {
+	for i, v := range assertStrings {
+		v, unresolved, err := naptemplate.RenderReferences(v, ctx.Variables.Lookup)
+		if err != nil {
+			return nil, err
+		}
 
-		for k, val := range ctx.EnvironmentVariables {
-			variable := fmt.Sprintf("${%s}", k)
-			v = strings.ReplaceAll(v, variable, val)
+		if request.strict {
+			for _, reference := range unresolved {
+				reference.Field = fmt.Sprintf("%s[%d]", field, i)
+			}
+
+			if err := naptemplate.Undefined(request.path, unresolved); err != nil {
+				return nil, err
+			}
 		}
+
 		matches := re.FindStringSubmatch(v)
 		if len(matches) < 4 {
 			return nil, fmt.Errorf("Could not parse assert: %s", v)
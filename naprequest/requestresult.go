@@ -30,12 +30,61 @@ type RequestResult struct {
 	StartTime         time.Time
 	EndTime           time.Time
 	Error             error
+	Attempts          int
+
+	// the response body is read once by the runner so it can be
+	// truncated, hashed and saved to disk in a single pass
+	ResponseBody      []byte
+	ResponseSize      int64
+	ResponseTruncated bool
+	ResponseSha256    string
+	ResponseMd5       string
+
+	// events received when the request is run in sse mode
+	Events []*SSEEvent
+
+	// messages received over a websocket connection
+	Messages []*WebSocketReceived
+
+	// the outcome of a grpc call, which has no http response
+	GrpcResponse *GrpcResponse
+}
+
+type GrpcResponse struct {
+	Code     int
+	Status   string
+	Message  string
+	Headers  map[string][]string
+	Trailers map[string][]string
+}
+
+type WebSocketReceived struct {
+	Type string
+	Data []byte
+}
+
+type SSEEvent struct {
+	Id    string
+	Event string
+	Data  string
 }
 
 func (r *RequestResult) GetElapsedMs() int64 {
 	return r.EndTime.Sub(r.StartTime).Milliseconds()
 }
 
+func (r *RequestResult) GetStatus() string {
+	if r.GrpcResponse != nil {
+		return r.GrpcResponse.Status
+	}
+
+	if r.HttpResponse != nil {
+		return r.HttpResponse.Status
+	}
+
+	return ""
+}
+
 func ResultError(r *Request, err error) *RequestResult {
 	result := new(RequestResult)
 	result.Error = err
@@ -0,0 +1,133 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+graph.go - this file contains logic for step dependencies
+*/
+package naproutine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StringList is a list of strings that may also be written in yaml as a single string
+type StringList []string
+
+func (list *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*list = StringList{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := unmarshal(&multiple); err != nil {
+		return err
+	}
+
+	*list = multiple
+	return nil
+}
+
+// HasNeeds returns true if any of the steps depend on another, in which case they run as a dependency graph
+func HasNeeds(steps []*RoutineStep) bool {
+	for _, step := range steps {
+		if step != nil && len(step.Needs) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateNeeds checks that step ids are unique, that every step a step needs exists in the same list
+// and that there are no cycles
+func validateNeeds(steps []*RoutineStep) error {
+	ids := make(map[string]*RoutineStep)
+
+	for _, step := range steps {
+		if step == nil || len(step.Id) == 0 {
+			continue
+		}
+
+		if _, ok := ids[step.Id]; ok {
+			return fmt.Errorf("duplicate step id: %s", step.Id)
+		}
+
+		ids[step.Id] = step
+	}
+
+	for _, step := range steps {
+		if step == nil {
+			continue
+		}
+
+		for _, need := range step.Needs {
+			if _, ok := ids[need]; !ok {
+				return fmt.Errorf("step %s needs unknown step id: %s", step.Run, need)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make(map[string]int)
+	path := []string{}
+
+	var visit func(id string) error
+	visit = func(id string) error {
+		switch state[id] {
+		case visiting:
+			start := 0
+			for i, v := range path {
+				if v == id {
+					start = i
+				}
+			}
+
+			return fmt.Errorf("steps have a dependency cycle: %s -> %s", strings.Join(path[start:], " -> "), id)
+		case visited:
+			return nil
+		}
+
+		state[id] = visiting
+		path = append(path, id)
+
+		for _, need := range ids[id].Needs {
+			if err := visit(need); err != nil {
+				return err
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[id] = visited
+
+		return nil
+	}
+
+	for _, step := range steps {
+		if step != nil && len(step.Id) > 0 {
+			if err := visit(step.Id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
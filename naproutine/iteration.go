@@ -0,0 +1,292 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+iteration.go - this file contains logic for loading step iterations from environment and data files
+*/
+package naproutine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/davesheldon/nap/napcontext"
+	"github.com/davesheldon/nap/napenv"
+)
+
+// Iteration is one run of a step, with its variables loaded from an environment file or a data file row
+type Iteration struct {
+	Context *napcontext.Context
+	Index   int
+	Source  string
+	Row     int
+}
+
+// GetIterations loads the step's iterations. environment files give one iteration each, while csv, json
+// and jsonl data files give one per row. rows are filtered, shuffled and limited according to the step's
+// options. filter is called for each iteration when the step has a filter. a step without iterations
+// runs once with the given context
+func (step *RoutineStep) GetIterations(ctx *napcontext.Context, filter func(*napcontext.Context) (bool, error)) ([]*Iteration, error) {
+	iterations := make([]*Iteration, 0)
+
+	var environmentsToLoad []string = make([]string, 0)
+
+	switch step.Iterations.(type) {
+	case string:
+		if result, err := filepath.Glob(path.Join(ctx.WorkingDirectory, step.Iterations.(string))); err != nil {
+			return nil, err
+		} else {
+			environmentsToLoad = result
+		}
+	case []interface{}:
+		for _, v := range step.Iterations.([]interface{}) {
+			switch v.(type) {
+			case string:
+				if result, err := filepath.Glob(path.Join(ctx.WorkingDirectory, v.(string))); err != nil {
+					return nil, err
+				} else {
+					environmentsToLoad = append(environmentsToLoad, result...)
+				}
+			}
+		}
+	}
+
+	for _, v := range environmentsToLoad {
+		switch strings.ToLower(filepath.Ext(v)) {
+		case ".csv", ".json", ".jsonl":
+			rows, err := loadDataRows(v)
+			if err != nil {
+				return nil, err
+			}
+
+			for i, row := range rows {
+				iteration := ctx.Clone(ctx.WorkingDirectory)
+				iteration.Variables.SetAll(napcontext.StepScope, row.variables)
+				iteration.Variables.MarkStructured(napcontext.StepScope, row.structured)
+
+				iterations = append(iterations, &Iteration{Context: iteration, Source: v, Row: i + 1})
+			}
+		default:
+			iteration := ctx.Clone(ctx.WorkingDirectory)
+
+			loaded, err := napenv.LoadEnvironmentFromPath(ctx.WorkingDirectory, v, ctx.EnvironmentPath...)
+			if err != nil {
+				return nil, err
+			}
+
+			result, err := napenv.Resolve(loaded.Variables, ctx.Variables.Lookup)
+			if err != nil {
+				return nil, err
+			}
+
+			result, err = napenv.ResolveSecrets(result, ctx.Secrets)
+			if err != nil {
+				return nil, err
+			}
+
+			iteration.Variables.SetAll(napcontext.StepScope, result)
+			iteration.Variables.MarkStructured(napcontext.StepScope, loaded.Structured)
+
+			iterations = append(iterations, &Iteration{Context: iteration, Source: v})
+		}
+	}
+
+	if len(step.Filter) > 0 && filter != nil {
+		filtered := make([]*Iteration, 0, len(iterations))
+		for _, v := range iterations {
+			ok, err := filter(v.Context)
+			if err != nil {
+				return nil, err
+			}
+
+			if ok {
+				filtered = append(filtered, v)
+			}
+		}
+
+		iterations = filtered
+	}
+
+	if step.Shuffle {
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		random.Shuffle(len(iterations), func(i, j int) {
+			iterations[i], iterations[j] = iterations[j], iterations[i]
+		})
+	}
+
+	if step.Limit > 0 && len(iterations) > step.Limit {
+		iterations = iterations[:step.Limit]
+	}
+
+	for i, v := range iterations {
+		v.Index = i
+	}
+
+	if len(environmentsToLoad) == 0 {
+		iterations = append(iterations, &Iteration{Context: ctx})
+	}
+
+	return iterations, nil
+}
+
+// dataRow is the variables from one row of a data file, and which of them hold objects or lists stored
+// as json
+type dataRow struct {
+	variables  map[string]string
+	structured map[string]bool
+}
+
+// loadDataRows reads the variables for each row of a csv, json or jsonl data file
+func loadDataRows(fileName string) ([]*dataRow, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open '%s'. %w", fileName, err)
+	}
+
+	var rows []*dataRow
+
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".csv":
+		rows, err = parseCsvRows(data)
+	case ".json":
+		rows, err = parseJsonRows(data)
+	case ".jsonl":
+		rows, err = parseJsonlRows(data)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse '%s'. %w", fileName, err)
+	}
+
+	return rows, nil
+}
+
+func parseCsvRows(data []byte) ([]*dataRow, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return []*dataRow{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows := make([]*dataRow, 0)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		row := &dataRow{variables: make(map[string]string), structured: make(map[string]bool)}
+		for i, name := range header {
+			row.variables[strings.TrimSpace(name)] = record[i]
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func parseJsonRows(data []byte) ([]*dataRow, error) {
+	var objects []map[string]interface{}
+	if err := json.Unmarshal(data, &objects); err != nil {
+		return nil, fmt.Errorf("expected an array of objects: %w", err)
+	}
+
+	rows := make([]*dataRow, 0, len(objects))
+	for _, v := range objects {
+		row, err := toRowVariables(v)
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func parseJsonlRows(data []byte) ([]*dataRow, error) {
+	rows := make([]*dataRow, 0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var object map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &object); err != nil {
+			return nil, fmt.Errorf("line %d: expected an object: %w", line, err)
+		}
+
+		row, err := toRowVariables(object)
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, scanner.Err()
+}
+
+// toRowVariables turns a json object into variables. strings are used as they are, null becomes
+// an empty string and anything else is stored as json
+func toRowVariables(object map[string]interface{}) (*dataRow, error) {
+	row := &dataRow{variables: make(map[string]string), structured: make(map[string]bool)}
+
+	for k, v := range object {
+		switch value := v.(type) {
+		case nil:
+			row.variables[k] = ""
+		case string:
+			row.variables[k] = value
+		default:
+			data, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+
+			row.variables[k] = string(data)
+
+			switch value.(type) {
+			case map[string]interface{}, []interface{}:
+				row.structured[k] = true
+			}
+		}
+	}
+
+	return row, nil
+}
@@ -20,80 +20,61 @@ package naproutine
 import (
 	"fmt"
 	"os"
-	"path"
-	"path/filepath"
-	"strings"
+	"regexp"
 
 	"github.com/davesheldon/nap/napcontext"
-	"github.com/davesheldon/nap/napenv"
-	"github.com/davesheldon/nap/naputil"
+	"github.com/davesheldon/nap/naptemplate"
 	"gopkg.in/yaml.v2"
 )
 
 type Routine struct {
-	Name  string
-	Env   map[string]string
-	Steps []*RoutineStep
+	Name           string
+	Strict         bool
+	Env            map[string]string
+	OnError        string `yaml:"onError"`
+	Parallel       *bool
+	MaxConcurrency int `yaml:"maxConcurrency"`
+	Exports        StringList
+	Setup          []*RoutineStep
+	Steps          []*RoutineStep
+	Teardown       []*RoutineStep
 }
 
 type RoutineStep struct {
-	Run        string
-	Iterations interface{}
-	Env        map[string]string
+	Id             string
+	Needs          StringList
+	Run            string
+	Iterations     interface{}
+	Env            map[string]string
+	If             string
+	Unless         string
+	Repeat         int
+	While          string
+	MaxIterations  int         `yaml:"maxIterations"`
+	ForEach        interface{} `yaml:"forEach"`
+	As             string
+	Shuffle        bool
+	Limit          int
+	Filter         string
+	OnError        string `yaml:"onError"`
+	Parallel       *bool
+	MaxConcurrency int `yaml:"maxConcurrency"`
 }
 
-func (step *RoutineStep) SetupContext(ctx *napcontext.Context) {
-	for k, v := range step.Env {
-		ctx.EnvironmentVariables[k] = v
-	}
-}
-
-func (step *RoutineStep) GetIterations(ctx *napcontext.Context) ([]*napcontext.Context, error) {
-	iterations := make([]*napcontext.Context, 0)
-
-	var environmentsToLoad []string = make([]string, 0)
-
-	switch step.Iterations.(type) {
-	case string:
-		if result, err := filepath.Glob(path.Join(ctx.WorkingDirectory, step.Iterations.(string))); err != nil {
-			return nil, err
-		} else {
-			environmentsToLoad = result
-		}
-	case []interface{}:
-		for _, v := range step.Iterations.([]interface{}) {
-			switch v.(type) {
-			case string:
-				if result, err := filepath.Glob(path.Join(ctx.WorkingDirectory, v.(string))); err != nil {
-					return nil, err
-				} else {
-					environmentsToLoad = append(environmentsToLoad, result...)
-				}
-			}
-		}
-	}
-
-	if environmentsToLoad != nil {
-		for _, v := range environmentsToLoad {
-			iteration := ctx.Clone(ctx.WorkingDirectory)
-			baseEnv := naputil.CloneMap(ctx.EnvironmentVariables)
-
-			result, err := napenv.AddEnvironmentFromPath(ctx.WorkingDirectory, v, baseEnv)
-			if err != nil {
-				return nil, err
-			}
-
-			iteration.EnvironmentVariables = result
+const (
+	OnErrorStop          = "stop"
+	OnErrorContinue      = "continue"
+	OnErrorSkipRemaining = "skipRemaining"
+)
 
-			iterations = append(iterations, iteration)
-		}
-	}
+// SetupContext sets the step's env variables for the duration of the step. the returned func removes them
+// again, so they don't apply to later steps
+func (step *RoutineStep) SetupContext(ctx *napcontext.Context) func() {
+	ctx.Variables.SetAll(napcontext.StepScope, step.Env)
 
-	if len(iterations) == 0 {
-		iterations = append(iterations, ctx)
+	return func() {
+		ctx.Variables.ClearScope(napcontext.StepScope)
 	}
-
-	return iterations, nil
 }
 
 func NewStep(run string, iterations interface{}) *RoutineStep {
@@ -121,31 +102,105 @@ func LoadFromPath(path string, ctx *napcontext.Context) (*Routine, error) {
 		return nil, err
 	}
 
-	dataAsString := string(data)
+	rendered, unresolved, err := naptemplate.RenderYaml(data, ctx.Variables.Lookup)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
 
-	for k, v := range ctx.EnvironmentVariables {
-		variable := fmt.Sprintf("${%s}", k)
-		dataAsString = strings.ReplaceAll(dataAsString, variable, v)
+	routine, err := parse(rendered)
+	if err != nil {
+		return nil, err
 	}
 
-	data = []byte(dataAsString)
+	if ctx.Strict || routine.Strict {
+		if err := naptemplate.Undefined(path, strictReferences(unresolved)); err != nil {
+			return nil, err
+		}
+	}
 
-	routine, err := parse(data)
+	// conditions and loops are evaluated when their step runs, against the variables at that point,
+	// so they keep their variable references rather than being substituted at load time
+	unsubstituted, err := parse(data)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := routine.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	keepStepExpressions(routine.Setup, unsubstituted.Setup)
+	keepStepExpressions(routine.Steps, unsubstituted.Steps)
+	keepStepExpressions(routine.Teardown, unsubstituted.Teardown)
+
 	if routine.Name == "" {
 		routine.Name = path
 	}
 
-	if routine.Env != nil {
-		for k, v := range routine.Env {
-			ctx.EnvironmentVariables[k] = v
+	ctx.Variables.EnterRoutine(routine.Env)
+
+	return routine, nil
+}
+
+func (routine *Routine) validate() error {
+	if err := validateOnError(routine.OnError); err != nil {
+		return err
+	}
+
+	for _, steps := range [][]*RoutineStep{routine.Setup, routine.Steps, routine.Teardown} {
+		for _, step := range steps {
+			if step == nil {
+				continue
+			}
+
+			if err := validateOnError(step.OnError); err != nil {
+				return fmt.Errorf("step %s: %w", step.Run, err)
+			}
+		}
+
+		if err := validateNeeds(steps); err != nil {
+			return err
 		}
 	}
 
-	return routine, nil
+	return nil
+}
+
+func validateOnError(onError string) error {
+	switch onError {
+	case "", OnErrorStop, OnErrorContinue, OnErrorSkipRemaining:
+		return nil
+	}
+
+	return fmt.Errorf("invalid onError: %s (must be %s, %s or %s)", onError, OnErrorStop, OnErrorContinue, OnErrorSkipRemaining)
+}
+
+var stepExpressionFieldRegex = regexp.MustCompile(`^(setup|steps|teardown)\[\d+\]\.(if|unless|while|forEach|filter)\b`)
+
+// strictReferences leaves out references in step conditions and loops, which are evaluated when the step
+// runs and treat variables that aren't set as empty
+func strictReferences(references []*naptemplate.Reference) []*naptemplate.Reference {
+	result := make([]*naptemplate.Reference, 0, len(references))
+
+	for _, v := range references {
+		if !stepExpressionFieldRegex.MatchString(v.Field) {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+func keepStepExpressions(steps []*RoutineStep, unsubstituted []*RoutineStep) {
+	for i, step := range steps {
+		if i < len(unsubstituted) && unsubstituted[i] != nil && step != nil {
+			step.If = unsubstituted[i].If
+			step.Unless = unsubstituted[i].Unless
+			step.While = unsubstituted[i].While
+			step.ForEach = unsubstituted[i].ForEach
+			step.Filter = unsubstituted[i].Filter
+		}
+	}
 }
 
 func parse(data []byte) (*Routine, error) {
@@ -19,6 +19,7 @@ package naproutine
 
 import (
 	"fmt"
+	"path/filepath"
 	"time"
 
 	"github.com/davesheldon/nap/napcontext"
@@ -26,21 +27,40 @@ import (
 )
 
 type RoutineResult struct {
-	Routine     *Routine
-	StepResults []*RoutineStepResult
-	StartTime   time.Time
-	EndTime     time.Time
-	Errors      []error
+	Routine         *Routine
+	SetupResults    []*RoutineStepResult
+	StepResults     []*RoutineStepResult
+	TeardownResults []*RoutineStepResult
+	StartTime       time.Time
+	EndTime         time.Time
+	Errors          []error
+	TeardownErrors  []error
 }
 
 type ResultStats struct {
 	Passing int
 	Total   int
+	Skipped int
 }
 
 type RunStats struct {
 	StatsByType map[string]*ResultStats
 	Totals      ResultStats
+	NotRun      int
+}
+
+// GetStatsType returns the name a step type is counted under in run stats
+func GetStatsType(stepType string) string {
+	switch stepType {
+	case "routine":
+		return "Subroutines"
+	case "script":
+		return "Scripts"
+	case "request", "websocket", "grpc":
+		return "Requests"
+	}
+
+	return "Unknown"
 }
 
 func (r *RoutineResult) GetElapsedMs() int64 {
@@ -48,20 +68,28 @@ func (r *RoutineResult) GetElapsedMs() int64 {
 }
 
 func (result *RoutineResult) IsPassing() bool {
-	if len(result.Errors) > 0 {
+	if len(result.Errors) > 0 || len(result.TeardownErrors) > 0 {
 		return false
 	}
 
-	for _, stepResult := range result.StepResults {
-		if len(stepResult.Errors) > 0 {
-			return false
-		}
+	return IsPassing(result.AllStepResults())
+}
 
-		if stepResult.RequestResult != nil && stepResult.RequestResult.Error != nil {
-			return false
-		}
+// AllStepResults returns the results of the setup, main and teardown steps, in the order they ran
+func (result *RoutineResult) AllStepResults() []*RoutineStepResult {
+	all := make([]*RoutineStepResult, 0, len(result.SetupResults)+len(result.StepResults)+len(result.TeardownResults))
+	all = append(all, result.SetupResults...)
+	all = append(all, result.StepResults...)
+	all = append(all, result.TeardownResults...)
 
-		if stepResult.SubroutineResult != nil && !stepResult.SubroutineResult.IsPassing() {
+	return all
+}
+
+// IsPassing returns true if none of the step results failed. nil results belong to subroutines that are
+// still running and are ignored
+func IsPassing(stepResults []*RoutineStepResult) bool {
+	for _, stepResult := range stepResults {
+		if stepResult != nil && !stepResult.IsPassing() {
 			return false
 		}
 	}
@@ -69,6 +97,26 @@ func (result *RoutineResult) IsPassing() bool {
 	return true
 }
 
+func (stepResult *RoutineStepResult) IsPassing() bool {
+	if len(stepResult.Errors) > 0 {
+		return false
+	}
+
+	if stepResult.RequestResult != nil && stepResult.RequestResult.Error != nil {
+		return false
+	}
+
+	if stepResult.ScriptResult != nil && stepResult.ScriptResult.Error != nil {
+		return false
+	}
+
+	if stepResult.SubroutineResult != nil && !stepResult.SubroutineResult.IsPassing() {
+		return false
+	}
+
+	return true
+}
+
 func (result *RoutineResult) Print(prefix string, context *napcontext.Context) {
 	if prefix == "" && result.Routine != nil && result.Routine.Name != "" {
 		fmt.Println("------------------------------------------------------")
@@ -78,8 +126,22 @@ func (result *RoutineResult) Print(prefix string, context *napcontext.Context) {
 
 	fmt.Printf("%sElapsed: %dms, IsPassing: %t\n", prefix, result.GetElapsedMs(), result.IsPassing())
 
+	if len(result.SetupResults) > 0 {
+		fmt.Printf("%sSetup:\n", prefix)
+		for i, s := range result.SetupResults {
+			s.print(i, prefix+"  ", result.StartTime, context)
+		}
+	}
+
 	for i, s := range result.StepResults {
-		s.print(i, prefix, context)
+		s.print(i, prefix, result.StartTime, context)
+	}
+
+	if len(result.TeardownResults) > 0 {
+		fmt.Printf("%sTeardown:\n", prefix)
+		for i, s := range result.TeardownResults {
+			s.print(i, prefix+"  ", result.StartTime, context)
+		}
 	}
 }
 
@@ -87,19 +149,38 @@ func (result *RoutineResult) GetRunStats(parents ...*RoutineResult) *RunStats {
 	runStats := new(RunStats)
 	runStats.StatsByType = make(map[string]*ResultStats)
 
-	for _, v := range result.StepResults {
+	for _, v := range result.AllStepResults() {
+		if v.NotRun {
+			runStats.NotRun += 1
+			continue
+		}
+
+		if v.Skipped {
+			statsType := GetStatsType(v.StepType)
+			_, ok := runStats.StatsByType[statsType]
+			if !ok {
+				runStats.StatsByType[statsType] = new(ResultStats)
+			}
+
+			runStats.StatsByType[statsType].Skipped += 1
+			continue
+		}
+
 		if v.SubroutineResult != nil {
 			subRunStats := v.SubroutineResult.GetRunStats(append(parents, result)...)
+			runStats.NotRun += subRunStats.NotRun
 
 			for runType, subStats := range subRunStats.StatsByType {
 				stats, ok := runStats.StatsByType[runType]
 				if ok {
 					stats.Passing += subStats.Passing
 					stats.Total += subStats.Total
+					stats.Skipped += subStats.Skipped
 				} else {
 					runStats.StatsByType[runType] = new(ResultStats)
 					runStats.StatsByType[runType].Passing = subStats.Passing
 					runStats.StatsByType[runType].Total = subStats.Total
+					runStats.StatsByType[runType].Skipped = subStats.Skipped
 				}
 			}
 
@@ -110,8 +191,12 @@ func (result *RoutineResult) GetRunStats(parents ...*RoutineResult) *RunStats {
 					runStats.StatsByType["Subroutines"] = new(ResultStats)
 				}
 
-				// any failure means the routine failed
-				if subRunStats.Totals.Total > subRunStats.Totals.Passing {
+				// any failure means the routine failed, including errors that don't belong to one of its steps,
+				// such as an exported variable that was never set
+				failed := subRunStats.Totals.Total > subRunStats.Totals.Passing || len(v.Errors) > 0 ||
+					len(v.SubroutineResult.Errors) > 0 || len(v.SubroutineResult.TeardownErrors) > 0
+
+				if failed {
 					runStats.StatsByType["Subroutines"].Total += 1
 				} else {
 					runStats.StatsByType["Subroutines"].Passing += 1
@@ -167,11 +252,17 @@ func (result *RoutineResult) GetRunStats(parents ...*RoutineResult) *RunStats {
 	for _, v := range runStats.StatsByType {
 		runStats.Totals.Passing += v.Passing
 		runStats.Totals.Total += v.Total
+		runStats.Totals.Skipped += v.Skipped
 	}
 
 	return runStats
 }
 
+// GetName returns the name a step result is shown under, including the iteration it came from
+func (stepResult *RoutineStepResult) GetName() string {
+	return stepResult.getName() + stepResult.getIterationName()
+}
+
 func (stepResult *RoutineStepResult) getName() string {
 	if stepResult.RequestResult != nil {
 		return fmt.Sprintf("%s (%s)", stepResult.RequestResult.Request.Name, stepResult.Step.Run)
@@ -183,28 +274,45 @@ func (stepResult *RoutineStepResult) getName() string {
 	return stepResult.Step.Run
 }
 
-func (stepResult *RoutineStepResult) print(i int, prefix string, context *napcontext.Context) {
-	fmt.Printf("%sRun %d: %s\n", prefix, i+1, stepResult.getName())
+// print writes the step result to stdout. start is when the routine started, and the step's start and
+// end times are shown relative to it so steps that ran at the same time can be spotted
+func (stepResult *RoutineStepResult) print(i int, prefix string, start time.Time, context *napcontext.Context) {
+	fmt.Printf("%sRun %d: %s%s\n", prefix, i+1, stepResult.getName(), context.Mask(stepResult.getIterationName()))
+
+	if !stepResult.StartTime.IsZero() && !start.IsZero() {
+		fmt.Printf("%s  Started: +%dms, Ended: +%dms\n", prefix, stepResult.StartTime.Sub(start).Milliseconds(), stepResult.EndTime.Sub(start).Milliseconds())
+	}
+
+	if stepResult.Skipped {
+		fmt.Printf("%s  Skipped: %s\n", prefix, context.Mask(stepResult.SkipReason))
+	}
+
+	if stepResult.NotRun {
+		fmt.Printf("%s  Not run: %s\n", prefix, context.Mask(stepResult.NotRunReason))
+	}
 
 	for _, error := range stepResult.Errors {
-		fmt.Printf("  [ERROR] %s\n", error.Error())
+		fmt.Printf("  [ERROR] %s\n", context.Mask(error.Error()))
 	}
 
 	if stepResult.RequestResult != nil {
 		if stepResult.RequestResult.Error != nil {
-			fmt.Printf("%s  [ERROR] %s\n", prefix, stepResult.RequestResult.Error.Error())
+			fmt.Printf("%s  [ERROR] %s\n", prefix, context.Mask(stepResult.RequestResult.Error.Error()))
 		} else {
-			fmt.Printf("%s  Status: %s\n", prefix, stepResult.RequestResult.HttpResponse.Status)
+			fmt.Printf("%s  Status: %s\n", prefix, stepResult.RequestResult.GetStatus())
 			fmt.Printf("%s  Elapsed: %dms\n", prefix, stepResult.RequestResult.GetElapsedMs())
+			if stepResult.RequestResult.Attempts > 1 {
+				fmt.Printf("%s  Attempts: %d\n", prefix, stepResult.RequestResult.Attempts)
+			}
 		}
 	}
 
 	if stepResult.ScriptResult != nil {
 		if stepResult.ScriptResult.Error != nil {
-			fmt.Printf("%s  [ERROR] %s\n", prefix, stepResult.ScriptResult.Error.Error())
+			fmt.Printf("%s  [ERROR] %s\n", prefix, context.Mask(stepResult.ScriptResult.Error.Error()))
 		} else {
 			for _, v := range stepResult.ScriptResult.ScriptOutput {
-				fmt.Printf("%s  Output: %s\n", prefix, v)
+				fmt.Printf("%s  Output: %s\n", prefix, context.Mask(v))
 			}
 
 			fmt.Printf("%s  Elapsed: %dms\n", prefix, stepResult.ScriptResult.GetElapsedMs())
@@ -216,6 +324,29 @@ func (stepResult *RoutineStepResult) print(i int, prefix string, context *napcon
 	}
 }
 
+// SetIteration records which iteration of its step a result came from
+func (stepResult *RoutineStepResult) SetIteration(iteration *Iteration) *RoutineStepResult {
+	if iteration != nil && len(iteration.Source) > 0 {
+		stepResult.IterationSource = iteration.Source
+		stepResult.IterationIndex = iteration.Index
+		stepResult.IterationRow = iteration.Row
+	}
+
+	return stepResult
+}
+
+func (stepResult *RoutineStepResult) getIterationName() string {
+	if len(stepResult.IterationSource) == 0 {
+		return ""
+	}
+
+	if stepResult.IterationRow > 0 {
+		return fmt.Sprintf(" [iteration %d: %s row %d]", stepResult.IterationIndex+1, filepath.Base(stepResult.IterationSource), stepResult.IterationRow)
+	}
+
+	return fmt.Sprintf(" [iteration %d: %s]", stepResult.IterationIndex+1, filepath.Base(stepResult.IterationSource))
+}
+
 func StepError(step *RoutineStep, err error) *RoutineStepResult {
 	stepResult := new(RoutineStepResult)
 	stepResult.Step = step
@@ -224,6 +355,26 @@ func StepError(step *RoutineStep, err error) *RoutineStepResult {
 	return stepResult
 }
 
+func StepSkipped(step *RoutineStep, stepType string, reason string) *RoutineStepResult {
+	stepResult := new(RoutineStepResult)
+	stepResult.Step = step
+	stepResult.StepType = stepType
+	stepResult.Skipped = true
+	stepResult.SkipReason = reason
+
+	return stepResult
+}
+
+// StepNotRun marks a step that never ran because an earlier failure or a cancellation stopped its routine
+func StepNotRun(step *RoutineStep, reason string) *RoutineStepResult {
+	stepResult := new(RoutineStepResult)
+	stepResult.Step = step
+	stepResult.NotRun = true
+	stepResult.NotRunReason = reason
+
+	return stepResult
+}
+
 func StepRequestResult(step *RoutineStep, requestResult *naprequest.RequestResult) *RoutineStepResult {
 	stepResult := new(RoutineStepResult)
 	stepResult.Step = step
@@ -246,6 +397,8 @@ func StepSubroutineResult(step *RoutineStep, subroutineResult *RoutineResult) *R
 	stepResult.Step = step
 
 	stepResult.SubroutineResult = subroutineResult
+	stepResult.StartTime = subroutineResult.StartTime
+	stepResult.EndTime = subroutineResult.EndTime
 
 	return stepResult
 }
@@ -256,6 +409,16 @@ type RoutineStepResult struct {
 	SubroutineResult *RoutineResult
 	ScriptResult     *ScriptResult
 	Errors           []error
+	StepType         string
+	Skipped          bool
+	SkipReason       string
+	NotRun           bool
+	NotRunReason     string
+	IterationSource  string
+	IterationIndex   int
+	IterationRow     int
+	StartTime        time.Time
+	EndTime          time.Time
 }
 
 type ScriptResult struct {
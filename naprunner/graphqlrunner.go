@@ -0,0 +1,168 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+graphqlrunner.go - this file contains logic for building and sending GraphQL requests
+*/
+package naprunner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/davesheldon/nap/napcontext"
+	"github.com/davesheldon/nap/naprequest"
+)
+
+func executeGraphQL(r *naprequest.Request, ctx *napcontext.Context, workingDirectory string) (*http.Response, error) {
+	query := r.GraphQL.Query
+	if strings.HasPrefix(query, "@") {
+		data, err := os.ReadFile(filepath.Join(workingDirectory, query[1:]))
+		if err != nil {
+			return nil, err
+		}
+		query = string(data)
+	}
+
+	variables := r.GraphQL.Variables
+	if variablesFile, ok := variables.(string); ok && strings.HasPrefix(variablesFile, "@") {
+		data, err := os.ReadFile(filepath.Join(workingDirectory, variablesFile[1:]))
+		if err != nil {
+			return nil, err
+		}
+
+		variables = nil
+		if err := json.Unmarshal(data, &variables); err != nil {
+			return nil, fmt.Errorf("cannot parse GraphQL variables file %s: %w", variablesFile[1:], err)
+		}
+	}
+
+	payload := map[string]interface{}{"query": query}
+
+	if variables != nil {
+		payload["variables"] = variables
+	}
+
+	if len(r.GraphQL.OperationName) > 0 {
+		payload["operationName"] = r.GraphQL.OperationName
+	}
+
+	if r.GraphQL.PersistedQuery {
+		// automatic persisted queries: send the hash alone first, and only send the
+		// full query if the server doesn't recognize the hash yet
+		hash := sha256.Sum256([]byte(query))
+		payload["extensions"] = map[string]interface{}{
+			"persistedQuery": map[string]interface{}{
+				"version":    1,
+				"sha256Hash": hex.EncodeToString(hash[:]),
+			},
+		}
+		delete(payload, "query")
+
+		response, err := sendGraphQL(r, ctx, payload)
+		if err != nil {
+			return nil, err
+		}
+
+		notFound, err := isPersistedQueryNotFound(response)
+		if err != nil || !notFound {
+			return response, err
+		}
+
+		payload["query"] = query
+	}
+
+	return sendGraphQL(r, ctx, payload)
+}
+
+func sendGraphQL(r *naprequest.Request, ctx *napcontext.Context, payload map[string]interface{}) (*http.Response, error) {
+	if strings.EqualFold(r.GraphQL.Method, "GET") {
+		requestUrl, err := url.Parse(r.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		params := requestUrl.Query()
+		for k, v := range payload {
+			if s, ok := v.(string); ok {
+				params.Set(k, s)
+				continue
+			}
+
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			params.Set(k, string(encoded))
+		}
+		requestUrl.RawQuery = params.Encode()
+
+		r.Verb = "GET"
+		return sendHttp(r, ctx, r.Verb, requestUrl.String(), strings.NewReader(""))
+	}
+
+	graphqlPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Verb = "POST"
+	if r.Headers == nil {
+		r.Headers = make(map[string]string)
+	}
+	r.Headers["Content-Type"] = "application/json"
+
+	return sendHttp(r, ctx, r.Verb, r.Path, bytes.NewBuffer(graphqlPayload))
+}
+
+// isPersistedQueryNotFound checks a response for the error servers return when a persisted query hash is unknown.
+// the body is restored so the response can still be read normally
+func isPersistedQueryNotFound(response *http.Response) (bool, error) {
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return false, err
+	}
+
+	response.Body = io.NopCloser(bytes.NewReader(body))
+
+	graphqlResponse := struct {
+		Errors []struct {
+			Message    string
+			Extensions struct {
+				Code string
+			}
+		}
+	}{}
+
+	if err := json.Unmarshal(body, &graphqlResponse); err != nil {
+		return false, nil
+	}
+
+	for _, v := range graphqlResponse.Errors {
+		if v.Message == "PersistedQueryNotFound" || v.Extensions.Code == "PERSISTED_QUERY_NOT_FOUND" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,148 @@
+package naprunner_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestGraphQL(t *testing.T) {
+	var mu sync.Mutex
+	persisted := map[string]string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := struct {
+			Query         string                 `json:"query"`
+			OperationName string                 `json:"operationName"`
+			Variables     map[string]interface{} `json:"variables"`
+			Extensions    struct {
+				PersistedQuery struct {
+					Sha256Hash string `json:"sha256Hash"`
+				} `json:"persistedQuery"`
+			} `json:"extensions"`
+		}{}
+
+		if r.Method == "GET" {
+			params := r.URL.Query()
+			payload.Query = params.Get("query")
+			payload.OperationName = params.Get("operationName")
+			json.Unmarshal([]byte(params.Get("variables")), &payload.Variables)
+			json.Unmarshal([]byte(params.Get("extensions")), &payload.Extensions)
+		} else {
+			json.NewDecoder(r.Body).Decode(&payload)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		hash := payload.Extensions.PersistedQuery.Sha256Hash
+		if len(hash) > 0 {
+			mu.Lock()
+			if len(payload.Query) > 0 {
+				persisted[hash] = payload.Query
+			} else if query, ok := persisted[hash]; ok {
+				payload.Query = query
+			}
+			mu.Unlock()
+
+			if len(payload.Query) == 0 {
+				fmt.Fprint(w, `{ "errors": [ { "message": "PersistedQueryNotFound", "extensions": { "code": "PERSISTED_QUERY_NOT_FOUND" } } ] }`)
+				return
+			}
+		}
+
+		if len(payload.Query) == 0 {
+			fmt.Fprint(w, `{ "errors": [ { "message": "must provide query string" } ] }`)
+			return
+		}
+
+		data := map[string]interface{}{
+			"method":        r.Method,
+			"operationName": payload.OperationName,
+			"id":            payload.Variables["id"],
+			"hash":          hash,
+		}
+		response, _ := json.Marshal(map[string]interface{}{"data": data})
+		w.Write(response)
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		request    string
+		shouldPass bool
+	}{
+		"operation name and variables file": {
+			request: `kind: request
+path: ${baseUrl}
+graphql:
+  query: "query GetUser($id: ID!) { user(id: $id) { id } }"
+  operationName: GetUser
+  variables: "@vars.json"
+asserts:
+  - graphql errors count == 0
+  - graphql data method == POST
+  - graphql data operationName == GetUser
+  - graphql data $.id == 42
+`,
+			shouldPass: true,
+		},
+		"get request": {
+			request: `kind: request
+path: ${baseUrl}?tenant=acme
+graphql:
+  method: GET
+  query: "{ user { id } }"
+  variables:
+    id: 7
+asserts:
+  - graphql errors == []
+  - graphql data method == GET
+  - graphql data id == 7
+`,
+			shouldPass: true,
+		},
+		"automatic persisted query": {
+			request: `kind: request
+path: ${baseUrl}
+graphql:
+  query: "{ persisted { id } }"
+  persistedQuery: true
+asserts:
+  - graphql errors count == 0
+  - graphql data hash == 0aa5889d322b795717cc4feede36efdb2272ab2f3f3f35165043e0ee7c8d04e2
+`,
+			shouldPass: true,
+		},
+		"errors are assertable": {
+			request: `kind: request
+path: ${baseUrl}
+graphql:
+  query: ""
+asserts:
+  - status == 200
+  - graphql errors count == 1
+  - graphql errors contains must provide query
+`,
+			shouldPass: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "vars.json"), []byte(`{ "id": 42 }`), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			result := runTestFile(t, dir, test.request, map[string]string{"baseUrl": server.URL})
+
+			if result.IsPassing() != test.shouldPass {
+				t.Errorf("Expected passing=%t, got errors: %v", test.shouldPass, result.Errors)
+			}
+		})
+	}
+}
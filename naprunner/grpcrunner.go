@@ -0,0 +1,190 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+grpcrunner.go - this file contains logic for invoking a unary grpc method
+*/
+package naprunner
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/davesheldon/nap/napcontext"
+	"github.com/davesheldon/nap/naprequest"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/jhump/protoreflect/dynamic/grpcdynamic"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func executeGrpc(ctx context.Context, napCtx *napcontext.Context, r *naprequest.Request, result *naprequest.RequestResult, workingDirectory string) error {
+	if timeout := r.Timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var creds credentials.TransportCredentials
+	if r.Plaintext {
+		creds = insecure.NewCredentials()
+	} else {
+		config := &tls.Config{}
+		if napCtx.Transport != nil && napCtx.Transport.TLSClientConfig != nil {
+			config = napCtx.Transport.TLSClientConfig.Clone()
+		}
+
+		creds = credentials.NewTLS(config)
+	}
+
+	conn, err := grpc.DialContext(ctx, r.Target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	service, err := resolveGrpcService(ctx, r, conn, workingDirectory)
+	if err != nil {
+		return err
+	}
+
+	method := service.FindMethodByName(r.Method)
+	if method == nil {
+		return fmt.Errorf("method \"%s\" not found in service \"%s\"", r.Method, r.Service)
+	}
+
+	if method.IsClientStreaming() || method.IsServerStreaming() {
+		return fmt.Errorf("method \"%s\" is a streaming method; only unary methods are supported", r.Method)
+	}
+
+	requestJson, err := getGrpcRequestJson(r, workingDirectory)
+	if err != nil {
+		return err
+	}
+
+	request := dynamic.NewMessage(method.GetInputType())
+	if err := request.UnmarshalJSON(requestJson); err != nil {
+		return fmt.Errorf("cannot build request message: %w", err)
+	}
+
+	if r.Verbose {
+		fmt.Printf("REQUEST:\n%s/%s\n%s\n", r.Target, method.GetFullyQualifiedName(), napCtx.Mask(string(requestJson)))
+	}
+
+	ctx = metadata.NewOutgoingContext(ctx, metadata.New(r.Metadata))
+
+	var header, trailer metadata.MD
+	response, err := grpcdynamic.NewStub(conn).InvokeRpc(ctx, method, request, grpc.Header(&header), grpc.Trailer(&trailer))
+
+	// a non-OK status is a result to assert on rather than a failure, the same as a non-2xx http status
+	callStatus, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	result.GrpcResponse = &naprequest.GrpcResponse{
+		Code:     int(callStatus.Code()),
+		Status:   callStatus.Code().String(),
+		Message:  callStatus.Message(),
+		Headers:  header,
+		Trailers: trailer,
+	}
+
+	if response != nil {
+		dynamicResponse, err := dynamic.AsDynamicMessage(response)
+		if err != nil {
+			return err
+		}
+
+		body, err := dynamicResponse.MarshalJSONPB(&jsonpb.Marshaler{})
+		if err != nil {
+			return err
+		}
+
+		result.ResponseBody = body
+		result.ResponseSize = int64(len(body))
+	}
+
+	if r.Verbose {
+		fmt.Printf("RESPONSE:\n%s %s\n%s\n", result.GrpcResponse.Status, napCtx.Mask(result.GrpcResponse.Message), napCtx.Mask(string(result.ResponseBody)))
+	}
+
+	return nil
+}
+
+// resolveGrpcService finds the service descriptor in the local proto files if any were given,
+// otherwise it asks the server via reflection
+func resolveGrpcService(ctx context.Context, r *naprequest.Request, conn *grpc.ClientConn, workingDirectory string) (*desc.ServiceDescriptor, error) {
+	if len(r.ProtoFiles) == 0 {
+		client := grpcreflect.NewClientAuto(ctx, conn)
+		defer client.Reset()
+
+		service, err := client.ResolveService(r.Service)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve service \"%s\" via server reflection: %w", r.Service, err)
+		}
+
+		return service, nil
+	}
+
+	importPaths := []string{}
+	for _, v := range r.ImportPaths {
+		importPaths = append(importPaths, filepath.Join(workingDirectory, v))
+	}
+
+	if len(importPaths) == 0 {
+		importPaths = append(importPaths, workingDirectory)
+	}
+
+	parser := protoparse.Parser{ImportPaths: importPaths}
+	files, err := parser.ParseFiles(r.ProtoFiles...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse proto files: %w", err)
+	}
+
+	for _, file := range files {
+		if service, ok := file.FindSymbol(r.Service).(*desc.ServiceDescriptor); ok {
+			return service, nil
+		}
+	}
+
+	return nil, fmt.Errorf("service \"%s\" not found in proto files: %s", r.Service, strings.Join(r.ProtoFiles, ", "))
+}
+
+func getGrpcRequestJson(r *naprequest.Request, workingDirectory string) ([]byte, error) {
+	if r.Message == nil {
+		return []byte("{}"), nil
+	}
+
+	if messageAsString, ok := r.Message.(string); ok {
+		if strings.HasPrefix(messageAsString, "@") {
+			return os.ReadFile(filepath.Join(workingDirectory, messageAsString[1:]))
+		}
+
+		return []byte(messageAsString), nil
+	}
+
+	return json.Marshal(r.Message)
+}
@@ -0,0 +1,164 @@
+package naprunner_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/davesheldon/nap/napcontext"
+	"github.com/davesheldon/nap/naprequest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+)
+
+const healthProto = `syntax = "proto3";
+
+package grpc.health.v1;
+
+message HealthCheckRequest {
+  string service = 1;
+}
+
+message HealthCheckResponse {
+  enum ServingStatus {
+    UNKNOWN = 0;
+    SERVING = 1;
+    NOT_SERVING = 2;
+    SERVICE_UNKNOWN = 3;
+  }
+  ServingStatus status = 1;
+}
+
+service Health {
+  rpc Check(HealthCheckRequest) returns (HealthCheckResponse);
+}
+`
+
+func TestGrpc(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// echo the tenant metadata back as a trailer
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("x-tenant")) > 0 {
+			grpc.SetTrailer(ctx, metadata.Pairs("x-tenant-echo", md.Get("x-tenant")[0]))
+		}
+		return handler(ctx, req)
+	}
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(interceptor))
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("users", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	reflection.Register(server)
+
+	go server.Serve(listener)
+	defer server.Stop()
+
+	tests := map[string]struct {
+		request    string
+		shouldPass bool
+	}{
+		"server reflection": {
+			request: `kind: grpc
+target: ${target}
+plaintext: true
+service: grpc.health.v1.Health
+method: Check
+message:
+  service: users
+metadata:
+  x-tenant: acme
+captures:
+  healthStatus: jsonpath $.status
+asserts:
+  - status == 0
+  - grpc status == OK
+  - jsonpath $.status == SERVING
+  - trailer x-tenant-echo == acme
+`,
+			shouldPass: true,
+		},
+		"local proto files": {
+			request: `kind: grpc
+target: ${target}
+plaintext: true
+protoFiles:
+  - health.proto
+service: grpc.health.v1.Health
+method: Check
+message: '{ "service": "users" }'
+asserts:
+  - jsonpath $.status == SERVING
+`,
+			shouldPass: true,
+		},
+		"non-ok status can be asserted": {
+			request: `kind: grpc
+target: ${target}
+plaintext: true
+service: grpc.health.v1.Health
+method: Check
+message:
+  service: unknown
+asserts:
+  - status == 5
+  - grpc status == NotFound
+  - grpc message contains unknown service
+`,
+			shouldPass: true,
+		},
+		"unknown method": {
+			request: `kind: grpc
+target: ${target}
+plaintext: true
+service: grpc.health.v1.Health
+method: Nope
+`,
+			shouldPass: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "health.proto"), []byte(healthProto), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			result := runTestFile(t, dir, test.request, map[string]string{"target": listener.Addr().String()})
+
+			if result.IsPassing() != test.shouldPass {
+				t.Errorf("Expected passing=%t, got errors: %v", test.shouldPass, result.Errors)
+			}
+		})
+	}
+}
+
+func TestGrpcMethodIsNotAVerb(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.yml")
+	contents := "kind: grpc\ntarget: localhost:50051\nservice: grpc.health.v1.Health\nmethod: Check\n"
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := naprequest.LoadFromPath(path, napcontext.New("", nil, nil, nil, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if request.Method != "Check" {
+		t.Errorf("Expected method Check, got %q", request.Method)
+	}
+
+	if request.Verb != "" {
+		t.Errorf("Expected no verb, got %q", request.Verb)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+looprunner.go - this file contains logic for repeat, while and forEach step loops
+*/
+package naprunner
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/davesheldon/nap/napcontext"
+	"github.com/davesheldon/nap/naproutine"
+	"github.com/davesheldon/nap/naptemplate"
+)
+
+const defaultMaxIterations = 100
+const defaultForEachVariable = "item"
+
+// runStepLoop calls pass once for each time the step's repeat, while or forEach loop says it should run.
+// a step without a loop runs once. pass returns false to stop the loop early
+func runStepLoop(ctx *napcontext.Context, step *naproutine.RoutineStep, pass func() bool) error {
+	loops := 0
+	for _, isSet := range []bool{step.Repeat != 0, len(step.While) > 0, step.ForEach != nil} {
+		if isSet {
+			loops++
+		}
+	}
+
+	if loops > 1 {
+		return fmt.Errorf("step %s: only one of repeat, while and forEach may be used", step.Run)
+	}
+
+	if step.ForEach != nil {
+		items, err := getForEachItems(ctx, step.ForEach)
+		if err != nil {
+			return fmt.Errorf("step %s: %w", step.Run, err)
+		}
+
+		as := step.As
+		if len(as) == 0 {
+			as = defaultForEachVariable
+		}
+
+		for _, item := range items {
+			if item.structured {
+				ctx.Variables.SetStructuredIn(napcontext.StepScope, as, item.value)
+			} else {
+				ctx.Variables.SetIn(napcontext.StepScope, as, item.value)
+			}
+
+			if !pass() {
+				break
+			}
+		}
+
+		return nil
+	}
+
+	if len(step.While) > 0 {
+		maxIterations := step.MaxIterations
+		if maxIterations <= 0 {
+			maxIterations = defaultMaxIterations
+		}
+
+		for i := 0; ; i++ {
+			ok, err := evalCondition(ctx, step.While)
+			if err != nil || !ok {
+				return err
+			}
+
+			if i == maxIterations {
+				return fmt.Errorf("step %s: while condition \"%s\" was still true after %d iterations", step.Run, step.While, maxIterations)
+			}
+
+			if !pass() {
+				return nil
+			}
+		}
+	}
+
+	if step.Repeat < 0 {
+		return fmt.Errorf("step %s: invalid repeat: %d", step.Run, step.Repeat)
+	}
+
+	count := step.Repeat
+	if count == 0 {
+		count = 1
+	}
+
+	for i := 0; i < count; i++ {
+		if !pass() {
+			break
+		}
+	}
+
+	return nil
+}
+
+// forEachItem is one item of a forEach loop. objects and lists are structured, and stored as json
+type forEachItem struct {
+	value      string
+	structured bool
+}
+
+// getForEachItems reads the items to loop over, either from a yaml list or from a variable holding a
+// json array such as the one a multi-value capture produces. any other value is treated as one item
+func getForEachItems(ctx *napcontext.Context, forEach interface{}) ([]forEachItem, error) {
+	var list []interface{}
+
+	switch value := forEach.(type) {
+	case []interface{}:
+		list = value
+	case string:
+		resolved, err := naptemplate.Substitute(value, ctx.Variables.Lookup, func(before string, value string, ok bool) string {
+			if !ok {
+				return before
+			}
+
+			return before + value
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid forEach: %w", err)
+		}
+
+		resolved = strings.TrimSpace(resolved)
+
+		if len(resolved) == 0 {
+			return []forEachItem{}, nil
+		}
+
+		if err := json.Unmarshal([]byte(resolved), &list); err != nil {
+			return []forEachItem{{value: resolved}}, nil
+		}
+	default:
+		return nil, fmt.Errorf("invalid forEach: %v (must be a list or a variable holding a json array)", forEach)
+	}
+
+	items := make([]forEachItem, 0, len(list))
+	for _, v := range list {
+		switch item := v.(type) {
+		case string:
+			// the items of a yaml list are kept as they're written until the loop starts, so they see the
+			// variables as they are then
+			if _, ok := forEach.([]interface{}); ok {
+				rendered, err := naptemplate.Render(item, ctx.Variables.Lookup)
+				if err != nil {
+					return nil, fmt.Errorf("invalid forEach item: %w", err)
+				}
+
+				item = rendered
+			}
+
+			items = append(items, forEachItem{value: item})
+		case map[interface{}]interface{}:
+			return nil, fmt.Errorf("invalid forEach item: %v (yaml lists may only contain values)", item)
+		default:
+			data, err := json.Marshal(item)
+			if err != nil {
+				return nil, err
+			}
+
+			structured := false
+			switch item.(type) {
+			case []interface{}, map[string]interface{}:
+				structured = true
+			}
+
+			items = append(items, forEachItem{value: string(data), structured: structured})
+		}
+	}
+
+	return items, nil
+}
@@ -18,6 +18,7 @@ runner.go - this file contains logic for running requests, routines and scripts
 package naprunner
 
 import (
+	"errors"
 	"path"
 
 	"github.com/davesheldon/nap/napcontext"
@@ -26,8 +27,12 @@ import (
 
 func RunPath(ctx *napcontext.Context, runPath string) *naproutine.RoutineResult {
 	routine := naproutine.NewRoutine(ctx, "Job: "+path.Base(runPath), runPath)
-	result := runRoutine(ctx, routine, nil, nil)
+	result := runRoutine(ctx, routine, nil, nil, nil)
 	populateErrors(result)
 
+	if ctx.IsCancelled() && len(result.Errors) == 0 {
+		result.Errors = append(result.Errors, errors.New("run cancelled"))
+	}
+
 	return result
 }
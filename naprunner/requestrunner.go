@@ -19,6 +19,9 @@ package naprunner
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -63,26 +66,9 @@ func runRequest(ctx *napcontext.Context, runPath string, request *naprequest.Req
 		}
 	}
 
-	result.StartTime = time.Now()
-
-	response, err := executeHttp(request, ctx, filepath.Dir(runPath))
-
-	result.HttpResponse = response
-	if err != nil {
-		result.Error = fmt.Errorf("Request failed to execute: %w", err)
-		return result
-	}
-
-	result.EndTime = time.Now()
-
-	if err := napscript.SetupVm(ctx, RunPath); err != nil {
-		result.Error = fmt.Errorf("Error setting up js vm: %w", err)
-		return result
-	}
-
-	vmData, err := napscript.SetVmHttpData(ctx, result)
+	vmData, err := executeWithRetry(ctx, runPath, request, result)
 	if err != nil {
-		result.Error = fmt.Errorf("Error setting js http result: %w", err)
+		result.Error = err
 		return result
 	}
 
@@ -138,38 +124,86 @@ func runRequest(ctx *napcontext.Context, runPath string, request *naprequest.Req
 	return result
 }
 
-func executeHttp(r *naprequest.Request, ctx *napcontext.Context, workingDirectory string) (*http.Response, error) {
-	client := &http.Client{}
+// attemptRequest executes the request once, filling in the response parts of the result
+func attemptRequest(ctx *napcontext.Context, runPath string, request *naprequest.Request, result *naprequest.RequestResult) (*napscript.VmHttpData, error) {
+	if err := sendRequest(ctx, runPath, request, result); err != nil {
+		return nil, err
+	}
 
-	if r.TimeoutSeconds > 0 {
-		client.Timeout = time.Duration(r.TimeoutSeconds) * time.Second
+	if err := napscript.SetupVm(ctx, RunPath); err != nil {
+		return nil, fmt.Errorf("Error setting up js vm: %w", err)
 	}
 
-	var content io.Reader
+	vmData, err := napscript.SetVmHttpData(ctx, result)
+	if err != nil {
+		return nil, fmt.Errorf("Error setting js http result: %w", err)
+	}
 
-	if r.GraphQL != nil {
-		if strings.HasPrefix(r.GraphQL.Query, "@") {
-			gqlPayloadFile := r.GraphQL.Query[1:]
-			gqlFullPath := filepath.Join(workingDirectory, gqlPayloadFile)
-			gqlData, err := os.ReadFile(gqlFullPath)
-			if err != nil {
-				return nil, err
-			}
-			r.GraphQL.Query = string(gqlData)
-		}
+	return vmData, nil
+}
 
-		graphqlPayload, err := json.Marshal(&r.GraphQL)
-		if err != nil {
-			return nil, err
-		}
+// sendRequest sends the request and reads its response into result. it holds one of the run's request slots
+// only while it's on the network, so scripts and retry waits don't count towards --concurrency, and a script
+// that runs another request never waits on a slot its own request is holding
+func sendRequest(ctx *napcontext.Context, runPath string, request *naprequest.Request, result *naprequest.RequestResult) error {
+	ctx.AcquireRequestSlot()
+	defer ctx.ReleaseRequestSlot()
+
+	result.StartTime = time.Now()
+
+	var response *http.Response
+	var err error
 
-		content = bytes.NewBuffer(graphqlPayload)
-		r.Verb = "POST"
-		if r.Headers == nil {
-			r.Headers = make(map[string]string)
+	if request.Kind == "websocket" {
+		response, err = executeWebSocket(request, result, ctx, filepath.Dir(runPath))
+	} else if request.Kind == "grpc" {
+		err = executeGrpc(ctx.RunContext(), ctx, request, result, filepath.Dir(runPath))
+	} else {
+		response, err = executeHttp(request, ctx, filepath.Dir(runPath))
+	}
+
+	result.HttpResponse = response
+	if err != nil {
+		return &executionError{fmt.Errorf("Request failed to execute: %w", err)}
+	}
+
+	result.EndTime = time.Now()
+
+	if request.SSE != nil {
+		if err := readEventStream(request, result); err != nil {
+			return fmt.Errorf("Error reading event stream: %w", err)
 		}
-		r.Headers["Content-Type"] = "application/json"
-	} else if bodyAsString := fmt.Sprint(r.Body); r.Body != nil && len(bodyAsString) > 0 {
+	} else if request.Kind != "websocket" && request.Kind != "grpc" {
+		// websocket messages and grpc responses are already on the result
+		if err := readResponseBody(request, result, filepath.Dir(runPath)); err != nil {
+			return fmt.Errorf("Error reading response body: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// executionError marks a failure to execute the request at all, e.g. a network error
+type executionError struct {
+	err error
+}
+
+func (e *executionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *executionError) Unwrap() error {
+	return e.err
+}
+
+func executeHttp(r *naprequest.Request, ctx *napcontext.Context, workingDirectory string) (*http.Response, error) {
+	if r.GraphQL != nil {
+		return executeGraphQL(r, ctx, workingDirectory)
+	}
+
+	var content io.Reader
+
+	if bodyAsString := fmt.Sprint(r.Body); r.Body != nil && len(bodyAsString) > 0 {
 		if strings.HasPrefix(r.Headers["Content-Type"], "multipart/form-data") {
 			bodyAsMap, ok := r.Body.(map[interface{}]interface{})
 
@@ -212,7 +246,22 @@ func executeHttp(r *naprequest.Request, ctx *napcontext.Context, workingDirector
 		content = strings.NewReader("")
 	}
 
-	request, err := http.NewRequest(r.Verb, r.Path, content)
+	return sendHttp(r, ctx, r.Verb, r.Path, content)
+}
+
+func sendHttp(r *naprequest.Request, ctx *napcontext.Context, verb string, url string, content io.Reader) (*http.Response, error) {
+	client := &http.Client{}
+
+	// the project config's tls and proxy settings, if it has any
+	if ctx.Transport != nil {
+		client.Transport = ctx.Transport
+	}
+
+	if timeout := r.Timeout(); timeout > 0 {
+		client.Timeout = timeout
+	}
+
+	request, err := http.NewRequestWithContext(ctx.RunContext(), verb, url, content)
 
 	if err != nil {
 		return nil, err
@@ -222,6 +271,10 @@ func executeHttp(r *naprequest.Request, ctx *napcontext.Context, workingDirector
 		request.Header.Add(k, v)
 	}
 
+	if r.SSE != nil && len(request.Header.Get("Accept")) == 0 {
+		request.Header.Set("Accept", "text/event-stream")
+	}
+
 	if r.Cookies != nil && (len(r.Cookies)+len(ctx.Cookies) > 0) {
 		cookies := make([]*http.Cookie, 0)
 		for k, v := range r.Cookies {
@@ -243,7 +296,7 @@ func executeHttp(r *naprequest.Request, ctx *napcontext.Context, workingDirector
 		fmt.Println("REQUEST:")
 		dump, err := httputil.DumpRequestOut(request, true)
 		if err == nil {
-			fmt.Println(string(dump))
+			fmt.Println(ctx.Mask(string(dump)))
 		} else {
 			fmt.Println(err)
 		}
@@ -263,9 +316,10 @@ func executeHttp(r *naprequest.Request, ctx *napcontext.Context, workingDirector
 
 	if r.Verbose {
 		fmt.Println("RESPONSE:")
-		dump, err := httputil.DumpResponse(response, true)
+		// an event stream may never end, so its body is left out of the dump
+		dump, err := httputil.DumpResponse(response, r.SSE == nil)
 		if err == nil {
-			fmt.Println(string(dump))
+			fmt.Println(ctx.Mask(string(dump)))
 		} else {
 			fmt.Println(err)
 		}
@@ -274,6 +328,60 @@ func executeHttp(r *naprequest.Request, ctx *napcontext.Context, workingDirector
 	return response, nil
 }
 
+func readResponseBody(r *naprequest.Request, result *naprequest.RequestResult, workingDirectory string) error {
+	defer result.HttpResponse.Body.Close()
+
+	sha256Hash := sha256.New()
+	md5Hash := md5.New()
+	writers := []io.Writer{sha256Hash, md5Hash}
+
+	if len(r.SaveBodyTo) > 0 {
+		savePath := r.SaveBodyTo
+		if !filepath.IsAbs(savePath) {
+			savePath = filepath.Join(workingDirectory, savePath)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(savePath), os.ModePerm); err != nil {
+			return err
+		}
+
+		file, err := os.Create(savePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		writers = append(writers, file)
+	}
+
+	// everything read from the response passes through the hashes (and the file, if any),
+	// but only the first MaxBodyBytes are kept in memory for queries and scripts
+	reader := io.TeeReader(result.HttpResponse.Body, io.MultiWriter(writers...))
+
+	var captureReader io.Reader = reader
+	if r.MaxBodyBytes > 0 {
+		captureReader = io.LimitReader(reader, r.MaxBodyBytes)
+	}
+
+	body, err := io.ReadAll(captureReader)
+	if err != nil {
+		return err
+	}
+
+	remaining, err := io.Copy(io.Discard, reader)
+	if err != nil {
+		return err
+	}
+
+	result.ResponseBody = body
+	result.ResponseSize = int64(len(body)) + remaining
+	result.ResponseTruncated = remaining > 0
+	result.ResponseSha256 = hex.EncodeToString(sha256Hash.Sum(nil))
+	result.ResponseMd5 = hex.EncodeToString(md5Hash.Sum(nil))
+
+	return nil
+}
+
 func createFormData(form map[string]string, workingDirectory string) (string, io.Reader, error) {
 	body := new(bytes.Buffer)
 	mp := multipart.NewWriter(body)
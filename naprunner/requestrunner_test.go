@@ -0,0 +1,425 @@
+package naprunner_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davesheldon/nap/napcontext"
+	"github.com/davesheldon/nap/naproutine"
+	"github.com/davesheldon/nap/naprunner"
+	"github.com/davesheldon/nap/napsecret"
+)
+
+func TestResponseBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/text":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, "hello world")
+		case "/abc":
+			fmt.Fprint(w, "abc")
+		case "/malformed":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{ "broken": `)
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		request    string
+		shouldPass bool
+	}{
+		"truncated body keeps full size and digests": {
+			request: `kind: request
+path: ${baseUrl}/text
+maxBodyBytes: 5
+saveBodyTo: out/body.txt
+asserts:
+  - body == hello
+  - size == 11
+  - sha256 == b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9
+  - md5 == 5eb63bbbe01eeed093cb22bb8f5acdc3
+  - bytes base64 == aGVsbG8=
+`,
+			shouldPass: true,
+		},
+		"digests match known values": {
+			request: `kind: request
+path: ${baseUrl}/abc
+asserts:
+  - sha256 == ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad
+  - md5 == 900150983cd24fb0d6963f7d28e17f72
+`,
+			shouldPass: true,
+		},
+		"wrong digest fails": {
+			request: `kind: request
+path: ${baseUrl}/abc
+asserts:
+  - md5 == 00000000000000000000000000000000
+`,
+			shouldPass: false,
+		},
+		"malformed json is assertable": {
+			request: `kind: request
+path: ${baseUrl}/malformed
+asserts:
+  - status == 200
+  - jsonvalid == false
+  - jsonerror contains unexpected value type
+`,
+			shouldPass: true,
+		},
+		"malformed json fails a jsonvalid assert": {
+			request: `kind: request
+path: ${baseUrl}/malformed
+asserts:
+  - jsonvalid == true
+`,
+			shouldPass: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			result := runTestFile(t, dir, test.request, map[string]string{"baseUrl": server.URL})
+
+			if result.IsPassing() != test.shouldPass {
+				t.Errorf("Expected passing=%t, got errors: %v", test.shouldPass, result.Errors)
+			}
+		})
+	}
+
+	t.Run("body saved to disk", func(t *testing.T) {
+		dir := t.TempDir()
+		runTestFile(t, dir, "kind: request\npath: ${baseUrl}/text\nmaxBodyBytes: 1\nsaveBodyTo: out/body.txt\n", map[string]string{"baseUrl": server.URL})
+
+		saved, err := os.ReadFile(filepath.Join(dir, "out", "body.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(saved) != "hello world" {
+			t.Errorf("Expected saved body %q, got %q", "hello world", string(saved))
+		}
+	})
+}
+
+func runTestFile(t *testing.T, dir string, contents string, variables map[string]string) *naproutine.RoutineResult {
+	t.Helper()
+
+	path := filepath.Join(dir, "test.yml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := napcontext.New("", nil, variables, nil, true)
+
+	return naprunner.RunPath(ctx, path)
+}
+
+func TestTemplating(t *testing.T) {
+	var received *http.Request
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		request string
+		path    string
+		header  string
+		err     string
+	}{
+		"special characters stay in their field": {
+			request: "kind: request\npath: ${baseUrl}/items\nheaders:\n  X-Value: ${tricky}\n",
+			path:    "/items",
+			header:  "a: b # c",
+		},
+		"defaults and nested lookups": {
+			request: "kind: request\npath: ${baseUrl}/${section:-default}/${user.id}\nheaders:\n  X-Value: ${base64(name)}\n",
+			path:    "/default/42",
+			header:  "bmFw",
+		},
+		"required variable": {
+			request: "kind: request\npath: ${baseUrl}/${section:?section must be set}\n",
+			err:     "section: section must be set",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			received = nil
+
+			dir := t.TempDir()
+			result := runTestFile(t, dir, test.request, map[string]string{"baseUrl": server.URL, "tricky": "a: b # c", "name": "nap", "user": `{ "id": 42 }`})
+
+			if len(test.err) > 0 {
+				if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Error(), test.err) {
+					t.Errorf("Expected error %q, got %v", test.err, result.Errors)
+				}
+
+				if received != nil {
+					t.Errorf("Expected no request to be sent")
+				}
+				return
+			}
+
+			if !result.IsPassing() {
+				t.Fatalf("Expected passing, got errors: %v", result.Errors)
+			}
+
+			if received.URL.Path != test.path {
+				t.Errorf("Expected path %s, got %s", test.path, received.URL.Path)
+			}
+
+			if actual := received.Header.Get("X-Value"); actual != test.header {
+				t.Errorf("Expected header %q, got %q", test.header, actual)
+			}
+		})
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	sent := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = true
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{ "id": 7 }`))
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		file   string
+		strict bool
+		err    string
+		sends  bool
+	}{
+		"undefined variables are sent without strict mode": {
+			file: "kind: request\npath: ${baseUrl}/items\nheaders:\n  Authorization: ${tokne}\n",
+		},
+		"strict flag": {
+			file:   "kind: request\npath: ${baseUrl}/items\nheaders:\n  Authorization: Bearer ${tokne}\n",
+			strict: true,
+			err:    "test.yml:4:25: undefined variable tokne (in headers.Authorization)",
+		},
+		"strict file": {
+			file: "kind: request\nstrict: true\npath: ${baseUrl}/${section}\n",
+			err:  "test.yml:3:18: undefined variable section (in path)",
+		},
+		"asserts can use the request's captures": {
+			file:   "kind: request\npath: ${baseUrl}/items\ncaptures:\n  id: jsonpath $.id\nasserts:\n  - jsonpath $.id == ${id}\n",
+			strict: true,
+		},
+		"asserts are checked once the request is sent": {
+			file:   "kind: request\npath: ${baseUrl}/items\nasserts:\n  - status == ${expectedStatus}\n",
+			strict: true,
+			err:    "test.yml: undefined variable expectedStatus (in asserts[0])",
+			sends:  true,
+		},
+		"retry until is checked once the request is sent": {
+			file:   "kind: request\npath: ${baseUrl}/items\nretry:\n  until:\n    - status == ${expectedStatus}\n",
+			strict: true,
+			err:    "test.yml: undefined variable expectedStatus (in retry.until[0])",
+			sends:  true,
+		},
+		"every undefined variable is listed": {
+			file:   "kind: request\npath: ${baseUrl}/${a}/${b.c}\n",
+			strict: true,
+			err:    "test.yml:2:18: undefined variable a (in path); ",
+		},
+		"functions": {
+			file:   "kind: request\npath: ${baseUrl}/${base64(tokne)}\n",
+			strict: true,
+			err:    "test.yml:2:18: cannot evaluate ${base64(tokne)}",
+		},
+		"defaults and scripts are allowed": {
+			file:   "kind: request\npath: ${baseUrl}/${section:-items}\npreRequestScript: console.log(\"${x}\")\n",
+			strict: true,
+		},
+		"strict routine": {
+			file: "kind: routine\nstrict: true\nsteps:\n  - run: ${missing}.yml\n",
+			err:  "test.yml:4:10: undefined variable missing (in steps[0].run)",
+		},
+		"routine conditions are evaluated later": {
+			file:   "kind: routine\nsteps:\n  - run: item.yml\n    if: ${maybe}\n  - run: item.yml\n    forEach: ${items}\n",
+			strict: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			sent = false
+
+			dir := t.TempDir()
+			files := map[string]string{
+				"item.yml": "kind: request\npath: ${baseUrl}/item\n",
+				"test.yml": test.file,
+			}
+
+			for file, contents := range files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx := napcontext.New("", nil, map[string]string{"baseUrl": server.URL}, nil, true)
+			ctx.Strict = test.strict
+
+			result := naprunner.RunPath(ctx, filepath.Join(dir, "test.yml"))
+
+			if len(test.err) == 0 {
+				if !result.IsPassing() {
+					t.Errorf("Expected passing, got errors: %v", result.Errors)
+				}
+				return
+			}
+
+			if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Error(), test.err) {
+				t.Errorf("Expected error %q, got %v", test.err, result.Errors)
+			}
+
+			if sent != test.sends {
+				t.Errorf("Expected sent=%t, got %t", test.sends, sent)
+			}
+		})
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	napsecret.Register("test", napsecret.StaticProvider{"api/token": "s3cret"})
+	defer napsecret.Unregister("test")
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"secrets.yml": "token: ${secret:test:api/token}\n",
+		"request.yml": "kind: request\npath: ${baseUrl}/items\nheaders:\n  Authorization: Bearer ${token}\n",
+		"log.js":      "console.log('token is ' + nap.env.get('token'))",
+	}
+
+	for file, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	job := runTestFile(t, dir, "kind: routine\nsteps:\n  - run: request.yml\n    iterations: secrets.yml\n  - run: log.js\n    iterations: secrets.yml\n", map[string]string{"baseUrl": server.URL})
+
+	if !job.IsPassing() {
+		t.Fatalf("Expected the secret to be sent, got errors: %v", job.Errors)
+	}
+
+	output := job.StepResults[0].SubroutineResult.StepResults[1].ScriptResult.ScriptOutput
+	if len(output) != 1 || output[0] != "token is "+napsecret.Redacted {
+		t.Errorf("Expected the secret to be masked in script output, got %v", output)
+	}
+}
+
+func TestRequestDefaults(t *testing.T) {
+	defaults := &napcontext.RequestDefaults{
+		BaseUrl: "${baseUrl}",
+		Timeout: 50 * time.Millisecond,
+		Headers: map[string]string{"X-Client": "nap", "X-Tenant": "${tenant}"},
+	}
+
+	tests := map[string]struct {
+		request    string
+		path       string
+		headers    map[string]string
+		shouldPass bool
+	}{
+		"relative path is joined to the base url": {
+			request:    "kind: request\npath: /items\n",
+			path:       "/api/items",
+			headers:    map[string]string{"X-Client": "nap", "X-Tenant": "acme"},
+			shouldPass: true,
+		},
+		"full url is left as it is": {
+			request:    "kind: request\npath: ${server}/other\n",
+			path:       "/other",
+			shouldPass: true,
+		},
+		"request headers win over defaults": {
+			request:    "kind: request\npath: items\nheaders:\n  x-client: custom\n",
+			path:       "/api/items",
+			headers:    map[string]string{"X-Client": "custom", "X-Tenant": "acme"},
+			shouldPass: true,
+		},
+		"default timeout applies": {
+			request:    "kind: request\npath: slow\n",
+			shouldPass: false,
+		},
+		"request timeout wins over the default": {
+			request:    "kind: request\npath: slow\ntimeoutSeconds: 5\n",
+			path:       "/api/slow",
+			shouldPass: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			var path string
+			var headers http.Header
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				path, headers = r.URL.Path, r.Header.Clone()
+				mu.Unlock()
+
+				// slower than the default timeout, but well within the request's own
+				if r.URL.Path == "/api/slow" {
+					select {
+					case <-r.Context().Done():
+					case <-time.After(200 * time.Millisecond):
+					}
+				}
+			}))
+			defer server.Close()
+
+			file := filepath.Join(t.TempDir(), "request.yml")
+			if err := os.WriteFile(file, []byte(test.request), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := napcontext.New("", nil, map[string]string{"baseUrl": server.URL + "/api/", "server": server.URL, "tenant": "acme"}, nil, true)
+			ctx.RequestDefaults = defaults
+
+			result := naprunner.RunPath(ctx, file)
+
+			if result.IsPassing() != test.shouldPass {
+				t.Fatalf("Expected passing=%t, got errors: %v", test.shouldPass, result.Errors)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if len(test.path) > 0 && path != test.path {
+				t.Errorf("Expected path %s, got %s", test.path, path)
+			}
+
+			for k, v := range test.headers {
+				if actual := headers.Get(k); actual != v {
+					t.Errorf("Expected header %s=%s, got %s", k, v, actual)
+				}
+			}
+		})
+	}
+}
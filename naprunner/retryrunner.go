@@ -0,0 +1,196 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+retryrunner.go - this file contains logic for retrying and polling requests
+*/
+package naprunner
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/davesheldon/nap/napassert"
+	"github.com/davesheldon/nap/napcontext"
+	"github.com/davesheldon/nap/napquery"
+	"github.com/davesheldon/nap/naprequest"
+	"github.com/davesheldon/nap/napscript"
+)
+
+const defaultRetryCount = 3
+
+// executeWithRetry runs the request until it succeeds or its retry policy gives up.
+// the result is left holding the final attempt
+func executeWithRetry(ctx *napcontext.Context, runPath string, request *naprequest.Request, result *naprequest.RequestResult) (*napscript.VmHttpData, error) {
+	if request.Retry == nil {
+		result.Attempts = 1
+		return attemptRequest(ctx, runPath, request, result)
+	}
+
+	policy, err := newRetryPolicy(request.Retry)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		attempt := new(naprequest.RequestResult)
+		attempt.Request = request
+		attempt.Attempts = result.Attempts + 1
+
+		vmData, err := attemptRequest(ctx, runPath, request, attempt)
+		*result = *attempt
+
+		reason, err := getRetryReason(ctx, request, vmData, err)
+		if len(reason) == 0 {
+			return vmData, err
+		}
+
+		wait := policy.NextBackOff()
+		if wait == backoff.Stop {
+			if err != nil {
+				return nil, fmt.Errorf("%w (gave up after %d attempts)", err, result.Attempts)
+			}
+			return vmData, fmt.Errorf("Retry failed after %d attempts: %s", result.Attempts, reason)
+		}
+
+		if request.Verbose {
+			fmt.Printf("RETRY: attempt %d (%s), retrying in %s\n", result.Attempts, ctx.Mask(reason), wait)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.RunContext().Done():
+			return vmData, fmt.Errorf("run cancelled while waiting to retry after %d attempts", result.Attempts)
+		}
+	}
+}
+
+// getRetryReason describes why an attempt should be retried, or returns an empty reason if it shouldn't be
+func getRetryReason(ctx *napcontext.Context, request *naprequest.Request, vmData *napscript.VmHttpData, err error) (string, error) {
+	if err != nil {
+		var execErr *executionError
+		if request.Retry.OnNetworkError && errors.As(err, &execErr) {
+			return err.Error(), err
+		}
+
+		return "", err
+	}
+
+	if vmData != nil && vmData.Response != nil {
+		for _, v := range request.Retry.OnStatus {
+			if vmData.Response.StatusCode == v {
+				return fmt.Sprintf("status %d", v), nil
+			}
+		}
+	}
+
+	asserts, err := request.GetRetryUntilAsserts(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, v := range asserts {
+		actual, err := napquery.Eval(v.Query, vmData)
+		if err != nil {
+			return "", err
+		}
+
+		if err := napassert.Execute(v, actual); err != nil {
+			return fmt.Sprintf("until condition not met: %s", err), nil
+		}
+	}
+
+	return "", nil
+}
+
+// newRetryPolicy checks a request's retry options and builds the policy for them. it runs before the first
+// attempt, so a request with invalid options is never sent
+func newRetryPolicy(options *naprequest.RetryOptions) (backoff.BackOff, error) {
+	count := defaultRetryCount
+	if options.Count != nil {
+		count = *options.Count
+	}
+
+	if count < 0 {
+		return nil, fmt.Errorf("invalid retry count: %d (must not be negative)", count)
+	}
+
+	delay, err := parseRetryDuration(options.Delay, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry delay: %w", err)
+	}
+
+	maxDelay, err := parseRetryDuration(options.MaxDelay, time.Duration(math.MaxInt64))
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry maxDelay: %w", err)
+	}
+
+	if options.Multiplier < 0 {
+		return nil, fmt.Errorf("invalid retry multiplier: %v (must not be negative)", options.Multiplier)
+	}
+
+	if options.Jitter < 0 || options.Jitter > 1 {
+		return nil, fmt.Errorf("invalid retry jitter: %v (must be between 0 and 1)", options.Jitter)
+	}
+
+	policy := backoff.NewExponentialBackOff()
+	policy.InitialInterval = delay
+	policy.MaxInterval = maxDelay
+	policy.MaxElapsedTime = 0
+	policy.RandomizationFactor = options.Jitter
+
+	switch options.Backoff {
+	case "", "constant":
+		policy.Multiplier = 1
+	case "exponential":
+		policy.Multiplier = options.Multiplier
+		if policy.Multiplier == 0 {
+			policy.Multiplier = 2
+		}
+	default:
+		return nil, fmt.Errorf("invalid retry backoff: %s (must be constant or exponential)", options.Backoff)
+	}
+
+	retryPolicy := backoff.WithMaxRetries(policy, uint64(count))
+	retryPolicy.Reset()
+
+	return retryPolicy, nil
+}
+
+// parseRetryDuration reads a duration such as 500ms or 2s. a bare number is read as seconds. negative
+// durations are an error
+func parseRetryDuration(value string, defaultValue time.Duration) (time.Duration, error) {
+	if len(value) == 0 {
+		return defaultValue, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if seconds, parseErr := strconv.ParseFloat(value, 64); parseErr == nil {
+		duration, err = time.Duration(seconds*float64(time.Second)), nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if duration < 0 {
+		return 0, fmt.Errorf("%s must not be negative", value)
+	}
+
+	return duration, nil
+}
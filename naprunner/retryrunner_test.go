@@ -0,0 +1,184 @@
+package naprunner_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRetry(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		call := calls[r.URL.Path]
+		mu.Unlock()
+
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/flaky"):
+			if call < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, "ok")
+		case strings.HasPrefix(r.URL.Path, "/job"):
+			w.Header().Set("Content-Type", "application/json")
+			state := "pending"
+			if call >= 3 {
+				state = "done"
+			}
+			fmt.Fprintf(w, `{ "state": "%s", "call": %d }`, state, call)
+		}
+	}))
+	defer server.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedUrl := closed.URL
+	closed.Close()
+
+	tests := map[string]struct {
+		request       string
+		shouldPass    bool
+		errorContains string
+	}{
+		"retries on status": {
+			request: `kind: request
+path: ${baseUrl}/flaky/1
+retry:
+  count: 3
+  delay: 10ms
+  onStatus: [503]
+asserts:
+  - status == 200
+`,
+			shouldPass: true,
+		},
+		"gives up on status": {
+			request: `kind: request
+path: ${baseUrl}/flaky/2
+retry:
+  count: 1
+  delay: 10ms
+  onStatus: [503]
+`,
+			shouldPass:    false,
+			errorContains: "Retry failed after 2 attempts: status 503",
+		},
+		"polls until asserts pass": {
+			request: `kind: request
+path: ${baseUrl}/job/1
+retry:
+  count: 5
+  delay: 10ms
+  backoff: exponential
+  multiplier: 1.5
+  maxDelay: 20ms
+  jitter: 0.5
+  until:
+    - jsonpath $.state == done
+captures:
+  doneOnCall: jsonpath $.call
+asserts:
+  - jsonpath $.call == 3
+`,
+			shouldPass: true,
+		},
+		"gives up polling": {
+			request: `kind: request
+path: ${baseUrl}/job/2
+retry:
+  count: 1
+  delay: 10ms
+  until:
+    - jsonpath $.state == done
+`,
+			shouldPass:    false,
+			errorContains: "until condition not met",
+		},
+		"count 0 turns retries off": {
+			request: `kind: request
+path: ${baseUrl}/job/3
+retry:
+  count: 0
+  delay: 10ms
+  until:
+    - jsonpath $.state == done
+`,
+			shouldPass:    false,
+			errorContains: "Retry failed after 1 attempts: until condition not met",
+		},
+		"retries on network error": {
+			request: `kind: request
+path: ${closedUrl}
+retry:
+  count: 2
+  delay: 10ms
+  onNetworkError: true
+`,
+			shouldPass:    false,
+			errorContains: "gave up after 3 attempts",
+		},
+		"invalid backoff": {
+			request: `kind: request
+path: ${baseUrl}/flaky/3
+retry:
+  backoff: linear
+`,
+			shouldPass:    false,
+			errorContains: "invalid retry backoff",
+		},
+		"negative count": {
+			request: `kind: request
+path: ${baseUrl}/flaky/invalid
+retry:
+  count: -1
+`,
+			shouldPass:    false,
+			errorContains: "invalid retry count: -1",
+		},
+		"negative delay": {
+			request: `kind: request
+path: ${baseUrl}/flaky/invalid
+retry:
+  delay: -1s
+`,
+			shouldPass:    false,
+			errorContains: "invalid retry delay: -1s must not be negative",
+		},
+		"negative max delay": {
+			request: `kind: request
+path: ${baseUrl}/flaky/invalid
+retry:
+  maxDelay: "-5"
+`,
+			shouldPass:    false,
+			errorContains: "invalid retry maxDelay",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			result := runTestFile(t, t.TempDir(), test.request, map[string]string{"baseUrl": server.URL, "closedUrl": closedUrl})
+
+			if result.IsPassing() != test.shouldPass {
+				t.Errorf("Expected passing=%t, got errors: %v", test.shouldPass, result.Errors)
+			}
+
+			if len(test.errorContains) > 0 && (len(result.Errors) == 0 || !strings.Contains(result.Errors[0].Error(), test.errorContains)) {
+				t.Errorf("Expected error containing %q, got %v", test.errorContains, result.Errors)
+			}
+		})
+	}
+
+	// requests with invalid retry options are never sent
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["/flaky/invalid"] != 0 {
+		t.Errorf("Expected no calls for invalid retry options, got %d", calls["/flaky/invalid"])
+	}
+}
@@ -23,156 +23,704 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/davesheldon/nap/napcontext"
 	"github.com/davesheldon/nap/naprequest"
 	"github.com/davesheldon/nap/naproutine"
+	"github.com/davesheldon/nap/napscript"
+	"github.com/davesheldon/nap/naptemplate"
 	"github.com/davesheldon/nap/naputil"
 	"gopkg.in/yaml.v2"
 )
 
-func runRoutine(ctx *napcontext.Context, routine *naproutine.Routine, parentStep *naproutine.RoutineStep, ch chan *naproutine.RoutineStepResult) *naproutine.RoutineResult {
+func runRoutine(ctx *napcontext.Context, routine *naproutine.Routine, parentStep *naproutine.RoutineStep, iteration *naproutine.Iteration, ch chan *naproutine.RoutineStepResult) *naproutine.RoutineResult {
 	result := new(naproutine.RoutineResult)
 	result.Routine = routine
 	result.StartTime = time.Now()
 
-	waitCount := 0
+	run := new(routineRun)
+	run.ctx = ctx
+	run.routine = routine
 
-	childCh := make(chan *naproutine.RoutineStepResult)
+	if ch != nil {
+		run.progressSteps = int64(len(routine.Setup) + len(routine.Steps) + len(routine.Teardown))
+		run.progress = ctx.ProgressStart(routine.Name, run.progressSteps)
+	}
+
+	result.SetupResults = run.runSteps(ctx, routine.Setup, false)
+
+	if !naproutine.IsPassing(result.SetupResults) {
+		result.StepResults = notRun(routine.Steps, "setup failed")
+		run.cancelProgress()
+	} else if routine.Parallel != nil && *routine.Parallel && !naproutine.HasNeeds(routine.Steps) {
+		result.StepResults = run.runStepsInParallel(ctx, routine.Steps)
+	} else {
+		result.StepResults = run.runSteps(ctx, routine.Steps, false)
+	}
+
+	// teardown always runs, even after a failure or a cancelled run, so anything the routine created gets cleaned up
+	result.TeardownResults = run.runSteps(ctx.Detach(), routine.Teardown, true)
+
+	if run.progressCount < run.progressSteps {
+		run.cancelProgress()
+	}
 
-	var progress *napcontext.Progress
+	result.EndTime = time.Now()
 
 	if ch != nil {
-		progress = ctx.ProgressStart(routine.Name, int64(len(routine.Steps)))
+		ch <- naproutine.StepSubroutineResult(parentStep, result).SetIteration(iteration)
 	}
 
-	for _, step := range routine.Steps {
-		step.SetupContext(ctx)
-		var stepResult *naproutine.RoutineStepResult
-		stepResult = nil
+	return result
+}
 
-		stepPath := filepath.Join(ctx.WorkingDirectory, step.Run)
+// routineRun holds the state shared by each phase (setup, steps and teardown) of a routine run
+type routineRun struct {
+	ctx               *napcontext.Context
+	routine           *naproutine.Routine
+	progress          *napcontext.Progress
+	progressSteps     int64
+	progressCount     int64
+	progressCancelled bool
+	mu                sync.Mutex
+}
 
-		if exists, _ := naputil.FileExists(stepPath); !exists {
-			stepResult = naproutine.StepError(step, fmt.Errorf("file doesn't exist: %s", stepPath))
-			result.StepResults = append(result.StepResults, stepResult)
-			if ch != nil {
-				ctx.ProgressCancel(progress)
-			}
+// incrementProgress moves the routine's progress bar on by one. the bar counts steps, but it's moved on for
+// each pass of a loop, so it stops at its total rather than completing more than once
+func (run *routineRun) incrementProgress() {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	if run.progress == nil || run.progressCancelled || run.progressCount >= run.progressSteps {
+		return
+	}
+
+	run.progressCount++
+	run.ctx.ProgressIncrement(run.progress)
+}
+
+func (run *routineRun) cancelProgress() {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	if run.progress == nil || run.progressCancelled || run.progressCount >= run.progressSteps {
+		return
+	}
+
+	run.progressCancelled = true
+	run.ctx.ProgressCancel(run.progress)
+}
+
+// getErrorPolicy decides what happens after a step fails, using the step's onError, then the routine's.
+// without either, the routine carries on after failed requests and scripts but stops when a step can't be
+// run at all (e.g. its file is missing). teardown always carries on so that as much as possible is cleaned up
+func (run *routineRun) getErrorPolicy(step *naproutine.RoutineStep, runnable bool, teardown bool) string {
+	if teardown {
+		return naproutine.OnErrorContinue
+	}
+
+	if len(step.OnError) > 0 {
+		return step.OnError
+	}
+
+	if len(run.routine.OnError) > 0 {
+		return run.routine.OnError
+	}
+
+	if !runnable {
+		return naproutine.OnErrorSkipRemaining
+	}
+
+	return naproutine.OnErrorContinue
+}
+
+// handleFailure applies the error policy after a step fails and reports whether the remaining steps should be skipped
+func (run *routineRun) handleFailure(ctx *napcontext.Context, step *naproutine.RoutineStep, runnable bool, teardown bool) bool {
+	if ctx.FailFast {
+		ctx.Cancel()
+	}
+
+	policy := run.getErrorPolicy(step, runnable, teardown)
+
+	if policy == naproutine.OnErrorStop {
+		ctx.Cancel()
+	}
+
+	return policy == naproutine.OnErrorStop || policy == naproutine.OnErrorSkipRemaining
+}
+
+// waitForSubroutines decides whether a subroutine step has to finish before the next step starts.
+// by default subroutines run in parallel with the steps after them
+func (run *routineRun) waitForSubroutines(step *naproutine.RoutineStep) bool {
+	if step.Parallel != nil {
+		return !*step.Parallel
+	}
+
+	return run.routine.Parallel != nil && !*run.routine.Parallel
+}
+
+// runSteps runs a list of steps in order and returns their results in the same order. subroutines started
+// by the steps run in parallel and are waited on before returning. steps that don't run because of a failure
+// or a cancelled run are marked as not run
+func (run *routineRun) runSteps(ctx *napcontext.Context, steps []*naproutine.RoutineStep, teardown bool) []*naproutine.RoutineStepResult {
+	if naproutine.HasNeeds(steps) {
+		return run.runStepsAsGraph(ctx, steps, teardown)
+	}
+
+	results := make([]*naproutine.RoutineStepResult, 0, len(steps))
+	pending := []chan *naproutine.RoutineStepResult{}
+
+	for i, step := range steps {
+		if ctx.IsCancelled() {
+			results = append(results, notRun(steps[i:], "run cancelled")...)
+			run.cancelProgress()
 			break
 		}
 
-		stepType, err := peekType(stepPath, ctx)
+		stepResults, stepPending, runnable := run.runStep(ctx, step, teardown || run.waitForSubroutines(step))
+		results = append(results, stepResults...)
+		pending = append(pending, stepPending...)
 
-		if err != nil {
-			stepResult = naproutine.StepError(step, err)
-			result.StepResults = append(result.StepResults, stepResult)
-			if ch != nil {
-				ctx.ProgressCancel(progress)
-			}
+		if naproutine.IsPassing(stepResults) {
+			continue
+		}
+
+		if run.handleFailure(ctx, step, runnable, teardown) {
+			results = append(results, notRun(steps[i+1:], fmt.Sprintf("%s failed", step.Run))...)
+			run.cancelProgress()
 			break
 		}
+	}
 
-		iterations, err := step.GetIterations(ctx)
+	// fill in the places held for subroutines that ran in the background, in the order they were started
+	next := 0
+	for i, v := range results {
+		if v == nil {
+			results[i] = <-pending[next]
+			next++
+			run.incrementProgress()
+		}
+	}
 
-		if err != nil {
-			stepResult = naproutine.StepError(step, err)
-			result.StepResults = append(result.StepResults, stepResult)
-			if ch != nil {
-				ctx.ProgressCancel(progress)
+	return results
+}
+
+// runStepsInParallel starts every step at once, up to the routine's maxConcurrency. each step runs with
+// its own copy of the variables, so captures made by one step aren't visible to the others. once every step
+// has finished, the variables they set are copied back in the order the steps are declared, so teardown
+// sees them
+func (run *routineRun) runStepsInParallel(ctx *napcontext.Context, steps []*naproutine.RoutineStep) []*naproutine.RoutineStepResult {
+	// results are kept per step so they come out in declaration order whichever step finishes first
+	resultsByStep := make([][]*naproutine.RoutineStepResult, len(steps))
+	changesByStep := make([]*variableChanges, len(steps))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	limit := newLimiter(run.routine.MaxConcurrency)
+	stopReason := ""
+
+	for i, step := range steps {
+		limit.acquire()
+
+		mu.Lock()
+		if len(stopReason) == 0 && ctx.IsCancelled() {
+			stopReason = "run cancelled"
+		}
+
+		if len(stopReason) > 0 {
+			for j, step := range steps[i:] {
+				resultsByStep[i+j] = notRun([]*naproutine.RoutineStep{step}, stopReason)
 			}
+			mu.Unlock()
+			limit.release()
+			run.cancelProgress()
 			break
 		}
+		mu.Unlock()
 
-		for _, iterationCtx := range iterations {
+		stepCtx := ctx.Clone(ctx.WorkingDirectory)
+		changes := watchVariables(stepCtx)
 
-			if stepType == "request" {
-				request, err := naprequest.LoadFromPath(stepPath, iterationCtx)
+		wg.Add(1)
+		go func(i int, step *naproutine.RoutineStep) {
+			defer wg.Done()
+			defer limit.release()
 
-				if err != nil {
-					stepResult = naproutine.StepError(step, err)
-					result.StepResults = append(result.StepResults, stepResult)
-					break
-				} else {
-					stepResult = naproutine.StepRequestResult(step, runRequest(iterationCtx, stepPath, request))
-				}
+			// subroutines are waited on so that they count towards maxConcurrency until they finish
+			stepResults, _, runnable := run.runStep(stepCtx, step, true)
+			changes.collect(stepCtx)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			resultsByStep[i] = stepResults
+			changesByStep[i] = changes
+
+			if !naproutine.IsPassing(stepResults) && run.handleFailure(ctx, step, runnable, false) && len(stopReason) == 0 {
+				stopReason = fmt.Sprintf("%s failed", step.Run)
 			}
+		}(i, step)
+	}
+
+	wg.Wait()
 
-			if stepType == "script" {
-				stepResult = naproutine.StepScriptResult(step, runScript(iterationCtx, stepPath))
+	for _, changes := range changesByStep {
+		if changes != nil {
+			changes.apply(ctx)
+		}
+	}
+
+	results := make([]*naproutine.RoutineStepResult, 0, len(steps))
+	for _, stepResults := range resultsByStep {
+		results = append(results, stepResults...)
+	}
+
+	return results
+}
+
+// variableChanges records the variables a step sets in its own copy of the context, so they can be copied
+// back into the routine's
+type variableChanges struct {
+	before           map[string]string
+	beforeStructured map[string]bool
+
+	values map[string]string
+
+	// the changed variables that hold structured values
+	structured map[string]bool
+}
+
+// watchVariables starts recording the variables set in a step's copy of the context
+func watchVariables(stepCtx *napcontext.Context) *variableChanges {
+	return &variableChanges{before: stepCtx.Variables.All(), beforeStructured: stepCtx.Variables.AllStructured()}
+}
+
+// collect records the variables that were set or changed since watchVariables, once the step is done
+func (changes *variableChanges) collect(stepCtx *napcontext.Context) {
+	changes.values = make(map[string]string)
+	changes.structured = stepCtx.Variables.AllStructured()
+
+	for k, v := range stepCtx.Variables.All() {
+		if previous, ok := changes.before[k]; !ok || previous != v || changes.beforeStructured[k] != changes.structured[k] {
+			changes.values[k] = v
+		}
+	}
+}
+
+// apply sets the changed variables in ctx, as if they were captured there
+func (changes *variableChanges) apply(ctx *napcontext.Context) {
+	for k, v := range changes.values {
+		if changes.structured[k] {
+			ctx.Variables.SetStructured(k, v)
+		} else {
+			ctx.Variables.Set(k, v)
+		}
+	}
+}
+
+// runStepsAsGraph runs steps as soon as the steps they need have finished, so independent steps run at the
+// same time, up to the routine's maxConcurrency. each step starts with a copy of the variables as they are
+// when it starts, and the variables it sets are copied back when it finishes, so steps see the captures of
+// the steps they need. steps that need a failed step aren't run
+func (run *routineRun) runStepsAsGraph(ctx *napcontext.Context, steps []*naproutine.RoutineStep, teardown bool) []*naproutine.RoutineStepResult {
+	const (
+		pending = iota
+		running
+		passed
+		failed
+		notStarted
+	)
+
+	type completion struct {
+		index    int
+		results  []*naproutine.RoutineStepResult
+		runnable bool
+		changes  *variableChanges
+	}
+
+	states := make([]int, len(steps))
+	stepResults := make([][]*naproutine.RoutineStepResult, len(steps))
+	stateById := func(id string) int {
+		for i, step := range steps {
+			if step.Id == id {
+				return states[i]
 			}
+		}
 
-			if stepType == "routine" {
-				subroutineCtx := iterationCtx.Clone(filepath.Dir(stepPath))
-				subroutine, err := naproutine.LoadFromPath(stepPath, subroutineCtx)
+		return pending
+	}
 
-				if err != nil {
-					stepResult = naproutine.StepError(step, err)
-				} else {
-					waitCount = waitCount + 1
+	done := make(chan completion)
+	limit := newLimiter(run.routine.MaxConcurrency)
+	active := 0
+	stopReason := ""
 
-					go runRoutine(subroutineCtx, subroutine, step, childCh)
-					// we'll get the results after the loop finishes
+	for {
+		if len(stopReason) == 0 && ctx.IsCancelled() {
+			stopReason = "run cancelled"
+		}
+
+		// mark steps that can no longer run, repeating until nothing changes since they may be needed in turn
+		for changed := true; changed; {
+			changed = false
+
+			for i, step := range steps {
+				if states[i] != pending {
 					continue
 				}
+
+				reason := stopReason
+				for _, need := range step.Needs {
+					if state := stateById(need); len(reason) == 0 && (state == failed || state == notStarted) {
+						reason = fmt.Sprintf("needs %s, which didn't pass", need)
+					}
+				}
+
+				if len(reason) > 0 {
+					states[i] = notStarted
+					stepResults[i] = []*naproutine.RoutineStepResult{naproutine.StepNotRun(step, reason)}
+					changed = true
+				}
+			}
+		}
+
+		for i, step := range steps {
+			if states[i] != pending {
+				continue
 			}
 
-			if stepResult == nil {
-				stepResult = naproutine.StepError(step, fmt.Errorf("could not run path: %s", stepPath))
-				if ch != nil {
-					ctx.ProgressCancel(progress)
+			ready := true
+			for _, need := range step.Needs {
+				if stateById(need) != passed {
+					ready = false
 				}
-				break
 			}
 
-			result.StepResults = append(result.StepResults, stepResult)
-			if ch != nil {
-				ctx.ProgressIncrement(progress)
+			if !ready {
+				continue
 			}
+
+			states[i] = running
+			active++
+
+			stepCtx := ctx.Clone(ctx.WorkingDirectory)
+			changes := watchVariables(stepCtx)
+
+			go func(index int, step *naproutine.RoutineStep) {
+				limit.acquire()
+				defer limit.release()
+
+				// subroutines are waited on so that the steps that need them see them finish
+				results, _, runnable := run.runStep(stepCtx, step, true)
+				changes.collect(stepCtx)
+
+				done <- completion{index: index, results: results, runnable: runnable, changes: changes}
+			}(i, step)
+		}
+
+		if active == 0 {
+			break
+		}
+
+		finished := <-done
+		active--
+		stepResults[finished.index] = finished.results
+
+		finished.changes.apply(ctx)
+
+		if naproutine.IsPassing(finished.results) {
+			states[finished.index] = passed
+			continue
+		}
+
+		states[finished.index] = failed
+
+		if run.handleFailure(ctx, steps[finished.index], finished.runnable, teardown) && len(stopReason) == 0 {
+			stopReason = fmt.Sprintf("%s failed", steps[finished.index].Run)
 		}
 	}
 
-	for i := 0; i < waitCount; i++ {
-		deferredResult := <-childCh
-		result.StepResults = append(result.StepResults, deferredResult)
-		if ch != nil {
-			ctx.ProgressIncrement(progress)
+	results := make([]*naproutine.RoutineStepResult, 0, len(steps))
+	for _, v := range stepResults {
+		results = append(results, v...)
+	}
+
+	return results
+}
+
+// runStep runs one step, once per iteration and loop pass, and returns its results in the order the passes
+// started. it also reports whether the step could be run at all. unless wait is set, subroutines run in the
+// background: each one has a nil placeholder in the results, and its result arrives on the matching channel
+// in pending
+func (run *routineRun) runStep(ctx *napcontext.Context, step *naproutine.RoutineStep, wait bool) ([]*naproutine.RoutineStepResult, []chan *naproutine.RoutineStepResult, bool) {
+	results := []*naproutine.RoutineStepResult{}
+	pending := []chan *naproutine.RoutineStepResult{}
+	start := time.Now()
+
+	fail := func(err error) ([]*naproutine.RoutineStepResult, []chan *naproutine.RoutineStepResult, bool) {
+		return append(results, stamp(naproutine.StepError(step, err), start)), pending, false
+	}
+
+	defer step.SetupContext(ctx)()
+
+	stepPath := filepath.Join(ctx.WorkingDirectory, step.Run)
+
+	if exists, _ := naputil.FileExists(stepPath); !exists {
+		return fail(fmt.Errorf("file doesn't exist: %s", stepPath))
+	}
+
+	stepType, err := peekType(stepPath, ctx)
+
+	if err != nil {
+		return fail(err)
+	}
+
+	if skip, reason, err := shouldSkipStep(ctx, step); err != nil {
+		return fail(err)
+	} else if skip {
+		run.incrementProgress()
+		return append(results, stamp(naproutine.StepSkipped(step, stepType, reason), start)), pending, true
+	}
+
+	iterations, err := step.GetIterations(ctx, func(iterationCtx *napcontext.Context) (bool, error) {
+		return evalCondition(iterationCtx, step.Filter)
+	})
+
+	if err != nil {
+		return fail(err)
+	}
+
+	// a while loop's condition depends on the pass before it, so its passes always run one at a time
+	parallel := step.Parallel != nil && *step.Parallel && len(step.While) == 0
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	limit := newLimiter(step.MaxConcurrency)
+	runnable := true
+
+	for _, iteration := range iterations {
+		iteration := iteration
+		iterationCtx := iteration.Context
+
+		err := runStepLoop(iterationCtx, step, func() bool {
+			if ctx.IsCancelled() {
+				return false
+			}
+
+			if !parallel {
+				stepResult, resultCh, ok := run.runPass(iterationCtx, step, stepType, stepPath, iteration, wait)
+				results = append(results, stepResult)
+				if resultCh != nil {
+					pending = append(pending, resultCh)
+				}
+
+				runnable = ok
+				return ok
+			}
+
+			// each pass gets its own copy of the variables, taken now so it keeps this pass's forEach item
+			passCtx := iterationCtx.Clone(iterationCtx.WorkingDirectory)
+
+			// hold the pass's place so results stay in the order the passes started
+			mu.Lock()
+			index := len(results)
+			results = append(results, nil)
+			mu.Unlock()
+
+			limit.acquire()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer limit.release()
+
+				stepResult, _, ok := run.runPass(passCtx, step, stepType, stepPath, iteration, true)
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				results[index] = stepResult
+				runnable = runnable && ok
+			}()
+
+			return true
+		})
+
+		if err != nil {
+			wg.Wait()
+			results = append(results, stamp(naproutine.StepError(step, err), start))
+			return results, pending, false
+		}
+
+		mu.Lock()
+		stop := !runnable
+		mu.Unlock()
+
+		if stop {
+			break
 		}
 	}
 
-	if ch != nil {
-		ch <- naproutine.StepSubroutineResult(parentStep, result)
+	wg.Wait()
+
+	return results, pending, runnable
+}
+
+// runPass runs a step once and returns its result. a subroutine run without wait runs in the background, in
+// which case the result is nil and it arrives on the returned channel instead. it also reports whether the
+// step could be run at all
+func (run *routineRun) runPass(ctx *napcontext.Context, step *naproutine.RoutineStep, stepType string, stepPath string, iteration *naproutine.Iteration, wait bool) (*naproutine.RoutineStepResult, chan *naproutine.RoutineStepResult, bool) {
+	var stepResult *naproutine.RoutineStepResult
+	start := time.Now()
+
+	if stepType == "request" || stepType == "websocket" || stepType == "grpc" {
+		request, err := naprequest.LoadFromPath(stepPath, ctx)
+
+		if err != nil {
+			return stamp(naproutine.StepError(step, err).SetIteration(iteration), start), nil, false
+		}
+
+		stepResult = naproutine.StepRequestResult(step, runRequest(ctx, stepPath, request)).SetIteration(iteration)
 	}
 
-	result.EndTime = time.Now()
+	if stepType == "script" {
+		stepResult = naproutine.StepScriptResult(step, runScript(ctx, stepPath)).SetIteration(iteration)
+	}
 
-	return result
+	if stepType == "routine" {
+		subroutineCtx := ctx.Clone(filepath.Dir(stepPath))
+		subroutine, err := naproutine.LoadFromPath(stepPath, subroutineCtx)
+
+		// the subroutine sends its result on the channel as soon as it's done, so it never waits on the reader
+		resultCh := make(chan *naproutine.RoutineStepResult, 1)
+
+		if err != nil {
+			stepResult = naproutine.StepError(step, err).SetIteration(iteration)
+		} else if wait || len(subroutine.Exports) > 0 {
+			// a subroutine with exports is waited on so the variables it exports are there for the next step
+			runRoutine(subroutineCtx, subroutine, step, iteration, resultCh)
+			stepResult = <-resultCh
+			exportVariables(ctx, subroutineCtx, subroutine, stepResult)
+		} else {
+			go runRoutine(subroutineCtx, subroutine, step, iteration, resultCh)
+			return nil, resultCh, true
+		}
+	}
+
+	if stepResult == nil {
+		return stamp(naproutine.StepError(step, fmt.Errorf("could not run path: %s", stepPath)), start), nil, false
+	}
+
+	stamp(stepResult, start)
+	run.incrementProgress()
+
+	// with fail-fast, a failure part way through a loop stops the rest of it too
+	if ctx.FailFast && !stepResult.IsPassing() {
+		ctx.Cancel()
+	}
+
+	return stepResult, nil, true
+}
+
+// exportVariables copies the variables a subroutine exports into the context of the step that ran it
+func exportVariables(ctx *napcontext.Context, subroutineCtx *napcontext.Context, subroutine *naproutine.Routine, stepResult *naproutine.RoutineStepResult) {
+	for _, name := range subroutine.Exports {
+		value, ok := subroutineCtx.Variables.Lookup(name)
+		if !ok {
+			stepResult.Errors = append(stepResult.Errors, fmt.Errorf("%s: exported variable %s was never set", subroutine.Name, name))
+			continue
+		}
+
+		if subroutineCtx.Variables.IsStructured(name) {
+			ctx.Variables.SetStructured(name, value)
+		} else {
+			ctx.Variables.Set(name, value)
+		}
+	}
+}
+
+// stamp records when a step result started and finished, unless it already knows
+func stamp(stepResult *naproutine.RoutineStepResult, start time.Time) *naproutine.RoutineStepResult {
+	if stepResult.StartTime.IsZero() {
+		stepResult.StartTime = start
+		stepResult.EndTime = time.Now()
+	}
+
+	return stepResult
+}
+
+// limiter bounds how many goroutines run at once. a nil limiter doesn't limit anything
+type limiter chan struct{}
+
+func newLimiter(limit int) limiter {
+	if limit <= 0 {
+		return nil
+	}
+
+	return make(limiter, limit)
+}
+
+func (l limiter) acquire() {
+	if l != nil {
+		l <- struct{}{}
+	}
+}
+
+func (l limiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+func notRun(steps []*naproutine.RoutineStep, reason string) []*naproutine.RoutineStepResult {
+	results := make([]*naproutine.RoutineStepResult, 0, len(steps))
+	for _, step := range steps {
+		results = append(results, naproutine.StepNotRun(step, reason))
+	}
+
+	return results
 }
 
 func populateErrors(result *naproutine.RoutineResult) {
-	for _, v := range result.StepResults {
+	result.Errors = append(result.Errors, collectErrors(result, result.SetupResults)...)
+	result.Errors = append(result.Errors, collectErrors(result, result.StepResults)...)
+
+	// teardown errors are kept apart so they don't hide whatever failed first
+	result.TeardownErrors = append(result.TeardownErrors, collectErrors(result, result.TeardownResults)...)
+}
+
+// collectErrors gathers the errors from a list of step results. teardown errors from subroutines are added
+// to the result's teardown errors
+func collectErrors(result *naproutine.RoutineResult, stepResults []*naproutine.RoutineStepResult) []error {
+	errs := []error{}
+
+	for _, v := range stepResults {
 		if v.SubroutineResult != nil {
 			populateErrors(v.SubroutineResult)
-			result.Errors = append(result.Errors, v.SubroutineResult.Errors...)
+			errs = append(errs, v.SubroutineResult.Errors...)
+			errs = append(errs, v.Errors...)
+			result.TeardownErrors = append(result.TeardownErrors, v.SubroutineResult.TeardownErrors...)
 			continue
 		}
 
 		if len(v.Errors) > 0 {
-			result.Errors = append(result.Errors, v.Errors...)
+			errs = append(errs, v.Errors...)
 			continue
 		}
 
 		if v.RequestResult != nil && v.RequestResult.Error != nil {
-			result.Errors = append(result.Errors, errors.New(fmt.Sprintf("%s: %s", v.RequestResult.Request.Name, v.RequestResult.Error)))
+			errs = append(errs, errors.New(fmt.Sprintf("%s: %s", v.RequestResult.Request.Name, v.RequestResult.Error)))
 			continue
 		}
 
 		if v.ScriptResult != nil && v.ScriptResult.Error != nil {
-			result.Errors = append(result.Errors, errors.New(fmt.Sprintf("%s: %s", v.Step.Run, v.ScriptResult.Error)))
+			errs = append(errs, errors.New(fmt.Sprintf("%s: %s", v.Step.Run, v.ScriptResult.Error)))
 			continue
 		}
 	}
+
+	return errs
 }
 
 func peekType(path string, ctx *napcontext.Context) (string, error) {
@@ -188,15 +736,12 @@ func peekType(path string, ctx *napcontext.Context) (string, error) {
 		return "", fmt.Errorf("type of file unclear: %s (cannot read file: %s)", path, err.Error())
 	}
 
-	dataAsString := string(data)
+	data, _, err = naptemplate.RenderYaml(data, ctx.Variables.Lookup)
 
-	for k, v := range ctx.EnvironmentVariables {
-		variable := fmt.Sprintf("${%s}", k)
-		dataAsString = strings.ReplaceAll(dataAsString, variable, v)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", path, err.Error())
 	}
 
-	data = []byte(dataAsString)
-
 	err = yaml.Unmarshal(data, &yamlMap)
 
 	if err != nil {
@@ -214,3 +759,134 @@ func peekType(path string, ctx *napcontext.Context) (string, error) {
 		return "", fmt.Errorf("type of file unclear: %s", path)
 	}
 }
+
+// shouldSkipStep evaluates the step's if/unless conditions against the current variables
+func shouldSkipStep(ctx *napcontext.Context, step *naproutine.RoutineStep) (bool, string, error) {
+	if len(step.If) > 0 {
+		ok, err := evalCondition(ctx, step.If)
+		if err != nil {
+			return false, "", err
+		}
+
+		if !ok {
+			return true, fmt.Sprintf("if: %s", step.If), nil
+		}
+	}
+
+	if len(step.Unless) > 0 {
+		ok, err := evalCondition(ctx, step.Unless)
+		if err != nil {
+			return false, "", err
+		}
+
+		if ok {
+			return true, fmt.Sprintf("unless: %s", step.Unless), nil
+		}
+	}
+
+	return false, "", nil
+}
+
+// evalCondition decides whether a condition holds. a lone ${...} expression is true when its value is
+// non-empty and not false. anything else is evaluated as javascript, unless it's a plain true/false value.
+// each expression's value is bound to a variable rather than pasted into the javascript, so a value holding
+// quotes or semicolons can't change the expression. values that aren't set are empty
+func evalCondition(ctx *napcontext.Context, condition string) (bool, error) {
+	condition = strings.TrimSpace(condition)
+
+	values := []string{}
+	bindings := []interface{}{}
+	var quote byte
+
+	source, err := naptemplate.Substitute(condition, ctx.Variables.Lookup, func(before string, value string, ok bool) string {
+		if !ok {
+			value = ""
+		}
+
+		name := fmt.Sprintf("__condition%d", len(bindings))
+		values = append(values, value)
+		quote = scanQuotes(before, quote)
+
+		// inside a string literal, the value is joined to the text around it
+		if quote != 0 {
+			bindings = append(bindings, value)
+			return fmt.Sprintf("%s%c + %s + %c", before, quote, name, quote)
+		}
+
+		bindings = append(bindings, conditionValue(value))
+		return before + name
+	})
+
+	if err != nil {
+		return false, fmt.Errorf("cannot evaluate condition \"%s\": %w", condition, err)
+	}
+
+	if len(values) == 1 && source == "__condition0" {
+		return isTruthy(values[0]), nil
+	}
+
+	if len(bindings) == 0 {
+		switch strings.ToLower(condition) {
+		case "true", "yes", "1":
+			return true, nil
+		case "", "false", "no", "0", "null", "undefined":
+			return false, nil
+		}
+	}
+
+	if err := napscript.SetupVm(ctx, RunPath); err != nil {
+		return false, err
+	}
+
+	for i, v := range bindings {
+		if err := ctx.ScriptContext.Vm.Set(fmt.Sprintf("__condition%d", i), v); err != nil {
+			return false, err
+		}
+	}
+
+	value, err := ctx.ScriptContext.Vm.Run(source)
+	if err != nil {
+		return false, fmt.Errorf("cannot evaluate condition \"%s\": %w", condition, err)
+	}
+
+	return value.ToBoolean()
+}
+
+// conditionValue reads a value outside a string literal the way javascript would read it written there, so
+// numbers, booleans and json compare as themselves. anything else is a string
+func conditionValue(value string) interface{} {
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(value), &parsed); err == nil && parsed != nil {
+		return parsed
+	}
+
+	return value
+}
+
+// scanQuotes follows the string literals in a piece of javascript and returns the quote that's still open
+// at its end, if any. quote is the one that was open at its start
+func scanQuotes(source string, quote byte) byte {
+	for i := 0; i < len(source); i++ {
+		c := source[i]
+
+		switch {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		}
+	}
+
+	return quote
+}
+
+func isTruthy(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "false", "no", "0", "null", "undefined":
+		return false
+	}
+
+	return true
+}
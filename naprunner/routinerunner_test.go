@@ -0,0 +1,1208 @@
+package naprunner_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davesheldon/nap/napcontext"
+	"github.com/davesheldon/nap/naproutine"
+	"github.com/davesheldon/nap/naprunner"
+)
+
+func TestStepConditions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{ "id": "abc-123", "count": 3 }`)
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		step        string
+		shouldRun   bool
+		shouldError bool
+	}{
+		"if with a captured variable":        {step: "if: ${resourceId}", shouldRun: true},
+		"if with an undefined variable":      {step: "if: ${missing}", shouldRun: false},
+		"if with an expression":              {step: `if: "${count} > 2"`, shouldRun: true},
+		"if with a false expression":         {step: `if: "'${resourceId}' == 'other'"`, shouldRun: false},
+		"if with a literal false":            {step: "if: false", shouldRun: false},
+		"unless with a captured variable":    {step: "unless: ${resourceId}", shouldRun: false},
+		"unless with an undefined variable":  {step: "unless: ${missing}", shouldRun: true},
+		"if and unless together":             {step: "if: ${resourceId}\n    unless: \"${count} == 3\"", shouldRun: false},
+		"invalid expression":                 {step: "if: \"${count} >\"", shouldError: true},
+		"if with a structured value":         {step: "if: ${db.enabled}", shouldRun: true},
+		"if with a default":                  {step: "if: ${flag:-true}", shouldRun: true},
+		"if with a quote in a value":         {step: `if: "'${name}' == \"O'Brien\""`, shouldRun: true},
+		"values can't change the expression": {step: `if: "'${injection}' == 'safe'"`, shouldRun: false},
+		"numbers compare as numbers":         {step: `if: "${ten} > ${nine}"`, shouldRun: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			create := "kind: request\npath: ${baseUrl}\ncaptures:\n  resourceId: jsonpath $.id\n  count: jsonpath $.count\n"
+			if err := os.WriteFile(filepath.Join(dir, "create.yml"), []byte(create), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			routine := fmt.Sprintf("kind: routine\nsteps:\n  - run: create.yml\n  - run: create.yml\n    %s\n", test.step)
+			variables := map[string]string{
+				"baseUrl":   server.URL,
+				"db":        `{ "enabled": true }`,
+				"name":      "O'Brien",
+				"injection": "x' || true || '",
+				"ten":       "10",
+				"nine":      "9",
+			}
+
+			job := runTestFile(t, dir, routine, variables)
+			result := job.StepResults[0].SubroutineResult
+
+			if len(result.StepResults) != 2 {
+				t.Fatalf("Expected 2 step results, got %d", len(result.StepResults))
+			}
+
+			if result.IsPassing() == test.shouldError {
+				t.Fatalf("Expected passing=%t, got errors: %v", !test.shouldError, job.Errors)
+			}
+
+			if test.shouldError {
+				return
+			}
+
+			if result.StepResults[1].Skipped == test.shouldRun {
+				t.Errorf("Expected step to run=%t, skip reason: %s", test.shouldRun, result.StepResults[1].SkipReason)
+			}
+
+			stats := job.GetRunStats()
+			expectedSkipped := 0
+			if !test.shouldRun {
+				expectedSkipped = 1
+			}
+
+			if stats.Totals.Skipped != expectedSkipped {
+				t.Errorf("Expected %d skipped, got %d", expectedSkipped, stats.Totals.Skipped)
+			}
+		})
+	}
+}
+
+func TestStepLoops(t *testing.T) {
+	tests := map[string]struct {
+		steps      string
+		hits       map[string]int
+		shouldPass bool
+	}{
+		"repeat": {
+			steps:      "  - run: ping.yml\n    repeat: 3\n",
+			hits:       map[string]int{"/ping": 3},
+			shouldPass: true,
+		},
+		"for each captured id": {
+			steps:      "  - run: list.yml\n  - run: delete.yml\n    forEach: ${ids}\n    as: resourceId\n",
+			hits:       map[string]int{"/items": 1, "/items/a": 1, "/items/b": 1, "/items/c": 1},
+			shouldPass: true,
+		},
+		"for each over a yaml list": {
+			steps:      "  - run: delete.yml\n    forEach: [x, 7]\n    as: resourceId\n",
+			hits:       map[string]int{"/items/x": 1, "/items/7": 1},
+			shouldPass: true,
+		},
+		"for each over a yaml list of templates": {
+			steps:      "  - run: poll.yml\n  - run: delete.yml\n    forEach: [\"${prefix}-x\", \"${state}\", \"${prefix}-${missing:-y}\"]\n    as: resourceId\n",
+			hits:       map[string]int{"/poll": 1, "/items/hello-x": 1, "/items/pending": 1, "/items/hello-y": 1},
+			shouldPass: true,
+		},
+		"for each over a structured value": {
+			steps:      "  - run: delete.yml\n    forEach: ${db.ids}\n    as: resourceId\n",
+			hits:       map[string]int{"/items/p": 1, "/items/q": 1},
+			shouldPass: true,
+		},
+		"for each over an empty capture": {
+			steps:      "  - run: delete.yml\n    forEach: ${missing}\n    as: resourceId\n",
+			hits:       map[string]int{},
+			shouldPass: true,
+		},
+		"while polling": {
+			steps:      "  - run: poll.yml\n    while: \"'${state}' != 'done'\"\n",
+			hits:       map[string]int{"/poll": 3},
+			shouldPass: true,
+		},
+		"while guard": {
+			steps:      "  - run: poll.yml\n    while: \"'${state}' != 'never'\"\n    maxIterations: 2\n",
+			hits:       map[string]int{"/poll": 2},
+			shouldPass: false,
+		},
+		"more than one loop": {
+			steps:      "  - run: ping.yml\n    repeat: 2\n    while: \"true\"\n",
+			hits:       map[string]int{},
+			shouldPass: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			hits := map[string]int{}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				hits[r.URL.Path]++
+				polls := hits["/poll"]
+				mu.Unlock()
+
+				w.Header().Set("Content-Type", "application/json")
+
+				switch r.URL.Path {
+				case "/items":
+					fmt.Fprint(w, `{ "items": [ { "id": "a" }, { "id": "b" }, { "id": "c" } ] }`)
+				case "/poll":
+					state := "pending"
+					if polls >= 3 {
+						state = "done"
+					}
+					fmt.Fprintf(w, `{ "state": "%s" }`, state)
+				default:
+					fmt.Fprint(w, `{}`)
+				}
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			files := map[string]string{
+				"ping.yml":   "kind: request\npath: ${baseUrl}/ping\n",
+				"list.yml":   "kind: request\npath: ${baseUrl}/items\ncaptures:\n  ids: jsonpath $.items[*].id\n",
+				"delete.yml": "kind: request\nverb: DELETE\npath: ${baseUrl}/items/${resourceId}\n",
+				"poll.yml":   "kind: request\npath: ${baseUrl}/poll\ncaptures:\n  state: jsonpath $.state\n",
+			}
+
+			for file, contents := range files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result := runTestFile(t, dir, "kind: routine\nsteps:\n"+test.steps, map[string]string{"baseUrl": server.URL, "db": `{ "ids": ["p", "q"] }`, "prefix": "hello"})
+
+			if result.IsPassing() != test.shouldPass {
+				t.Errorf("Expected passing=%t, got errors: %v", test.shouldPass, result.Errors)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if !reflect.DeepEqual(hits, test.hits) {
+				t.Errorf("Expected hits %v, got %v", test.hits, hits)
+			}
+		})
+	}
+}
+
+func TestDataIterations(t *testing.T) {
+	dataFiles := map[string]string{
+		"users.csv":   "name,role\nada,admin\nbob,user\ncy,admin\n",
+		"users.json":  `[ { "name": "ada", "role": "admin" }, { "name": "bob", "role": "user", "age": 30 } ]`,
+		"users.jsonl": "{ \"name\": \"ada\", \"role\": \"admin\" }\n\n{ \"name\": \"bob\", \"role\": null }\n",
+	}
+
+	tests := map[string]struct {
+		step       string
+		names      []string
+		rows       []int
+		shouldPass bool
+	}{
+		"csv":                  {step: "iterations: users.csv", names: []string{"ada", "bob", "cy"}, rows: []int{1, 2, 3}, shouldPass: true},
+		"json":                 {step: "iterations: users.json", names: []string{"ada", "bob"}, rows: []int{1, 2}, shouldPass: true},
+		"jsonl":                {step: "iterations: users.jsonl", names: []string{"ada", "bob"}, rows: []int{1, 2}, shouldPass: true},
+		"filter":               {step: "iterations: users.csv\n    filter: \"'${role}' == 'admin'\"", names: []string{"ada", "cy"}, rows: []int{1, 3}, shouldPass: true},
+		"limit":                {step: "iterations: users.csv\n    limit: 2", names: []string{"ada", "bob"}, rows: []int{1, 2}, shouldPass: true},
+		"filter and limit":     {step: "iterations: users.csv\n    filter: \"'${role}' == 'admin'\"\n    limit: 1", names: []string{"ada"}, rows: []int{1}, shouldPass: true},
+		"filter matching none": {step: "iterations: users.csv\n    filter: \"'${role}' == 'owner'\"", names: []string{}, rows: []int{}, shouldPass: true},
+		"malformed json":       {step: "iterations: broken.json", names: []string{}, rows: []int{}, shouldPass: false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			names := []string{}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				names = append(names, r.URL.Query().Get("name"))
+				mu.Unlock()
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			files := map[string]string{
+				"user.yml":    "kind: request\npath: ${baseUrl}/users?name=${name}\n",
+				"broken.json": `{ "not": "an array" }`,
+			}
+
+			for file, contents := range dataFiles {
+				files[file] = contents
+			}
+
+			for file, contents := range files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			job := runTestFile(t, dir, "kind: routine\nsteps:\n  - run: user.yml\n    "+test.step+"\n", map[string]string{"baseUrl": server.URL})
+
+			if job.IsPassing() != test.shouldPass {
+				t.Fatalf("Expected passing=%t, got errors: %v", test.shouldPass, job.Errors)
+			}
+
+			if !reflect.DeepEqual(names, test.names) {
+				t.Errorf("Expected requests for %v, got %v", test.names, names)
+			}
+
+			if !test.shouldPass {
+				return
+			}
+
+			rows := []int{}
+			for i, v := range job.StepResults[0].SubroutineResult.StepResults {
+				if v.IterationIndex != i {
+					t.Errorf("Expected iteration index %d, got %d", i, v.IterationIndex)
+				}
+
+				rows = append(rows, v.IterationRow)
+			}
+
+			if !reflect.DeepEqual(rows, test.rows) {
+				t.Errorf("Expected rows %v, got %v", test.rows, rows)
+			}
+		})
+	}
+
+	t.Run("shuffle", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "users.csv"), []byte(dataFiles["users.csv"]), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, "user.js"), []byte("console.log(nap.env.get('name'))"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		job := runTestFile(t, dir, "kind: routine\nsteps:\n  - run: user.js\n    iterations: users.csv\n    shuffle: true\n", map[string]string{})
+
+		if !job.IsPassing() {
+			t.Fatalf("Expected passing, got errors: %v", job.Errors)
+		}
+
+		rows := map[int]bool{}
+		for _, v := range job.StepResults[0].SubroutineResult.StepResults {
+			rows[v.IterationRow] = true
+		}
+
+		if len(rows) != 3 {
+			t.Errorf("Expected each of the 3 rows to run once, got rows %v", rows)
+		}
+	})
+}
+
+func TestSetupAndTeardown(t *testing.T) {
+	tests := map[string]struct {
+		routine        string
+		hits           []string
+		errors         int
+		teardownErrors int
+		cancelOnPath   string
+		shouldPass     bool
+	}{
+		"setup captures are visible to steps and teardown": {
+			routine:    "setup:\n  - run: create.yml\nsteps:\n  - run: get.yml\nteardown:\n  - run: delete.yml\n",
+			hits:       []string{"POST /items", "GET /items/abc", "DELETE /items/abc"},
+			shouldPass: true,
+		},
+		"teardown sees captures from parallel steps": {
+			routine:    "parallel: true\nsteps:\n  - run: create.yml\n  - run: create.yml\nteardown:\n  - run: delete.yml\n",
+			hits:       []string{"POST /items", "POST /items", "DELETE /items/abc"},
+			shouldPass: true,
+		},
+		"teardown runs after a failed step": {
+			routine:    "setup:\n  - run: create.yml\nsteps:\n  - run: fail.yml\n  - run: get.yml\nteardown:\n  - run: delete.yml\n",
+			hits:       []string{"POST /items", "GET /fail", "GET /items/abc", "DELETE /items/abc"},
+			errors:     1,
+			shouldPass: false,
+		},
+		"steps don't run after a failed setup": {
+			routine:    "setup:\n  - run: fail.yml\nsteps:\n  - run: get.yml\nteardown:\n  - run: delete.yml\n",
+			hits:       []string{"GET /fail", "DELETE /items/"},
+			errors:     1,
+			shouldPass: false,
+		},
+		"teardown failures are reported separately": {
+			routine:        "steps:\n  - run: create.yml\n  - run: fail.yml\nteardown:\n  - run: fail.yml\n  - run: delete.yml\n",
+			hits:           []string{"POST /items", "GET /fail", "GET /fail", "DELETE /items/abc"},
+			errors:         1,
+			teardownErrors: 1,
+			shouldPass:     false,
+		},
+		"teardown runs after the run is cancelled": {
+			routine:      "setup:\n  - run: create.yml\nsteps:\n  - run: get.yml\n  - run: get.yml\nteardown:\n  - run: delete.yml\n",
+			hits:         []string{"POST /items", "GET /items/abc", "DELETE /items/abc"},
+			errors:       1,
+			cancelOnPath: "/items/abc",
+			shouldPass:   false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			hits := []string{}
+
+			var ctx *napcontext.Context
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				hits = append(hits, r.Method+" "+r.URL.Path)
+				mu.Unlock()
+
+				if r.URL.Path == test.cancelOnPath {
+					ctx.Cancel()
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{ "id": "abc" }`)
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			files := map[string]string{
+				"create.yml": "kind: request\nverb: POST\npath: ${baseUrl}/items\ncaptures:\n  id: jsonpath $.id\n",
+				"get.yml":    "kind: request\npath: ${baseUrl}/items/${id}\n",
+				"delete.yml": "kind: request\nverb: DELETE\npath: ${baseUrl}/items/${id}\n",
+				"fail.yml":   "kind: request\npath: ${baseUrl}/fail\nasserts:\n  - status == 500\n",
+				"test.yml":   "kind: routine\n" + test.routine,
+			}
+
+			for file, contents := range files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx = napcontext.New("", nil, map[string]string{"baseUrl": server.URL, "id": ""}, nil, true)
+			result := naprunner.RunPath(ctx, filepath.Join(dir, "test.yml"))
+
+			if result.IsPassing() != test.shouldPass {
+				t.Errorf("Expected passing=%t, got errors: %v, teardown errors: %v", test.shouldPass, result.Errors, result.TeardownErrors)
+			}
+
+			if len(result.Errors) != test.errors {
+				t.Errorf("Expected %d errors, got %v", test.errors, result.Errors)
+			}
+
+			if len(result.TeardownErrors) != test.teardownErrors {
+				t.Errorf("Expected %d teardown errors, got %v", test.teardownErrors, result.TeardownErrors)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if !reflect.DeepEqual(hits, test.hits) {
+				t.Errorf("Expected requests %v, got %v", test.hits, hits)
+			}
+		})
+	}
+}
+
+func TestErrorPolicies(t *testing.T) {
+	tests := map[string]struct {
+		routine    string
+		failFast   bool
+		hits       []string
+		notRun     int
+		shouldLoad bool
+	}{
+		"failed requests continue by default": {
+			routine:    "steps:\n  - run: fail.yml\n  - run: ping.yml\n",
+			hits:       []string{"/fail", "/ping"},
+			shouldLoad: true,
+		},
+		"missing files skip the remaining steps by default": {
+			routine:    "steps:\n  - run: missing.yml\n  - run: ping.yml\n",
+			hits:       []string{},
+			notRun:     1,
+			shouldLoad: true,
+		},
+		"routine skipRemaining": {
+			routine:    "onError: skipRemaining\nsteps:\n  - run: fail.yml\n  - run: ping.yml\n  - run: ping.yml\n",
+			hits:       []string{"/fail"},
+			notRun:     2,
+			shouldLoad: true,
+		},
+		"step continue overrides routine": {
+			routine:    "onError: skipRemaining\nsteps:\n  - run: fail.yml\n    onError: continue\n  - run: ping.yml\n",
+			hits:       []string{"/fail", "/ping"},
+			shouldLoad: true,
+		},
+		"continue after a missing file": {
+			routine:    "onError: continue\nsteps:\n  - run: missing.yml\n  - run: ping.yml\n",
+			hits:       []string{"/ping"},
+			shouldLoad: true,
+		},
+		"stop still runs teardown": {
+			routine:    "steps:\n  - run: fail.yml\n    onError: stop\n  - run: ping.yml\nteardown:\n  - run: ping.yml\n",
+			hits:       []string{"/fail", "/ping"},
+			notRun:     1,
+			shouldLoad: true,
+		},
+		"stop in a subroutine": {
+			routine:    "steps:\n  - run: stop.yml\n",
+			hits:       []string{"/fail"},
+			notRun:     1,
+			shouldLoad: true,
+		},
+		"fail fast cancels parallel subroutines": {
+			routine:    "steps:\n  - run: slow.yml\n  - run: failing.yml\n",
+			failFast:   true,
+			hits:       []string{"/fail"},
+			notRun:     1,
+			shouldLoad: true,
+		},
+		"invalid policy": {
+			routine:    "onError: explode\nsteps:\n  - run: ping.yml\n",
+			hits:       []string{},
+			shouldLoad: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			hits := []string{}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/slow" {
+					select {
+					case <-r.Context().Done():
+					case <-time.After(5 * time.Second):
+					}
+					return
+				}
+
+				mu.Lock()
+				hits = append(hits, r.URL.Path)
+				mu.Unlock()
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			files := map[string]string{
+				"ping.yml":    "kind: request\npath: ${baseUrl}/ping\n",
+				"fail.yml":    "kind: request\npath: ${baseUrl}/fail\nasserts:\n  - status == 500\n",
+				"slowreq.yml": "kind: request\npath: ${baseUrl}/slow\n",
+				"stop.yml":    "kind: routine\nonError: stop\nsteps:\n  - run: fail.yml\n  - run: ping.yml\n",
+				"slow.yml":    "kind: routine\nsteps:\n  - run: slowreq.yml\n  - run: ping.yml\n",
+				"failing.yml": "kind: routine\nsteps:\n  - run: fail.yml\n",
+				"test.yml":    "kind: routine\n" + test.routine,
+			}
+
+			for file, contents := range files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx := napcontext.New("", nil, map[string]string{"baseUrl": server.URL}, nil, true)
+			ctx.FailFast = test.failFast
+
+			start := time.Now()
+			result := naprunner.RunPath(ctx, filepath.Join(dir, "test.yml"))
+
+			if time.Since(start) > 4*time.Second {
+				t.Errorf("Expected in-flight requests to be cancelled, run took %s", time.Since(start))
+			}
+
+			if result.IsPassing() {
+				t.Errorf("Expected a failing run")
+			}
+
+			loaded := result.StepResults[0].SubroutineResult != nil
+			if loaded != test.shouldLoad {
+				t.Fatalf("Expected loaded=%t, got errors: %v", test.shouldLoad, result.Errors)
+			}
+
+			if notRun := result.GetRunStats().NotRun; notRun != test.notRun {
+				t.Errorf("Expected %d steps not run, got %d", test.notRun, notRun)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if !reflect.DeepEqual(hits, test.hits) {
+				t.Errorf("Expected requests %v, got %v", test.hits, hits)
+			}
+		})
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	tests := map[string]struct {
+		routine     string
+		concurrency int
+		minInFlight int
+		maxInFlight int
+		items       []string
+	}{
+		"iterations run one at a time by default": {
+			routine:     "steps:\n  - run: slow.yml\n    repeat: 3\n",
+			minInFlight: 1,
+			maxInFlight: 1,
+			items:       []string{"", "", ""},
+		},
+		"parallel iterations": {
+			routine:     "steps:\n  - run: slow.yml\n    repeat: 4\n    parallel: true\n",
+			minInFlight: 2,
+			maxInFlight: 4,
+			items:       []string{"", "", "", ""},
+		},
+		"parallel iterations with max concurrency": {
+			routine:     "steps:\n  - run: slow.yml\n    repeat: 4\n    parallel: true\n    maxConcurrency: 2\n",
+			minInFlight: 2,
+			maxInFlight: 2,
+			items:       []string{"", "", "", ""},
+		},
+		"parallel for each keeps each item": {
+			routine:     "steps:\n  - run: slow.yml\n    forEach: [a, b, c]\n    parallel: true\n",
+			minInFlight: 2,
+			maxInFlight: 3,
+			items:       []string{"a", "b", "c"},
+		},
+		"parallel routine": {
+			routine:     "parallel: true\nmaxConcurrency: 2\nsteps:\n  - run: slow.yml\n  - run: slow.yml\n  - run: slow.yml\n",
+			minInFlight: 2,
+			maxInFlight: 2,
+			items:       []string{"", "", ""},
+		},
+		"subroutines run in parallel by default": {
+			routine:     "steps:\n  - run: sub.yml\n  - run: sub.yml\n",
+			minInFlight: 2,
+			maxInFlight: 2,
+			items:       []string{"", ""},
+		},
+		"sequential routine waits for subroutines": {
+			routine:     "parallel: false\nsteps:\n  - run: sub.yml\n  - run: sub.yml\n",
+			minInFlight: 1,
+			maxInFlight: 1,
+			items:       []string{"", ""},
+		},
+		"global concurrency limit": {
+			routine:     "steps:\n  - run: sub.yml\n  - run: slow.yml\n    repeat: 3\n    parallel: true\n",
+			concurrency: 1,
+			minInFlight: 1,
+			maxInFlight: 1,
+			items:       []string{"", "", "", ""},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			inFlight, maxInFlight := 0, 0
+			items := []string{}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				items = append(items, r.URL.Query().Get("item"))
+				mu.Unlock()
+
+				time.Sleep(100 * time.Millisecond)
+
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			files := map[string]string{
+				"slow.yml": "kind: request\npath: ${baseUrl}/slow?item=${item}\n",
+				"sub.yml":  "kind: routine\nsteps:\n  - run: slow.yml\n",
+				"test.yml": "kind: routine\n" + test.routine,
+			}
+
+			for file, contents := range files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx := napcontext.New("", nil, map[string]string{"baseUrl": server.URL, "item": ""}, nil, true)
+			ctx.SetConcurrency(test.concurrency)
+
+			result := naprunner.RunPath(ctx, filepath.Join(dir, "test.yml"))
+
+			if !result.IsPassing() {
+				t.Fatalf("Expected passing, got errors: %v", result.Errors)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if maxInFlight < test.minInFlight || maxInFlight > test.maxInFlight {
+				t.Errorf("Expected between %d and %d requests in flight, got %d", test.minInFlight, test.maxInFlight, maxInFlight)
+			}
+
+			sort.Strings(items)
+			if !reflect.DeepEqual(items, test.items) {
+				t.Errorf("Expected items %v, got %v", test.items, items)
+			}
+		})
+	}
+}
+
+func TestStepDependencies(t *testing.T) {
+	tests := map[string]struct {
+		routine     string
+		hits        []string
+		notRun      int
+		minInFlight int
+		loadError   string
+	}{
+		"dependents see captures and independent steps run together": {
+			routine:     "steps:\n  - run: item.yml\n    id: a\n    needs: login\n    env:\n      name: a\n  - run: item.yml\n    id: b\n    needs: [login]\n    env:\n      name: b\n  - run: login.yml\n    id: login\n",
+			hits:        []string{"/login ", "/slow/a token-1", "/slow/b token-1"},
+			minInFlight: 2,
+		},
+		"dependents of failed steps are not run": {
+			routine: "steps:\n  - run: fail.yml\n    id: fails\n  - run: item.yml\n    id: a\n    needs: fails\n  - run: item.yml\n    needs: a\n  - run: login.yml\n",
+			hits:    []string{"/fail ", "/login "},
+			notRun:  2,
+		},
+		"skipped steps count as done": {
+			routine: "steps:\n  - run: login.yml\n    id: login\n    if: false\n  - run: item.yml\n    needs: login\n",
+			hits:    []string{"/slow/ "},
+		},
+		"cycle": {
+			routine:   "steps:\n  - run: login.yml\n    id: a\n    needs: c\n  - run: login.yml\n    id: b\n    needs: a\n  - run: login.yml\n    id: c\n    needs: b\n",
+			hits:      []string{},
+			loadError: "steps have a dependency cycle: a -> c -> b -> a",
+		},
+		"unknown step": {
+			routine:   "steps:\n  - run: login.yml\n    needs: nope\n",
+			hits:      []string{},
+			loadError: "needs unknown step id: nope",
+		},
+		"duplicate id": {
+			routine:   "steps:\n  - run: login.yml\n    id: a\n  - run: login.yml\n    id: a\n",
+			hits:      []string{},
+			loadError: "duplicate step id: a",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			hits := []string{}
+			inFlight, maxInFlight := 0, 0
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				hits = append(hits, r.URL.Path+" "+r.Header.Get("Authorization"))
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				mu.Unlock()
+
+				if r.URL.Path == "/login" {
+					w.Header().Set("Content-Type", "application/json")
+					fmt.Fprint(w, `{ "token": "token-1" }`)
+				} else {
+					time.Sleep(100 * time.Millisecond)
+				}
+
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			files := map[string]string{
+				"login.yml": "kind: request\npath: ${baseUrl}/login\ncaptures:\n  token: jsonpath $.token\n",
+				"item.yml":  "kind: request\npath: ${baseUrl}/slow/${name}\nheaders:\n  Authorization: ${token}\n",
+				"fail.yml":  "kind: request\npath: ${baseUrl}/fail\nasserts:\n  - status == 500\n",
+				"test.yml":  "kind: routine\n" + test.routine,
+			}
+
+			for file, contents := range files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx := napcontext.New("", nil, map[string]string{"baseUrl": server.URL, "name": "", "token": ""}, nil, true)
+			result := naprunner.RunPath(ctx, filepath.Join(dir, "test.yml"))
+
+			if len(test.loadError) > 0 {
+				if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Error(), test.loadError) {
+					t.Errorf("Expected load error %q, got %v", test.loadError, result.Errors)
+				}
+				return
+			}
+
+			if notRun := result.GetRunStats().NotRun; notRun != test.notRun {
+				t.Errorf("Expected %d steps not run, got %d", test.notRun, notRun)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			sort.Strings(hits)
+			if !reflect.DeepEqual(hits, test.hits) {
+				t.Errorf("Expected requests %v, got %v", test.hits, hits)
+			}
+
+			if test.minInFlight > 0 && maxInFlight < test.minInFlight {
+				t.Errorf("Expected at least %d requests in flight, got %d", test.minInFlight, maxInFlight)
+			}
+		})
+	}
+}
+
+func TestResultOrdering(t *testing.T) {
+	tests := map[string]struct {
+		routine  string
+		expected []string
+		overlaps bool
+	}{
+		"subroutines keep their place among sequential steps": {
+			routine:  "steps:\n  - run: sub-slow.yml\n  - run: delay.yml\n    env:\n      item: 0\n  - run: sub-fast.yml\n",
+			expected: []string{"sub-slow.yml", "delay.yml /delay/0", "sub-fast.yml"},
+			overlaps: true,
+		},
+		"parallel routine keeps declaration order": {
+			routine:  "parallel: true\nsteps:\n  - run: delay.yml\n    env:\n      item: 300\n  - run: delay.yml\n    env:\n      item: 0\n  - run: delay.yml\n    env:\n      item: 100\n",
+			expected: []string{"delay.yml /delay/300", "delay.yml /delay/0", "delay.yml /delay/100"},
+			overlaps: true,
+		},
+		"parallel passes keep loop order": {
+			routine:  "steps:\n  - run: delay.yml\n    forEach: [300, 0, 100]\n    parallel: true\n",
+			expected: []string{"delay.yml /delay/300", "delay.yml /delay/0", "delay.yml /delay/100"},
+			overlaps: true,
+		},
+		"sequential steps don't overlap": {
+			routine:  "parallel: false\nsteps:\n  - run: sub-slow.yml\n  - run: sub-fast.yml\n",
+			expected: []string{"sub-slow.yml", "sub-fast.yml"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var delay int
+				fmt.Sscanf(r.URL.Path, "/delay/%d", &delay)
+				time.Sleep(time.Duration(delay) * time.Millisecond)
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			files := map[string]string{
+				"delay.yml":    "kind: request\npath: ${baseUrl}/delay/${item}\n",
+				"sub-slow.yml": "kind: routine\nsteps:\n  - run: delay.yml\n    env:\n      item: 300\n",
+				"sub-fast.yml": "kind: routine\nsteps:\n  - run: delay.yml\n    env:\n      item: 100\n",
+				"test.yml":     "kind: routine\n" + test.routine,
+			}
+
+			for file, contents := range files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx := napcontext.New("", nil, map[string]string{"baseUrl": server.URL, "item": ""}, nil, true)
+			job := naprunner.RunPath(ctx, filepath.Join(dir, "test.yml"))
+
+			if !job.IsPassing() {
+				t.Fatalf("Expected passing, got errors: %v", job.Errors)
+			}
+
+			result := job.StepResults[0].SubroutineResult
+
+			actual := []string{}
+			for _, stepResult := range result.StepResults {
+				name := stepResult.Step.Run
+				if stepResult.RequestResult != nil {
+					name += " " + stepResult.RequestResult.HttpResponse.Request.URL.Path
+				}
+
+				actual = append(actual, name)
+
+				if stepResult.StartTime.IsZero() || stepResult.EndTime.Before(stepResult.StartTime) {
+					t.Errorf("Expected start and end times for %s, got %v and %v", name, stepResult.StartTime, stepResult.EndTime)
+				}
+			}
+
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("Expected results in order %v, got %v", test.expected, actual)
+			}
+
+			first, last := result.StepResults[0], result.StepResults[len(result.StepResults)-1]
+			if overlaps := last.StartTime.Before(first.EndTime); overlaps != test.overlaps {
+				t.Errorf("Expected first and last steps to overlap: %t, got %t", test.overlaps, overlaps)
+			}
+		})
+	}
+}
+
+func TestVariableScoping(t *testing.T) {
+	tests := map[string]struct {
+		routine    string
+		subroutine string
+		hits       []string
+		error      string
+	}{
+		"step env only applies to its step": {
+			routine: "steps:\n  - run: item.yml\n    env:\n      name: a\n  - run: item.yml\n",
+			hits:    []string{"/item/a ", "/item/ "},
+		},
+		"step env restores the previous value": {
+			routine: "env:\n  name: outer\nsteps:\n  - run: item.yml\n    env:\n      name: inner\n  - run: item.yml\n",
+			hits:    []string{"/item/inner ", "/item/outer "},
+		},
+		"step env keeps captures into the same variable": {
+			routine: "steps:\n  - run: login.yml\n    env:\n      token: none\n  - run: item.yml\n",
+			hits:    []string{"/login ", "/item/ token-1"},
+		},
+		"subroutine env stays in the subroutine": {
+			routine:    "parallel: false\nsteps:\n  - run: sub.yml\n  - run: item.yml\n",
+			subroutine: "env:\n  name: inner\nsteps:\n  - run: item.yml\n",
+			hits:       []string{"/item/inner ", "/item/ "},
+		},
+		"subroutine captures stay in the subroutine": {
+			routine:    "parallel: false\nsteps:\n  - run: sub.yml\n  - run: item.yml\n",
+			subroutine: "steps:\n  - run: login.yml\n",
+			hits:       []string{"/login ", "/item/ "},
+		},
+		"exported captures reach the caller": {
+			routine:    "steps:\n  - run: sub.yml\n  - run: item.yml\n",
+			subroutine: "exports: token\nsteps:\n  - run: login.yml\n",
+			hits:       []string{"/login ", "/item/ token-1"},
+		},
+		"exports don't include other variables": {
+			routine:    "steps:\n  - run: sub.yml\n  - run: item.yml\n",
+			subroutine: "exports: [token]\nenv:\n  name: inner\nsteps:\n  - run: login.yml\n",
+			hits:       []string{"/login ", "/item/ token-1"},
+		},
+		"missing export": {
+			routine:    "steps:\n  - run: sub.yml\n",
+			subroutine: "exports: [missing]\nsteps:\n  - run: item.yml\n",
+			hits:       []string{"/item/ "},
+			error:      "exported variable missing was never set",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			hits := []string{}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				hits = append(hits, r.URL.Path+" "+r.Header.Get("Authorization"))
+				mu.Unlock()
+
+				if r.URL.Path == "/login" {
+					w.Header().Set("Content-Type", "application/json")
+					fmt.Fprint(w, `{ "token": "token-1" }`)
+				}
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			files := map[string]string{
+				"login.yml": "kind: request\npath: ${baseUrl}/login\ncaptures:\n  token: jsonpath $.token\n",
+				"item.yml":  "kind: request\npath: ${baseUrl}/item/${name}\nheaders:\n  Authorization: ${token}\n",
+				"sub.yml":   "kind: routine\n" + test.subroutine,
+				"test.yml":  "kind: routine\n" + test.routine,
+			}
+
+			for file, contents := range files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx := napcontext.New("", nil, map[string]string{"baseUrl": server.URL, "name": "", "token": ""}, nil, true)
+			result := naprunner.RunPath(ctx, filepath.Join(dir, "test.yml"))
+
+			if len(test.error) > 0 {
+				if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Error(), test.error) {
+					t.Errorf("Expected error %q, got %v", test.error, result.Errors)
+				}
+			} else if !result.IsPassing() {
+				t.Errorf("Expected passing, got errors: %v", result.Errors)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if !reflect.DeepEqual(hits, test.hits) {
+				t.Errorf("Expected requests %v, got %v", test.hits, hits)
+			}
+		})
+	}
+}
+
+func TestParallelCaptures(t *testing.T) {
+	tests := map[string]string{
+		"parallel routine":                       "parallel: true\nsteps:\n  - run: sub.yml\n    env:\n      id: a\n  - run: sub.yml\n    env:\n      id: b\n  - run: sub.yml\n    env:\n      id: c\n  - run: sub.yml\n    env:\n      id: d\n",
+		"subroutines alongside sequential steps": "steps:\n  - run: sub.yml\n    env:\n      id: a\n  - run: echo.yml\n    forEach: [1, 2, 3, 4, 5]\n  - run: sub.yml\n    env:\n      id: b\n  - run: set.js\n  - run: echo.yml\n    forEach: [6, 7, 8]\n    parallel: true\n",
+		"graph":                                  "steps:\n  - run: sub.yml\n    id: first\n    env:\n      id: a\n  - run: sub.yml\n    env:\n      id: b\n  - run: sub.yml\n    needs: first\n    env:\n      id: c\n  - run: echo.yml\n    forEach: [1, 2, 3]\n    parallel: true\n",
+	}
+
+	for name, routine := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{ "value": "%s" }`, r.URL.Query().Get("value"))
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			files := map[string]string{
+				"echo.yml": "kind: request\npath: ${baseUrl}/echo?value=${id}-${item}\ncaptures:\n  last: jsonpath $.value\n  token: jsonpath $.value\nasserts:\n  - jsonpath $.value == ${id}-${item}\n",
+				"set.js":   "nap.env.set(\"seen\", nap.env.get(\"last\") + \"!\");\n",
+				"sub.yml":  "kind: routine\nexports: [last, seen]\nsteps:\n  - run: echo.yml\n    forEach: [1, 2, 3, 4, 5, 6, 7, 8]\n    parallel: true\n  - run: set.js\n  - run: echo.yml\n    repeat: 3\n  - run: set.js\n",
+				"test.yml": "kind: routine\n" + routine,
+			}
+
+			for file, contents := range files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx := napcontext.New("", nil, map[string]string{"baseUrl": server.URL, "id": "top", "item": ""}, nil, true)
+			result := naprunner.RunPath(ctx, filepath.Join(dir, "test.yml"))
+
+			if !result.IsPassing() {
+				t.Errorf("Expected passing, got errors: %v", result.Errors)
+			}
+
+			if actual := ctx.Variables.Get("id"); actual != "top" {
+				t.Errorf("Expected id=top after the run, got %s", actual)
+			}
+		})
+	}
+}
+
+func TestStructuredEnvironments(t *testing.T) {
+	var mu sync.Mutex
+	paths := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.URL.Path)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"env.yml":     "db:\n  host: db.local\n  port: 5432\nusers:\n  - name: ada\n  - name: grace\nids: [ 1, 2 ]\n",
+		"request.yml": "kind: request\npath: ${baseUrl}/${db.host}/${db.port}/${users[1].name}/${item}\n",
+		"script.js": `var db = nap.env.get('db');
+var users = nap.env.get('users');
+if (db.host !== 'db.local' || db.port !== 5432) nap.fail('expected db to be an object, got ' + nap.env.getString('db'));
+if (users.length !== 2 || users[0].name !== 'ada') nap.fail('expected users to be an array');
+if (nap.env.get('plain') !== '[not json') nap.fail('expected plain text to stay a string');
+nap.env.set('saved', { host: db.host, tags: [ 'a' ] });
+if (nap.env.get('saved').tags[0] !== 'a') nap.fail('expected saved to be read back as an object');
+console.log(nap.env.getString('saved'));`,
+	}
+
+	for file, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	job := runTestFile(t, dir, "kind: routine\nsteps:\n  - run: script.js\n    iterations: env.yml\n  - run: request.yml\n    iterations: env.yml\n    forEach: ${ids}\n", map[string]string{"baseUrl": server.URL, "plain": "[not json"})
+
+	if !job.IsPassing() {
+		t.Fatalf("Expected passing, got errors: %v", job.Errors)
+	}
+
+	output := job.StepResults[0].SubroutineResult.StepResults[0].ScriptResult.ScriptOutput
+	if len(output) != 1 || output[0] != `{"host":"db.local","tags":["a"]}` {
+		t.Errorf("Expected the saved object as json, got %v", output)
+	}
+
+	sort.Strings(paths)
+	expected := []string{"/db.local/5432/grace/1", "/db.local/5432/grace/2"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected paths %v, got %v", expected, paths)
+	}
+}
+
+func TestStructuredValues(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{ "payload": "{\"a\": 1}", "list": "[1]", "user": { "name": "ada" } }`))
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		routine string
+		script  string
+	}{
+		"captured json text stays a string": {
+			routine: "steps:\n  - run: data.yml\n  - run: check.js\n",
+			script:  "if (typeof nap.env.get('payload') !== 'string' || JSON.parse(nap.env.get('payload')).a !== 1) nap.fail('expected payload to be text'); if (nap.env.get('list') !== '[1]') nap.fail('expected list to be text');",
+		},
+		"captured objects are objects": {
+			routine: "steps:\n  - run: data.yml\n  - run: check.js\n",
+			script:  "if (nap.env.get('user').name !== 'ada') nap.fail('expected user to be an object');",
+		},
+		"text set by a script stays a string": {
+			routine: "steps:\n  - run: check.js\n",
+			script:  "nap.env.set('list', '[1]'); if (nap.env.get('list') !== '[1]') nap.fail('expected list to be text');",
+		},
+		"a string parameter stays a string": {
+			routine: "steps:\n  - run: check.js\n",
+			script:  "if (nap.env.get('param') !== '[1]') nap.fail('expected param to be text');",
+		},
+		"forEach objects are objects": {
+			routine: "steps:\n  - run: check.js\n    forEach: ${users}\n",
+			script:  "if (nap.env.get('item').name !== 'ada') nap.fail('expected item to be an object');",
+		},
+		"data file objects are objects": {
+			routine: "steps:\n  - run: check.js\n    iterations: users.json\n",
+			script:  "if (nap.env.get('address').city !== 'paris') nap.fail('expected address to be an object'); if (nap.env.get('tag') !== '[x]') nap.fail('expected tag to be text');",
+		},
+		"exported objects are objects": {
+			routine: "steps:\n  - run: sub.yml\n  - run: check.js\n",
+			script:  "if (nap.env.get('user').name !== 'ada') nap.fail('expected user to be an object'); if (nap.env.get('list') !== '[1]') nap.fail('expected list to be text');",
+		},
+		"captures from parallel steps keep their types": {
+			routine: "parallel: true\nsteps:\n  - run: data.yml\n    id: data\n  - run: check.js\n    needs: data\n",
+			script:  "if (nap.env.get('user').name !== 'ada') nap.fail('expected user to be an object'); if (nap.env.get('list') !== '[1]') nap.fail('expected list to be text');",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := map[string]string{
+				"data.yml":   "kind: request\npath: ${baseUrl}\ncaptures:\n  payload: jsonpath $.payload\n  list: jsonpath $.list\n  user: jsonpath $.user\n",
+				"sub.yml":    "kind: routine\nexports: [user, list]\nsteps:\n  - run: data.yml\n",
+				"users.json": `[ { "address": { "city": "paris" }, "tag": "[x]" } ]`,
+				"check.js":   test.script,
+			}
+
+			for file, contents := range files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result := runTestFile(t, dir, "kind: routine\n"+test.routine, map[string]string{"baseUrl": server.URL, "param": "[1]", "users": `[ { "name": "ada" } ]`})
+
+			if !result.IsPassing() {
+				t.Errorf("Expected passing, got errors: %v", result.Errors)
+			}
+		})
+	}
+}
+
+func TestConcurrencySlots(t *testing.T) {
+	var mu sync.Mutex
+	calls := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, r.URL.Path)
+		retrying := r.URL.Path == "/retrying" && len(calls) == 1
+		mu.Unlock()
+
+		if retrying {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		routine string
+		calls   []string
+	}{
+		"a script can run a request while its own request has the only slot": {
+			routine: "steps:\n  - run: outer.yml\n",
+			calls:   []string{"/outer", "/inner"},
+		},
+		"a retry wait doesn't hold the only slot": {
+			// the delay makes sure the retrying request has the slot first
+			routine: "parallel: true\nsteps:\n  - run: retrying.yml\n  - run: delayed.yml\n",
+			calls:   []string{"/retrying", "/inner", "/retrying"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			mu.Lock()
+			calls = []string{}
+			mu.Unlock()
+
+			dir := t.TempDir()
+			files := map[string]string{
+				"outer.yml":    "kind: request\npath: ${baseUrl}/outer\npostRequestScript: nap.run('inner.yml')\n",
+				"inner.yml":    "kind: request\npath: ${baseUrl}/inner\n",
+				"retrying.yml": "kind: request\npath: ${baseUrl}/retrying\nretry:\n  count: 1\n  delay: 300ms\n  onStatus: [503]\n",
+				"delay.js":     "var end = Date.now() + 50; while (Date.now() < end) {}",
+				"delayed.yml":  "kind: routine\nsteps:\n  - run: delay.js\n  - run: inner.yml\n",
+				"test.yml":     "kind: routine\n" + test.routine,
+			}
+
+			for file, contents := range files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx := napcontext.New("", nil, map[string]string{"baseUrl": server.URL}, nil, true)
+			ctx.SetConcurrency(1)
+
+			done := make(chan *naproutine.RoutineResult, 1)
+			go func() { done <- naprunner.RunPath(ctx, filepath.Join(dir, "test.yml")) }()
+
+			select {
+			case result := <-done:
+				if !result.IsPassing() {
+					t.Fatalf("Expected passing, got errors: %v", result.Errors)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Expected the run to finish, but it's waiting on a request slot")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if !reflect.DeepEqual(calls, test.calls) {
+				t.Errorf("Expected calls %v, got %v", test.calls, calls)
+			}
+		})
+	}
+}
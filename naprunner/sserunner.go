@@ -0,0 +1,160 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+sserunner.go - this file contains logic for collecting server-sent events from a response stream
+*/
+package naprunner
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/davesheldon/nap/naprequest"
+)
+
+// readEventStream collects events from a text/event-stream response until the configured
+// count, timeout or matching event is reached, then closes the stream
+func readEventStream(r *naprequest.Request, result *naprequest.RequestResult) error {
+	var untilData *regexp.Regexp
+	if len(r.SSE.UntilData) > 0 {
+		re, err := regexp.Compile(r.SSE.UntilData)
+		if err != nil {
+			return err
+		}
+		untilData = re
+	}
+
+	raw := new(bytes.Buffer)
+	events := make(chan *naprequest.SSEEvent)
+	done := make(chan error, 1)
+	stop := make(chan struct{})
+
+	go func() {
+		done <- parseEventStream(io.TeeReader(result.HttpResponse.Body, raw), events, stop)
+	}()
+
+	var timeout <-chan time.Time
+	if r.SSE.TimeoutSeconds > 0 {
+		timer := time.NewTimer(time.Duration(r.SSE.TimeoutSeconds) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var streamErr error
+
+collect:
+	for {
+		select {
+		case event := <-events:
+			result.Events = append(result.Events, event)
+
+			if r.SSE.Count > 0 && len(result.Events) >= r.SSE.Count {
+				break collect
+			}
+
+			if len(r.SSE.UntilEvent) > 0 && event.Event == r.SSE.UntilEvent {
+				break collect
+			}
+
+			if untilData != nil && untilData.MatchString(event.Data) {
+				break collect
+			}
+		case err := <-done:
+			// the server closed the stream
+			streamErr = err
+			done = nil
+			break collect
+		case <-timeout:
+			break collect
+		}
+	}
+
+	// closing the body unblocks the parser if it's still waiting on the server
+	close(stop)
+	result.HttpResponse.Body.Close()
+	if done != nil {
+		<-done
+	}
+
+	result.ResponseBody = raw.Bytes()
+	result.ResponseSize = int64(raw.Len())
+
+	return streamErr
+}
+
+// parseEventStream reads events according to the text/event-stream format and sends each one as it's dispatched
+func parseEventStream(reader io.Reader, events chan<- *naprequest.SSEEvent, stop <-chan struct{}) error {
+	scanner := bufio.NewScanner(reader)
+
+	event := new(naprequest.SSEEvent)
+	data := []string{}
+	lastId := ""
+
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+
+		if len(line) == 0 {
+			// a blank line dispatches the event, but only if it carried data
+			if len(data) > 0 {
+				event.Id = lastId
+				event.Data = strings.Join(data, "\n")
+				if len(event.Event) == 0 {
+					event.Event = "message"
+				}
+
+				select {
+				case events <- event:
+				case <-stop:
+					return nil
+				}
+			}
+
+			event = new(naprequest.SSEEvent)
+			data = []string{}
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			// comment
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "event":
+			event.Event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			if !strings.Contains(value, "\x00") {
+				lastId = value
+			}
+		}
+	}
+
+	select {
+	case <-stop:
+		// the stream was closed on purpose
+		return nil
+	default:
+		return scanner.Err()
+	}
+}
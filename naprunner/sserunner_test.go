@@ -0,0 +1,110 @@
+package naprunner_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServerSentEvents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+
+		fmt.Fprint(w, ": connected\n\n")
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(w, "id: %d\nevent: tick\ndata: {\"id\": %d}\n\n", i, i)
+			flusher.Flush()
+		}
+		fmt.Fprint(w, "event: done\ndata: line one\ndata: line two\n\n")
+		flusher.Flush()
+
+		if r.URL.Path == "/open" {
+			// keep the stream open until the client goes away
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		request    string
+		shouldPass bool
+	}{
+		"stops after count": {
+			request: `kind: request
+path: ${baseUrl}/open
+sse:
+  count: 2
+asserts:
+  - events count == 2
+  - event[1] id == 2
+  - event[1] data jsonpath $.id == 2
+`,
+			shouldPass: true,
+		},
+		"stops on matching event": {
+			request: `kind: request
+path: ${baseUrl}/open
+sse:
+  untilEvent: done
+asserts:
+  - events count == 4
+  - event[3] event == done
+  - event[3] data endswith line two
+`,
+			shouldPass: true,
+		},
+		"stops on matching data": {
+			request: `kind: request
+path: ${baseUrl}/open
+sse:
+  untilData: '"id": 3'
+asserts:
+  - events count == 3
+`,
+			shouldPass: true,
+		},
+		"stops after timeout": {
+			request: `kind: request
+path: ${baseUrl}/open
+sse:
+  timeoutSeconds: 1
+asserts:
+  - events count == 4
+`,
+			shouldPass: true,
+		},
+		"stops when the server closes the stream": {
+			request: `kind: request
+path: ${baseUrl}/closed
+sse: {}
+captures:
+  lastType: event[3] type
+asserts:
+  - events count == 4
+  - event[0] type == tick
+`,
+			shouldPass: true,
+		},
+		"failing assert": {
+			request: `kind: request
+path: ${baseUrl}/closed
+sse: {}
+asserts:
+  - events count == 5
+`,
+			shouldPass: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			result := runTestFile(t, t.TempDir(), test.request, map[string]string{"baseUrl": server.URL})
+
+			if result.IsPassing() != test.shouldPass {
+				t.Errorf("Expected passing=%t, got errors: %v", test.shouldPass, result.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+websocketrunner.go - this file contains logic for running a scripted websocket conversation
+*/
+package naprunner
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davesheldon/nap/napcontext"
+	"github.com/davesheldon/nap/naprequest"
+	"github.com/gorilla/websocket"
+)
+
+const defaultWebSocketTimeoutSeconds = 10
+
+type webSocketInbox struct {
+	mu       sync.Mutex
+	messages []*naprequest.WebSocketReceived
+	notify   chan struct{}
+	err      error
+}
+
+func (inbox *webSocketInbox) add(message *naprequest.WebSocketReceived) {
+	inbox.mu.Lock()
+	inbox.messages = append(inbox.messages, message)
+	inbox.mu.Unlock()
+	inbox.wake()
+}
+
+func (inbox *webSocketInbox) fail(err error) {
+	inbox.mu.Lock()
+	inbox.err = err
+	inbox.mu.Unlock()
+	inbox.wake()
+}
+
+func (inbox *webSocketInbox) wake() {
+	select {
+	case inbox.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (inbox *webSocketInbox) snapshot() ([]*naprequest.WebSocketReceived, error) {
+	inbox.mu.Lock()
+	defer inbox.mu.Unlock()
+	return append([]*naprequest.WebSocketReceived{}, inbox.messages...), inbox.err
+}
+
+func executeWebSocket(r *naprequest.Request, result *naprequest.RequestResult, ctx *napcontext.Context, workingDirectory string) (*http.Response, error) {
+	dialer := &websocket.Dialer{
+		Proxy:        http.ProxyFromEnvironment,
+		Subprotocols: r.Subprotocols,
+	}
+
+	if ctx.Transport != nil {
+		dialer.Proxy = ctx.Transport.Proxy
+		dialer.TLSClientConfig = ctx.Transport.TLSClientConfig
+	}
+
+	if timeout := r.Timeout(); timeout > 0 {
+		dialer.HandshakeTimeout = timeout
+	}
+
+	// build the handshake headers the same way an http request would be built
+	handshake, err := http.NewRequest("GET", r.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range r.Headers {
+		handshake.Header.Add(k, v)
+	}
+
+	for k, v := range r.Cookies {
+		handshake.AddCookie(&http.Cookie{Name: k, Value: v})
+	}
+
+	for _, v := range ctx.Cookies {
+		if v != nil {
+			handshake.AddCookie(v)
+		}
+	}
+
+	conn, response, err := dialer.DialContext(ctx.RunContext(), r.Path, handshake.Header)
+	if err != nil {
+		if response != nil {
+			return nil, fmt.Errorf("%w (%s)", err, response.Status)
+		}
+		return nil, err
+	}
+	defer conn.Close()
+
+	inbox := &webSocketInbox{notify: make(chan struct{}, 1)}
+	readerDone := make(chan struct{})
+
+	go func() {
+		defer close(readerDone)
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				inbox.fail(err)
+				return
+			}
+
+			received := &naprequest.WebSocketReceived{Type: "text", Data: data}
+			if messageType == websocket.BinaryMessage {
+				received.Type = "binary"
+			}
+
+			if r.Verbose {
+				fmt.Printf("RECEIVED (%s):\n%s\n", received.Type, ctx.Mask(string(data)))
+			}
+
+			inbox.add(received)
+		}
+	}()
+
+	consumed := 0
+
+	for i, message := range r.Messages {
+		if message.Expect != nil {
+			consumed, err = waitForMessages(r, message.Expect, inbox, consumed)
+			if err != nil {
+				return response, fmt.Errorf("message %d: %w", i+1, err)
+			}
+			continue
+		}
+
+		messageType, data, err := encodeWebSocketMessage(message, workingDirectory)
+		if err != nil {
+			return response, fmt.Errorf("message %d: %w", i+1, err)
+		}
+
+		if r.Verbose {
+			fmt.Printf("SENT:\n%s\n", ctx.Mask(string(data)))
+		}
+
+		if err := conn.WriteMessage(messageType, data); err != nil {
+			return response, fmt.Errorf("message %d: %w", i+1, err)
+		}
+	}
+
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	conn.Close()
+	<-readerDone
+
+	result.Messages, _ = inbox.snapshot()
+
+	return response, nil
+}
+
+func encodeWebSocketMessage(message *naprequest.WebSocketMessage, workingDirectory string) (int, []byte, error) {
+	if message.Json != nil {
+		data, err := json.Marshal(message.Json)
+		return websocket.TextMessage, data, err
+	}
+
+	if len(message.Binary) > 0 {
+		if strings.HasPrefix(message.Binary, "@") {
+			data, err := os.ReadFile(filepath.Join(workingDirectory, message.Binary[1:]))
+			return websocket.BinaryMessage, data, err
+		}
+
+		data, err := base64.StdEncoding.DecodeString(message.Binary)
+		return websocket.BinaryMessage, data, err
+	}
+
+	return websocket.TextMessage, []byte(message.Text), nil
+}
+
+// waitForMessages blocks until the expectation is met by messages received after the consumed index,
+// returning the new consumed index
+func waitForMessages(r *naprequest.Request, expect *naprequest.WebSocketExpect, inbox *webSocketInbox, consumed int) (int, error) {
+	var match *regexp.Regexp
+	if len(expect.Match) > 0 {
+		re, err := regexp.Compile(expect.Match)
+		if err != nil {
+			return consumed, err
+		}
+		match = re
+	}
+
+	count := expect.Count
+	if count == 0 && match == nil {
+		count = 1
+	}
+
+	timeout := time.Duration(expect.TimeoutSeconds) * time.Second
+	if timeout == 0 {
+		timeout = r.Timeout()
+	}
+	if timeout == 0 {
+		timeout = defaultWebSocketTimeoutSeconds * time.Second
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		messages, readErr := inbox.snapshot()
+
+		received := 0
+		for i := consumed; i < len(messages); i++ {
+			received++
+
+			if received >= count && (match == nil || match.Match(messages[i].Data)) {
+				return i + 1, nil
+			}
+		}
+
+		if readErr != nil {
+			return consumed, fmt.Errorf("connection closed while waiting for messages: %w", readErr)
+		}
+
+		select {
+		case <-inbox.notify:
+		case <-timer.C:
+			if match != nil {
+				return consumed, fmt.Errorf("timed out after %s waiting for a message matching \"%s\"", timeout, expect.Match)
+			}
+			return consumed, fmt.Errorf("timed out after %s waiting for %d message(s), received %d", timeout, count, received)
+		}
+	}
+}
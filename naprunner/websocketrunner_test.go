@@ -0,0 +1,113 @@
+package naprunner_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocket(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"notify.v1"}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			if messageType == websocket.TextMessage && strings.Contains(string(data), "subscribe") {
+				conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "subscribed"}`))
+				conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "notification", "id": 7}`))
+				continue
+			}
+
+			conn.WriteMessage(messageType, data)
+		}
+	}))
+	defer server.Close()
+
+	wsUrl := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	tests := map[string]struct {
+		request    string
+		shouldPass bool
+	}{
+		"scripted conversation": {
+			request: `kind: websocket
+url: ${wsUrl}
+headers:
+  Authorization: Bearer abc
+subprotocols:
+  - notify.v1
+messages:
+  - text: hello
+  - expect:
+      count: 1
+  - json:
+      action: subscribe
+  - expect:
+      match: notification
+  - binary: AP9uYXA=
+  - expect: {}
+captures:
+  notificationId: message[2] data jsonpath $.id
+asserts:
+  - status == 101
+  - header Sec-Websocket-Protocol == notify.v1
+  - messages count == 4
+  - message[0] data == hello
+  - message[1] data jsonpath $.type == subscribed
+  - message[2] data jsonpath $.id == 7
+  - message[3] type == binary
+  - message[3] data == AP9uYXA=
+`,
+			shouldPass: true,
+		},
+		"expect times out": {
+			request: `kind: websocket
+url: ${wsUrl}
+headers:
+  Authorization: Bearer abc
+messages:
+  - text: hello
+  - expect:
+      count: 2
+      timeoutSeconds: 1
+`,
+			shouldPass: false,
+		},
+		"handshake rejected": {
+			request: `kind: websocket
+url: ${wsUrl}
+messages:
+  - text: hello
+`,
+			shouldPass: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			result := runTestFile(t, t.TempDir(), test.request, map[string]string{"wsUrl": wsUrl})
+
+			if result.IsPassing() != test.shouldPass {
+				t.Errorf("Expected passing=%t, got errors: %v", test.shouldPass, result.Errors)
+			}
+		})
+	}
+}
@@ -19,8 +19,8 @@ script.go - this file contains data structures and logic for setting up and exec
 package napscript
 
 import (
+	"encoding/base64"
 	"fmt"
-	"io"
 	"net/http"
 	"strings"
 
@@ -50,7 +50,18 @@ func SetupVm(ctx *napcontext.Context, runPath func(*napcontext.Context, string)
 	}
 
 	err = ctx.ScriptContext.Vm.Set("napEnvSet", func(call otto.FunctionCall) otto.Value {
-		ctx.EnvironmentVariables[call.Argument(0).String()] = call.Argument(1).String()
+		value := call.Argument(1)
+
+		// objects and arrays are stored as json, so they can be read back as objects
+		if value.IsObject() {
+			text, err := ctx.ScriptContext.Vm.Call("JSON.stringify", nil, value)
+			if err == nil && text.IsString() {
+				ctx.Variables.SetStructured(call.Argument(0).String(), text.String())
+				return otto.Value{}
+			}
+		}
+
+		ctx.Variables.Set(call.Argument(0).String(), value.String())
 
 		return otto.Value{}
 	})
@@ -60,7 +71,27 @@ func SetupVm(ctx *napcontext.Context, runPath func(*napcontext.Context, string)
 	}
 
 	err = ctx.ScriptContext.Vm.Set("napEnvGet", func(call otto.FunctionCall) otto.Value {
-		result, _ := ctx.ScriptContext.Vm.ToValue(ctx.EnvironmentVariables[call.Argument(0).String()])
+		name := call.Argument(0).String()
+		value := ctx.Variables.Get(name)
+
+		// structured values, such as nested environment values and captured objects, are stored as json
+		// and given to scripts as objects. text is given as it is, even when it looks like json
+		if ctx.Variables.IsStructured(name) {
+			if result, err := ctx.ScriptContext.Vm.Call("JSON.parse", nil, value); err == nil {
+				return result
+			}
+		}
+
+		result, _ := ctx.ScriptContext.Vm.ToValue(value)
+		return result
+	})
+
+	if err != nil {
+		return err
+	}
+
+	err = ctx.ScriptContext.Vm.Set("napEnvGetString", func(call otto.FunctionCall) otto.Value {
+		result, _ := ctx.ScriptContext.Vm.ToValue(ctx.Variables.Get(call.Argument(0).String()))
 		return result
 	})
 
@@ -92,7 +123,7 @@ func SetupVm(ctx *napcontext.Context, runPath func(*napcontext.Context, string)
 		}
 
 		for _, v := range vals {
-			ctx.ScriptContext.Output = append(ctx.ScriptContext.Output, v)
+			ctx.ScriptContext.Output = append(ctx.ScriptContext.Output, ctx.Mask(v))
 		}
 
 		return otto.Value{}
@@ -104,6 +135,7 @@ func SetupVm(ctx *napcontext.Context, runPath func(*napcontext.Context, string)
 var nap = { 
 	env: { 
 		get: napEnvGet, 
+		getString: napEnvGetString,
 		set: napEnvSet
 	}, 
 	run: napRun,
@@ -111,6 +143,7 @@ var nap = {
 };
 
 napEnvGet = undefined;
+napEnvGetString = undefined;
 napEnvSet = undefined;
 napRun = undefined;
 napFail = undefined;
@@ -158,13 +191,37 @@ type VmHttpRequest struct {
 }
 
 type VmHttpResponse struct {
-	StatusCode int                      `json:"statusCode"`
-	Status     string                   `json:"status"`
-	Body       string                   `json:"body"`
-	JsonBody   interface{}              `json:"jsonBody"`
-	Headers    map[string][]interface{} `json:"headers"`
-	Cookies    map[string]*http.Cookie  `json:"cookies"`
-	ElapsedMs  int64
+	StatusCode  int                      `json:"statusCode"`
+	Status      string                   `json:"status"`
+	Body        string                   `json:"body"`
+	JsonBody    interface{}              `json:"jsonBody"`
+	Headers     map[string][]interface{} `json:"headers"`
+	Cookies     map[string]*http.Cookie  `json:"cookies"`
+	ElapsedMs   int64
+	Size        int64                    `json:"size"`
+	Truncated   bool                     `json:"truncated"`
+	Sha256      string                   `json:"sha256"`
+	Md5         string                   `json:"md5"`
+	JsonValid   bool                     `json:"jsonValid"`
+	JsonError   string                   `json:"jsonError"`
+	Events      []*VmSseEvent            `json:"events"`
+	Messages    []*VmWsMessage           `json:"messages"`
+	Trailers    map[string][]interface{} `json:"trailers"`
+	GrpcStatus  string                   `json:"grpcStatus"`
+	GrpcMessage string                   `json:"grpcMessage"`
+}
+
+type VmWsMessage struct {
+	Type     string      `json:"type"`
+	Data     string      `json:"data"`
+	JsonData interface{} `json:"jsonData"`
+}
+
+type VmSseEvent struct {
+	Id       string      `json:"id"`
+	Event    string      `json:"event"`
+	Data     string      `json:"data"`
+	JsonData interface{} `json:"jsonData"`
 }
 
 func MapVmHttpData(result *naprequest.RequestResult) (*VmHttpData, error) {
@@ -177,21 +234,62 @@ func MapVmHttpData(result *naprequest.RequestResult) (*VmHttpData, error) {
 	data.Request.Headers = result.Request.Headers
 	data.Request.Cookies = result.Request.Cookies
 
+	if result.GrpcResponse != nil {
+		data.Response = new(VmHttpResponse)
+		data.Response.StatusCode = result.GrpcResponse.Code
+		data.Response.Status = result.GrpcResponse.Status
+		data.Response.GrpcStatus = result.GrpcResponse.Status
+		data.Response.GrpcMessage = result.GrpcResponse.Message
+		data.Response.ElapsedMs = result.GetElapsedMs()
+		data.Response.Body = string(result.ResponseBody)
+		data.Response.Size = result.ResponseSize
+		data.Response.Headers = mapMetadata(result.GrpcResponse.Headers)
+		data.Response.Trailers = mapMetadata(result.GrpcResponse.Trailers)
+		data.Response.Cookies = map[string]*http.Cookie{}
+
+		if len(result.ResponseBody) > 0 {
+			if err := json.Unmarshal(result.ResponseBody, &data.Response.JsonBody); err != nil {
+				data.Response.JsonError = err.Error()
+			} else {
+				data.Response.JsonValid = true
+			}
+		}
+	}
+
 	if result.HttpResponse != nil {
 		data.Response = new(VmHttpResponse)
 		data.Response.StatusCode = result.HttpResponse.StatusCode
 		data.Response.Status = result.HttpResponse.Status
 		data.Response.ElapsedMs = result.GetElapsedMs()
 
-		bodyBytes, err := io.ReadAll(result.HttpResponse.Body)
-
-		if err != nil {
-			return nil, err
-		}
+		bodyBytes := result.ResponseBody
 
 		data.Response.Body = string(bodyBytes)
+		data.Response.Size = result.ResponseSize
+		data.Response.Truncated = result.ResponseTruncated
+		data.Response.Sha256 = result.ResponseSha256
+		data.Response.Md5 = result.ResponseMd5
+
+		for _, v := range result.Events {
+			event := &VmSseEvent{Id: v.Id, Event: v.Event, Data: v.Data}
+			if err := json.Unmarshal([]byte(v.Data), &event.JsonData); err != nil {
+				event.JsonData = nil
+			}
+			data.Response.Events = append(data.Response.Events, event)
+		}
 
-		defer result.HttpResponse.Body.Close()
+		for _, v := range result.Messages {
+			message := &VmWsMessage{Type: v.Type}
+			if v.Type == "binary" {
+				message.Data = base64.StdEncoding.EncodeToString(v.Data)
+			} else {
+				message.Data = string(v.Data)
+				if err := json.Unmarshal(v.Data, &message.JsonData); err != nil {
+					message.JsonData = nil
+				}
+			}
+			data.Response.Messages = append(data.Response.Messages, message)
+		}
 
 		data.Response.Cookies = map[string]*http.Cookie{}
 		responseCookies := result.HttpResponse.Cookies()
@@ -211,9 +309,13 @@ func MapVmHttpData(result *naprequest.RequestResult) (*VmHttpData, error) {
 				}
 
 				if k == "Content-Type" && strings.Contains(v[0], "json") {
-					err = json.Unmarshal(bodyBytes, &data.Response.JsonBody)
-					if err != nil {
-						return nil, err
+					// a malformed body shouldn't fail the request outright; it's exposed
+					// to the jsonvalid/jsonerror queries so it can be asserted on instead
+					if err := json.Unmarshal(bodyBytes, &data.Response.JsonBody); err != nil {
+						data.Response.JsonBody = nil
+						data.Response.JsonError = err.Error()
+					} else {
+						data.Response.JsonValid = true
 					}
 				}
 			}
@@ -222,3 +324,16 @@ func MapVmHttpData(result *naprequest.RequestResult) (*VmHttpData, error) {
 
 	return data, nil
 }
+
+func mapMetadata(md map[string][]string) map[string][]any {
+	mapped := map[string][]any{}
+
+	for k, v := range md {
+		mapped[k] = make([]any, len(v))
+		for i, val := range v {
+			mapped[k][i] = val
+		}
+	}
+
+	return mapped
+}
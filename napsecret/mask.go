@@ -0,0 +1,92 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+mask.go - this file contains logic for hiding secrets in output
+*/
+package napsecret
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secrets in output
+const Redacted = "********"
+
+// Masker hides known secrets in text. it's safe to use from several goroutines at once, and a nil masker
+// hides nothing
+type Masker struct {
+	mu       sync.RWMutex
+	secrets  map[string]bool
+	replacer *strings.Replacer
+}
+
+func NewMasker() *Masker {
+	return &Masker{secrets: make(map[string]bool)}
+}
+
+// Add records secrets to hide. empty secrets are ignored
+func (masker *Masker) Add(secrets ...string) {
+	if masker == nil {
+		return
+	}
+
+	masker.mu.Lock()
+	defer masker.mu.Unlock()
+
+	for _, v := range secrets {
+		if len(v) > 0 {
+			masker.secrets[v] = true
+		}
+	}
+
+	// longer secrets go first, so one that contains another is hidden whole
+	sorted := make([]string, 0, len(masker.secrets))
+	for k := range masker.secrets {
+		sorted = append(sorted, k)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+
+		return sorted[i] < sorted[j]
+	})
+
+	pairs := make([]string, 0, len(sorted)*2)
+	for _, v := range sorted {
+		pairs = append(pairs, v, Redacted)
+	}
+
+	masker.replacer = strings.NewReplacer(pairs...)
+}
+
+// Mask returns text with every known secret replaced
+func (masker *Masker) Mask(text string) string {
+	if masker == nil {
+		return text
+	}
+
+	masker.mu.RLock()
+	defer masker.mu.RUnlock()
+
+	if masker.replacer == nil {
+		return text
+	}
+
+	return masker.replacer.Replace(text)
+}
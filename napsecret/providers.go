@@ -0,0 +1,91 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+providers.go - this file contains the built-in secret providers
+*/
+package napsecret
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// FileProvider reads a secret from a file, such as a docker or kubernetes secret mount. a trailing line
+// break is removed
+type FileProvider struct{}
+
+func (FileProvider) Get(reference string) (string, error) {
+	data, err := os.ReadFile(reference)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// CommandProvider runs a shell command, such as a password manager's cli, and uses what it prints. a
+// trailing line break is removed
+type CommandProvider struct{}
+
+func (CommandProvider) Get(reference string) (string, error) {
+	var command *exec.Cmd
+	if runtime.GOOS == "windows" {
+		command = exec.Command("cmd", "/C", reference)
+	} else {
+		command = exec.Command("sh", "-c", reference)
+	}
+
+	var stderr bytes.Buffer
+	command.Stderr = &stderr
+
+	output, err := command.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); len(message) > 0 {
+			return "", fmt.Errorf("%w: %s", err, message)
+		}
+
+		return "", err
+	}
+
+	return strings.TrimRight(string(output), "\r\n"), nil
+}
+
+// EnvProvider reads a secret from an environment variable of the nap process
+type EnvProvider struct{}
+
+func (EnvProvider) Get(reference string) (string, error) {
+	value, ok := os.LookupEnv(reference)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", reference)
+	}
+
+	return value, nil
+}
+
+// StaticProvider serves secrets from a map. it stands in for a real backend, e.g. in tests or local runs
+type StaticProvider map[string]string
+
+func (provider StaticProvider) Get(reference string) (string, error) {
+	value, ok := provider[reference]
+	if !ok {
+		return "", fmt.Errorf("secret %s not found", reference)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+secret.go - this file contains logic for resolving references to secrets from pluggable providers
+*/
+package napsecret
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Provider looks up secrets from one backend, such as files or a vault
+type Provider interface {
+	// Get returns the secret a reference points to. what a reference looks like is up to the provider,
+	// e.g. a file path or a command
+	Get(reference string) (string, error)
+}
+
+var secretRegex = regexp.MustCompile(`\$\{\s*secret:([A-Za-z0-9_\-]+):([^}]*)\}`)
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]Provider{
+		"file": FileProvider{},
+		"cmd":  CommandProvider{},
+		"env":  EnvProvider{},
+	}
+)
+
+// Register adds a provider, or replaces the one with the same name. its secrets are referenced as
+// ${secret:<name>:<reference>}
+func Register(name string, provider Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	providers[name] = provider
+}
+
+// Unregister removes a provider
+func Unregister(name string) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	delete(providers, name)
+}
+
+func getProvider(name string) (Provider, bool) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	provider, ok := providers[name]
+	return provider, ok
+}
+
+// Contains reports whether text has any secret references in it
+func Contains(text string) bool {
+	return secretRegex.MatchString(text)
+}
+
+// Substitute replaces each ${secret:<provider>:<reference>} in text with the secret it points to. it
+// returns the secrets it found too, so they can be masked
+func Substitute(text string) (string, []string, error) {
+	secrets := []string{}
+	var err error
+
+	result := secretRegex.ReplaceAllStringFunc(text, func(match string) string {
+		if err != nil {
+			return match
+		}
+
+		parts := secretRegex.FindStringSubmatch(match)
+		name, reference := parts[1], strings.TrimSpace(parts[2])
+
+		provider, ok := getProvider(name)
+		if !ok {
+			err = fmt.Errorf("unknown secret provider %q (must be one of %s)", name, strings.Join(providerNames(), ", "))
+			return match
+		}
+
+		secret, getErr := provider.Get(reference)
+		if getErr != nil {
+			// the reference is left out, in case it holds something sensitive itself
+			err = fmt.Errorf("cannot get %s secret: %w", name, getErr)
+			return match
+		}
+
+		secrets = append(secrets, secret)
+		return secret
+	})
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	return result, secrets, nil
+}
+
+func providerNames() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	names := make([]string, 0, len(providers))
+	for k := range providers {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
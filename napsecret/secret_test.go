@@ -0,0 +1,102 @@
+package napsecret_test
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/davesheldon/nap/napsecret"
+)
+
+func TestSubstitute(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "token"), []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("NAP_SECRET_TEST", "from-env")
+
+	napsecret.Register("vault", napsecret.StaticProvider{"api/token": "from-vault"})
+	defer napsecret.Unregister("vault")
+
+	tests := map[string]struct {
+		text     string
+		expected string
+		secrets  []string
+		err      string
+		unix     bool
+	}{
+		"no secrets":        {text: "plain ${name}", expected: "plain ${name}", secrets: []string{}},
+		"file":              {text: "${secret:file:" + filepath.Join(dir, "token") + "}", expected: "from-file", secrets: []string{"from-file"}},
+		"env":               {text: "Bearer ${secret:env:NAP_SECRET_TEST}", expected: "Bearer from-env", secrets: []string{"from-env"}},
+		"command":           {text: "${secret:cmd:echo from-cmd}", expected: "from-cmd", secrets: []string{"from-cmd"}, unix: true},
+		"registered":        {text: "${secret:vault:api/token}", expected: "from-vault", secrets: []string{"from-vault"}},
+		"several":           {text: "${secret:vault:api/token}:${secret:env:NAP_SECRET_TEST}", expected: "from-vault:from-env", secrets: []string{"from-vault", "from-env"}},
+		"unknown provider":  {text: "${secret:nope:x}", err: `unknown secret provider "nope"`},
+		"missing file":      {text: "${secret:file:" + filepath.Join(dir, "nope") + "}", err: "cannot get file secret"},
+		"missing env":       {text: "${secret:env:NAP_SECRET_TEST_NOPE}", err: "environment variable NAP_SECRET_TEST_NOPE is not set"},
+		"missing secret":    {text: "${secret:vault:nope}", err: "secret nope not found"},
+		"failing command":   {text: "${secret:cmd:echo oops >&2; exit 3}", err: "oops", unix: true},
+		"other expressions": {text: "${name:-x} ${secret:vault:api/token}", expected: "${name:-x} from-vault", secrets: []string{"from-vault"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if test.unix && runtime.GOOS == "windows" {
+				t.Skip("uses a unix shell")
+			}
+
+			actual, secrets, err := napsecret.Substitute(test.text)
+
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if actual != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, actual)
+			}
+
+			if strings.Join(secrets, ",") != strings.Join(test.secrets, ",") {
+				t.Errorf("Expected secrets %v, got %v", test.secrets, secrets)
+			}
+		})
+	}
+}
+
+func TestMasker(t *testing.T) {
+	tests := map[string]struct {
+		secrets  []string
+		text     string
+		expected string
+	}{
+		"nothing to mask":   {text: "Authorization: Bearer abc", expected: "Authorization: Bearer abc"},
+		"masks every match": {secrets: []string{"abc"}, text: "abc and abc", expected: "******** and ********"},
+		"longest first":     {secrets: []string{"abc", "abcdef"}, text: "abcdef abc", expected: "******** ********"},
+		"empty is ignored":  {secrets: []string{""}, text: "abc", expected: "abc"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			masker := napsecret.NewMasker()
+			masker.Add(test.secrets...)
+
+			if actual := masker.Mask(test.text); actual != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, actual)
+			}
+		})
+	}
+
+	var masker *napsecret.Masker
+	if actual := masker.Mask("abc"); actual != "abc" {
+		t.Errorf("Expected a nil masker to mask nothing, got %s", actual)
+	}
+}
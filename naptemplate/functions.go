@@ -0,0 +1,149 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+functions.go - this file contains the built-in functions available to templates
+*/
+package naptemplate
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"time"
+)
+
+type function func(arguments []string) (string, error)
+
+var functions = map[string]function{
+	"uuid":      uuidFunction,
+	"now":       nowFunction,
+	"randomInt": randomIntFunction,
+	"base64":    base64Function,
+	"env":       envFunction,
+}
+
+var timeLayouts = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"Kitchen":     time.Kitchen,
+}
+
+func expectArguments(arguments []string, min int, max int) error {
+	if len(arguments) < min || len(arguments) > max {
+		if min == max {
+			return fmt.Errorf("expected %d arguments, got %d", min, len(arguments))
+		}
+
+		return fmt.Errorf("expected %d to %d arguments, got %d", min, max, len(arguments))
+	}
+
+	return nil
+}
+
+// uuidFunction returns a random version 4 uuid
+func uuidFunction(arguments []string) (string, error) {
+	if err := expectArguments(arguments, 0, 0); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// nowFunction returns the current time, formatted with a named layout such as RFC3339 (the default), unix,
+// unixMilli or a go time layout
+func nowFunction(arguments []string) (string, error) {
+	if err := expectArguments(arguments, 0, 1); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	if len(arguments) == 0 {
+		return now.Format(time.RFC3339), nil
+	}
+
+	switch arguments[0] {
+	case "unix":
+		return strconv.FormatInt(now.Unix(), 10), nil
+	case "unixMilli":
+		return strconv.FormatInt(now.UnixMilli(), 10), nil
+	}
+
+	if layout, ok := timeLayouts[arguments[0]]; ok {
+		return now.Format(layout), nil
+	}
+
+	return now.Format(arguments[0]), nil
+}
+
+// randomIntFunction returns a random integer between min and max, inclusive
+func randomIntFunction(arguments []string) (string, error) {
+	if err := expectArguments(arguments, 2, 2); err != nil {
+		return "", err
+	}
+
+	min, err := strconv.ParseInt(arguments[0], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid min: %s", arguments[0])
+	}
+
+	max, err := strconv.ParseInt(arguments[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid max: %s", arguments[1])
+	}
+
+	if max < min {
+		return "", fmt.Errorf("max %d is less than min %d", max, min)
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(max-min+1))
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(min+n.Int64(), 10), nil
+}
+
+func base64Function(arguments []string) (string, error) {
+	if err := expectArguments(arguments, 1, 1); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString([]byte(arguments[0])), nil
+}
+
+// envFunction returns the value of an environment variable of the nap process
+func envFunction(arguments []string) (string, error) {
+	if err := expectArguments(arguments, 1, 1); err != nil {
+		return "", err
+	}
+
+	return os.Getenv(arguments[0]), nil
+}
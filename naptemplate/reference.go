@@ -0,0 +1,109 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+reference.go - this file contains logic for reporting references that couldn't be resolved
+*/
+package naptemplate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var variablePathRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_\-]*(?:\.[A-Za-z0-9_\-]+|\[\d+\])*$`)
+
+// Reference is an expression that was left as it is because a variable it refers to isn't set, or because
+// it calls a function that doesn't exist
+type Reference struct {
+	// the variable's name, or the whole expression for a function call
+	Name     string
+	Function bool
+
+	// the yaml field the reference is in, e.g. headers.Authorization or steps[0].run, and its position in
+	// the file. these are only set by RenderYaml
+	Field  string
+	Line   int
+	Column int
+
+	offset int
+	source string
+}
+
+// newReference returns a reference for an expression that couldn't be resolved, or nil if the expression
+// doesn't look like a variable reference or function call, e.g. a javascript template literal in a script
+func newReference(expression string, offset int, source string) *Reference {
+	name, _, _ := splitOperator(strings.TrimSpace(expression))
+
+	if variablePathRegex.MatchString(name) {
+		return &Reference{Name: name, offset: offset, source: source}
+	}
+
+	if open := strings.Index(name, "("); open > 0 && strings.HasSuffix(name, ")") && identifierRegex.MatchString(strings.TrimSpace(name[:open])) {
+		return &Reference{Name: name, Function: true, offset: offset, source: source}
+	}
+
+	return nil
+}
+
+func (reference *Reference) Error() string {
+	if reference.Line > 0 {
+		return fmt.Sprintf("line %d, column %d: %s", reference.Line, reference.Column, reference.message())
+	}
+
+	return reference.message()
+}
+
+func (reference *Reference) message() string {
+	message := fmt.Sprintf("undefined variable %s", reference.Name)
+	if reference.Function {
+		message = fmt.Sprintf("cannot evaluate ${%s}: a variable it uses isn't set or the function doesn't exist", reference.Name)
+	}
+
+	if len(reference.Field) > 0 {
+		message += fmt.Sprintf(" (in %s)", reference.Field)
+	}
+
+	return message
+}
+
+// UndefinedError lists the references in a file that couldn't be resolved
+type UndefinedError struct {
+	Path       string
+	References []*Reference
+}
+
+// Undefined returns an error listing the references, or nil if there are none
+func Undefined(path string, references []*Reference) error {
+	if len(references) == 0 {
+		return nil
+	}
+
+	return &UndefinedError{Path: path, References: references}
+}
+
+func (e *UndefinedError) Error() string {
+	messages := make([]string, 0, len(e.References))
+
+	for _, v := range e.References {
+		if v.Line > 0 {
+			messages = append(messages, fmt.Sprintf("%s:%d:%d: %s", e.Path, v.Line, v.Column, v.message()))
+		} else {
+			messages = append(messages, fmt.Sprintf("%s: %s", e.Path, v.message()))
+		}
+	}
+
+	return strings.Join(messages, "; ")
+}
@@ -0,0 +1,463 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+template.go - this file contains logic for substituting ${...} expressions into text
+*/
+package naptemplate
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Lookup finds a variable's value and reports whether it's set
+type Lookup func(name string) (string, bool)
+
+var identifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_\-]*$`)
+var pathSegmentRegex = regexp.MustCompile(`^([^\[\]]*)((?:\[\d+\])*)$`)
+var indexRegex = regexp.MustCompile(`\[(\d+)\]`)
+
+// Render substitutes every ${...} expression in text. an expression may be:
+//
+//	${name}                 the variable's value
+//	${user.address.city}    a value inside a variable holding json, such as a structured capture
+//	${name:-default}        the variable's value, or default when it's unset or empty
+//	${name:?message}        the variable's value, or an error with message when it's unset or empty
+//	${uuid()}               the result of a built-in function
+//
+// references to variables that aren't set are left as they are
+func Render(text string, lookup Lookup) (string, error) {
+	value, _, err := render(text, lookup)
+	return value, err
+}
+
+// RenderReferences renders text like Render does, and also returns the references that couldn't be resolved
+func RenderReferences(text string, lookup Lookup) (string, []*Reference, error) {
+	return render(text, lookup)
+}
+
+// Substitute evaluates every ${...} expression in text like Render does, but lets replace decide what takes
+// each one's place. replace gets the text since the previous expression, the expression's value and whether
+// it could be resolved. it's for text that values can't be pasted into as they are, such as javascript
+func Substitute(text string, lookup Lookup, replace func(before string, value string, ok bool) string) (string, error) {
+	var sb strings.Builder
+	last := 0
+
+	err := walk(text, lookup, func(start int, end int, expression string, value string, ok bool) {
+		sb.WriteString(replace(text[last:start], value, ok))
+		last = end
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	sb.WriteString(text[last:])
+
+	return sb.String(), nil
+}
+
+// render substitutes the expressions in text and returns the references it couldn't resolve, with their
+// offsets into text
+func render(text string, lookup Lookup) (string, []*Reference, error) {
+	var sb strings.Builder
+	unresolved := []*Reference{}
+	last := 0
+
+	err := walk(text, lookup, func(start int, end int, expression string, value string, ok bool) {
+		sb.WriteString(text[last:start])
+		last = end
+
+		if ok {
+			sb.WriteString(value)
+			return
+		}
+
+		sb.WriteString(text[start:end])
+
+		if reference := newReference(expression, start, text[start:end]); reference != nil {
+			unresolved = append(unresolved, reference)
+		}
+	})
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	sb.WriteString(text[last:])
+
+	return sb.String(), unresolved, nil
+}
+
+// walk evaluates each expression in text in order, and calls visit with where it starts and ends, the
+// expression inside the braces and its value
+func walk(text string, lookup Lookup, visit func(start int, end int, expression string, value string, ok bool)) error {
+	offset := 0
+
+	for {
+		start := strings.Index(text[offset:], "${")
+		if start < 0 {
+			return nil
+		}
+
+		start += offset
+
+		end := findClosingBrace(text, start+2)
+		if end < 0 {
+			return nil
+		}
+
+		expression := text[start+2 : end]
+		value, ok, err := eval(expression, lookup)
+		if err != nil {
+			return err
+		}
+
+		visit(start, end+1, expression, value, ok)
+		offset = end + 1
+	}
+}
+
+// findClosingBrace returns the index of the } that closes an expression, skipping nested expressions and
+// quoted function arguments, or -1 if the expression isn't closed
+func findClosingBrace(text string, from int) int {
+	depth := 0
+	parens := 0
+	var quote byte
+
+	for i := from; i < len(text); i++ {
+		c := text[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && parens > 0:
+			quote = c
+		case c == '(':
+			parens++
+		case c == ')' && parens > 0:
+			parens--
+		case c == '$' && i+1 < len(text) && text[i+1] == '{':
+			depth++
+			i++
+		case c == '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+
+	return -1
+}
+
+// eval evaluates one expression. it reports false when the expression refers to a variable that isn't set
+func eval(expression string, lookup Lookup) (string, bool, error) {
+	expression = strings.TrimSpace(expression)
+
+	name, operator, operand := splitOperator(expression)
+
+	value, ok, err := evalValue(name, lookup)
+	if err != nil {
+		return "", false, err
+	}
+
+	switch operator {
+	case ":-":
+		if !ok || len(value) == 0 {
+			value, err := Render(operand, lookup)
+			return value, err == nil, err
+		}
+	case ":?":
+		if !ok || len(value) == 0 {
+			message := operand
+			if len(message) == 0 {
+				message = "is not set"
+			}
+
+			return "", false, fmt.Errorf("%s: %s", name, message)
+		}
+	}
+
+	return value, ok, nil
+}
+
+// splitOperator splits an expression such as name:-default into its parts
+func splitOperator(expression string) (string, string, string) {
+	from := 0
+
+	// quoted literals and function arguments may contain anything, so the operator comes after them
+	if len(expression) > 0 && (expression[0] == '"' || expression[0] == '\'') {
+		if close := strings.IndexByte(expression[1:], expression[0]); close >= 0 {
+			from = close + 2
+		}
+	} else if open := strings.Index(expression, "("); open > 0 && identifierRegex.MatchString(expression[:open]) {
+		if close := findClosingParen(expression, open+1); close >= 0 {
+			from = close + 1
+		}
+	}
+
+	end := -1
+	for _, operator := range []string{":-", ":?"} {
+		if i := strings.Index(expression[from:], operator); i >= 0 && (end < 0 || from+i < end) {
+			end = from + i
+		}
+	}
+
+	if end < 0 {
+		return expression, "", ""
+	}
+
+	return strings.TrimSpace(expression[:end]), expression[end : end+2], expression[end+2:]
+}
+
+func findClosingParen(text string, from int) int {
+	depth := 0
+	var quote byte
+
+	for i := from; i < len(text); i++ {
+		c := text[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+
+	return -1
+}
+
+// evalValue evaluates a function call, a literal or a variable reference
+func evalValue(expression string, lookup Lookup) (string, bool, error) {
+	if len(expression) == 0 {
+		return "", false, nil
+	}
+
+	if expression[0] == '"' || expression[0] == '\'' {
+		value, err := unquote(expression)
+		return value, err == nil, err
+	}
+
+	if _, err := strconv.ParseFloat(expression, 64); err == nil {
+		return expression, true, nil
+	}
+
+	if open := strings.Index(expression, "("); open > 0 && strings.HasSuffix(expression, ")") {
+		name := strings.TrimSpace(expression[:open])
+		if identifierRegex.MatchString(name) {
+			return evalFunction(name, expression[open+1:len(expression)-1], lookup)
+		}
+	}
+
+	value, ok := lookupPath(expression, lookup)
+	return value, ok, nil
+}
+
+func unquote(literal string) (string, error) {
+	if len(literal) < 2 || literal[len(literal)-1] != literal[0] {
+		return "", fmt.Errorf("unterminated string: %s", literal)
+	}
+
+	if literal[0] == '\'' {
+		return literal[1 : len(literal)-1], nil
+	}
+
+	return strconv.Unquote(literal)
+}
+
+// evalFunction calls a built-in function with its arguments evaluated. like an unset variable, a call to a
+// function that doesn't exist or with an argument that isn't set is left as it is
+func evalFunction(name string, argumentText string, lookup Lookup) (string, bool, error) {
+	function, ok := functions[name]
+	if !ok {
+		return "", false, nil
+	}
+
+	arguments := []string{}
+
+	for _, v := range splitArguments(argumentText) {
+		value, ok, err := evalValue(strings.TrimSpace(v), lookup)
+		if err != nil {
+			return "", false, fmt.Errorf("%s: %w", name, err)
+		}
+
+		if !ok {
+			return "", false, nil
+		}
+
+		arguments = append(arguments, value)
+	}
+
+	value, err := function(arguments)
+	if err != nil {
+		return "", false, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return value, true, nil
+}
+
+// splitArguments splits function arguments on the commas that aren't inside quotes or nested calls
+func splitArguments(text string) []string {
+	if len(strings.TrimSpace(text)) == 0 {
+		return []string{}
+	}
+
+	arguments := []string{}
+	depth := 0
+	start := 0
+	var quote byte
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			arguments = append(arguments, text[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(arguments, text[start:])
+}
+
+// lookupPath finds a variable by its full name, or failing that, follows a dotted path such as
+// user.roles[0].name into a variable that holds json
+func lookupPath(path string, lookup Lookup) (string, bool) {
+	if value, ok := lookup(path); ok {
+		return value, true
+	}
+
+	segments := strings.Split(path, ".")
+
+	root, indexes, ok := parseSegment(segments[0])
+	if !ok {
+		return "", false
+	}
+
+	text, ok := lookup(root)
+	if !ok || (len(segments) == 1 && len(indexes) == 0) {
+		return "", false
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return "", false
+	}
+
+	if value, ok = index(value, indexes); !ok {
+		return "", false
+	}
+
+	for _, segment := range segments[1:] {
+		key, indexes, ok := parseSegment(segment)
+		if !ok {
+			return "", false
+		}
+
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+
+		if value, ok = object[key]; !ok {
+			return "", false
+		}
+
+		if value, ok = index(value, indexes); !ok {
+			return "", false
+		}
+	}
+
+	return stringify(value)
+}
+
+// parseSegment splits a path segment such as roles[0] into its key and indexes
+func parseSegment(segment string) (string, []int, bool) {
+	matches := pathSegmentRegex.FindStringSubmatch(segment)
+	if matches == nil || len(matches[1]) == 0 {
+		return "", nil, false
+	}
+
+	indexes := []int{}
+	for _, v := range indexRegex.FindAllStringSubmatch(matches[2], -1) {
+		i, _ := strconv.Atoi(v[1])
+		indexes = append(indexes, i)
+	}
+
+	return matches[1], indexes, true
+}
+
+func index(value interface{}, indexes []int) (interface{}, bool) {
+	for _, i := range indexes {
+		list, ok := value.([]interface{})
+		if !ok || i >= len(list) {
+			return nil, false
+		}
+
+		value = list[i]
+	}
+
+	return value, true
+}
+
+// stringify turns a value found in json into text. strings are used as they are, null becomes an empty
+// string and anything else is written as json
+func stringify(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", true
+	case string:
+		return v, true
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+
+		return string(data), true
+	}
+}
@@ -0,0 +1,241 @@
+package naptemplate_test
+
+import (
+	"encoding/base64"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davesheldon/nap/naptemplate"
+	"gopkg.in/yaml.v2"
+)
+
+var variables = map[string]string{
+	"name":   "nap",
+	"empty":  "",
+	"tricky": "a: b # c",
+	"user":   `{ "name": "ada", "address": { "city": "London" }, "roles": [ { "name": "admin" }, { "name": "user" } ], "age": 36, "tags": [ "a", "b" ], "none": null }`,
+	"ids":    `[ 1, 2, 3 ]`,
+	"a.b":    "dotted",
+}
+
+func lookup(name string) (string, bool) {
+	value, ok := variables[name]
+	return value, ok
+}
+
+func TestRender(t *testing.T) {
+	os.Setenv("NAP_TEMPLATE_TEST", "from os")
+
+	tests := map[string]struct {
+		text     string
+		expected string
+		pattern  string
+		err      string
+	}{
+		"plain text":                {text: "no expressions", expected: "no expressions"},
+		"variable":                  {text: "hello ${name}!", expected: "hello nap!"},
+		"several variables":         {text: "${name}/${name}", expected: "nap/nap"},
+		"undefined is left":         {text: "hello ${nope}", expected: "hello ${nope}"},
+		"unclosed is left":          {text: "hello ${name", expected: "hello ${name"},
+		"whitespace":                {text: "${ name }", expected: "nap"},
+		"default when unset":        {text: "${nope:-fallback}", expected: "fallback"},
+		"default when empty":        {text: "${empty:-fallback}", expected: "fallback"},
+		"default not used":          {text: "${name:-fallback}", expected: "nap"},
+		"empty default":             {text: "[${nope:-}]", expected: "[]"},
+		"nested default":            {text: "${nope:-${name}-x}", expected: "nap-x"},
+		"default with apostrophe":   {text: "${nope:-it's}", expected: "it's"},
+		"required when set":         {text: "${name:?name is required}", expected: "nap"},
+		"required when unset":       {text: "${nope:?nope is required}", err: "nope: nope is required"},
+		"required when empty":       {text: "${empty:?}", err: "empty: is not set"},
+		"dotted name":               {text: "${a.b}", expected: "dotted"},
+		"nested lookup":             {text: "${user.address.city}", expected: "London"},
+		"nested index":              {text: "${user.roles[1].name}", expected: "user"},
+		"top level index":           {text: "${ids[2]}", expected: "3"},
+		"nested number":             {text: "${user.age}", expected: "36"},
+		"nested list":               {text: "${user.tags}", expected: `["a","b"]`},
+		"nested null":               {text: "[${user.none}]", expected: "[]"},
+		"nested missing":            {text: "${user.nope}", expected: "${user.nope}"},
+		"nested out of range":       {text: "${ids[5]}", expected: "${ids[5]}"},
+		"nested lookup default":     {text: "${user.nope:-none}", expected: "none"},
+		"uuid":                      {text: "${uuid()}", pattern: `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		"now":                       {text: "${now()}", pattern: `^\d{4}-\d{2}-\d{2}T`},
+		"now with layout":           {text: `${now("unix")}`, pattern: `^\d+$`},
+		"now with go layout":        {text: `${now("2006")}`, expected: strconv.Itoa(time.Now().Year())},
+		"random int":                {text: "${randomInt(5, 5)}", expected: "5"},
+		"random int range":          {text: "${randomInt(1,3)}", pattern: `^[123]$`},
+		"random int invalid":        {text: "${randomInt(3, 1)}", err: "randomInt: max 1 is less than min 3"},
+		"base64 of variable":        {text: "${base64(name)}", expected: base64.StdEncoding.EncodeToString([]byte("nap"))},
+		"base64 of literal":         {text: `${base64("a:b")}`, expected: base64.StdEncoding.EncodeToString([]byte("a:b"))},
+		"base64 of nested call":     {text: `${base64(env("NAP_TEMPLATE_TEST"))}`, expected: base64.StdEncoding.EncodeToString([]byte("from os"))},
+		"env":                       {text: `${env("NAP_TEMPLATE_TEST")}`, expected: "from os"},
+		"env single quotes":         {text: `${env('NAP_TEMPLATE_TEST')}`, expected: "from os"},
+		"function with brace":       {text: `${base64("}")}`, expected: base64.StdEncoding.EncodeToString([]byte("}"))},
+		"wrong argument count":      {text: "${uuid(1)}", err: "uuid: expected 0 arguments, got 1"},
+		"unknown function is left":  {text: "${nope()}", expected: "${nope()}"},
+		"unset argument is left":    {text: "${base64(nope)}", expected: "${base64(nope)}"},
+		"function default":          {text: "${base64(nope):-fallback}", expected: "fallback"},
+		"script expression is left": {text: "`${a + b}`", expected: "`${a + b}`"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, err := naptemplate.Render(test.text, lookup)
+
+			if len(test.err) > 0 {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("Expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if len(test.pattern) > 0 {
+				if !regexp.MustCompile(test.pattern).MatchString(actual) {
+					t.Errorf("Expected a match for %s, got %s", test.pattern, actual)
+				}
+				return
+			}
+
+			if actual != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	befores := []string{}
+
+	actual, err := naptemplate.Substitute("x = ${name}; y = ${missing:-none} + ${missing}!", lookup, func(before string, value string, ok bool) string {
+		befores = append(befores, before)
+		return before + "<" + value + ":" + strconv.FormatBool(ok) + ">"
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "x = <nap:true>; y = <none:true> + <:false>!"; actual != expected {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+
+	if expected := []string{"x = ", "; y = ", " + "}; strings.Join(befores, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected the text before each expression to be %q, got %q", expected, befores)
+	}
+}
+
+func TestRenderYaml(t *testing.T) {
+	type document struct {
+		Name    string
+		Count   int
+		Quoted  string
+		Enabled bool
+		Headers map[string]string
+		List    []string
+		Body    string
+	}
+
+	variables["count"] = "42"
+	variables["enabled"] = "true"
+	variables["multiline"] = "line 1\nline 2"
+
+	tests := map[string]struct {
+		yaml     string
+		expected document
+		err      string
+	}{
+		"special characters stay in their field": {
+			yaml:     "name: ${tricky}\ncount: 1\n",
+			expected: document{Name: "a: b # c", Count: 1},
+		},
+		"values get their type": {
+			yaml:     "count: ${count}\nenabled: ${enabled}\nquoted: \"${count}\"\n",
+			expected: document{Count: 42, Enabled: true, Quoted: "42"},
+		},
+		"keys and nested values": {
+			yaml:     "headers:\n  X-${name}: ${tricky}\nlist:\n  - ${name}\n  - \"${nope:-x}\"\n",
+			expected: document{Headers: map[string]string{"X-nap": "a: b # c"}, List: []string{"nap", "x"}},
+		},
+		"multiline values": {
+			yaml:     "body: ${multiline}\nname: after\n",
+			expected: document{Body: "line 1\nline 2", Name: "after"},
+		},
+		"block scalars": {
+			yaml:     "body: |\n  hello ${name}\n  ${tricky}\n",
+			expected: document{Body: "hello nap\na: b # c\n"},
+		},
+		"undefined stays": {
+			yaml:     "name: ${nope}\n",
+			expected: document{Name: "${nope}"},
+		},
+		"errors": {
+			yaml: "name: ${nope:?must be set}\n",
+			err:  "nope: must be set",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			data, _, err := naptemplate.RenderYaml([]byte(test.yaml), lookup)
+
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			var actual document
+			if err := yaml.Unmarshal(data, &actual); err != nil {
+				t.Fatalf("Expected valid yaml, got %v:\n%s", err, data)
+			}
+
+			if actual.Name != test.expected.Name || actual.Count != test.expected.Count || actual.Quoted != test.expected.Quoted ||
+				actual.Enabled != test.expected.Enabled || actual.Body != test.expected.Body ||
+				strings.Join(actual.List, ",") != strings.Join(test.expected.List, ",") || len(actual.Headers) != len(test.expected.Headers) {
+				t.Errorf("Expected %+v, got %+v", test.expected, actual)
+			}
+
+			for k, v := range test.expected.Headers {
+				if actual.Headers[k] != v {
+					t.Errorf("Expected header %s=%s, got %s", k, v, actual.Headers[k])
+				}
+			}
+		})
+	}
+}
+
+
+func TestRenderYamlValueTypes(t *testing.T) {
+	variables["no"] = "no"
+	variables["on"] = "on"
+	variables["y"] = "y"
+
+	data, _, err := naptemplate.RenderYaml([]byte("answer: ${no}\nswitch: ${on}\nshort: ${y}\nenabled: ${enabled:-true}\ncount: ${count:-42}\n"), lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actual map[string]interface{}
+	if err := yaml.Unmarshal(data, &actual); err != nil {
+		t.Fatalf("Expected valid yaml, got %v:\n%s", err, data)
+	}
+
+	expected := map[string]interface{}{"answer": "no", "switch": "on", "short": "y", "enabled": true, "count": 42}
+	for k, v := range expected {
+		if actual[k] != v {
+			t.Errorf("Expected %s=%#v, got %#v", k, v, actual[k])
+		}
+	}
+}
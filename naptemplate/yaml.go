@@ -0,0 +1,171 @@
+/*
+Copyright © 2021 Bold City Software
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+yaml.go - this file contains logic for substituting expressions into the fields of a yaml document
+*/
+package naptemplate
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RenderYaml substitutes expressions into each key and value of a yaml document separately, so a value
+// can't change the document's structure however many special characters it has. the document is returned
+// as yaml again, ready to be unmarshalled, along with the references that couldn't be resolved
+func RenderYaml(data []byte, lookup Lookup) ([]byte, []*Reference, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, nil, err
+	}
+
+	if document.Kind == 0 {
+		return data, []*Reference{}, nil
+	}
+
+	renderer := &yamlRenderer{lookup: lookup, lines: strings.Split(string(data), "\n"), unresolved: []*Reference{}}
+
+	changed, err := renderer.render(&document, "")
+	if err != nil || !changed {
+		return data, renderer.unresolved, err
+	}
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+
+	if err := encoder.Encode(&document); err != nil {
+		return nil, nil, err
+	}
+
+	return buffer.Bytes(), renderer.unresolved, nil
+}
+
+type yamlRenderer struct {
+	lookup     Lookup
+	lines      []string
+	unresolved []*Reference
+}
+
+// render substitutes expressions into a node and the nodes under it. field is the path to the node, used
+// to report where unresolved references are
+func (renderer *yamlRenderer) render(node *yaml.Node, field string) (bool, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return renderer.renderScalar(node, field)
+	case yaml.MappingNode:
+		changed := false
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+
+			valueField := key.Value
+			if len(field) > 0 {
+				valueField = field + "." + key.Value
+			}
+
+			keyChanged, err := renderer.render(key, field)
+			if err != nil {
+				return false, err
+			}
+
+			valueChanged, err := renderer.render(value, valueField)
+			if err != nil {
+				return false, err
+			}
+
+			changed = changed || keyChanged || valueChanged
+		}
+
+		return changed, nil
+	default:
+		changed := false
+
+		for i, child := range node.Content {
+			childField := field
+			if node.Kind == yaml.SequenceNode {
+				childField = fmt.Sprintf("%s[%d]", field, i)
+			}
+
+			childChanged, err := renderer.render(child, childField)
+			if err != nil {
+				return false, err
+			}
+
+			changed = changed || childChanged
+		}
+
+		return changed, nil
+	}
+}
+
+func (renderer *yamlRenderer) renderScalar(node *yaml.Node, field string) (bool, error) {
+	if !strings.Contains(node.Value, "${") {
+		return false, nil
+	}
+
+	value, unresolved, err := render(node.Value, renderer.lookup)
+	if err != nil {
+		return false, fmt.Errorf("line %d: %w", node.Line, err)
+	}
+
+	for _, v := range unresolved {
+		v.Field = field
+		v.Line, v.Column = renderer.position(node, v)
+		renderer.unresolved = append(renderer.unresolved, v)
+	}
+
+	if value == node.Value {
+		return false, nil
+	}
+
+	node.Value = value
+
+	// an unquoted value gets its type from what it was replaced with, e.g. a number or a boolean. anything
+	// that's a string to yaml.v3 is quoted, as the document is read with yaml.v2, which reads values such as
+	// no, on and y as booleans
+	if node.Style == 0 {
+		node.Tag = ""
+
+		if node.ShortTag() == "!!str" {
+			node.Style = yaml.DoubleQuotedStyle
+		}
+	}
+
+	return true, nil
+}
+
+// position finds the line and column of a reference in the file
+func (renderer *yamlRenderer) position(node *yaml.Node, reference *Reference) (int, int) {
+	line := node.Line
+
+	// block scalars start on the line after their indicator
+	if node.Style == yaml.LiteralStyle || node.Style == yaml.FoldedStyle {
+		line++
+	}
+
+	line += strings.Count(node.Value[:reference.offset], "\n")
+
+	if line-1 < len(renderer.lines) {
+		if column := strings.Index(renderer.lines[line-1], reference.source); column >= 0 {
+			return line, column + 1
+		}
+	}
+
+	return node.Line, node.Column
+}